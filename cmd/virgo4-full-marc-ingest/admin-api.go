@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/uvalib/uva-aws-s3-sdk/uva-s3"
+)
+
+// the maximum number of runs returned by GET /runs
+var maxRunsListed = 500
+
+// AdminApi - the HTTP control plane
+type AdminApi struct {
+	cfg    *ServiceConfig
+	s3Svc  uva_s3.UvaS3
+	ingest chan []InboundFile // runs requested through the API
+}
+
+// IngestRequest - the body of POST /ingest
+type IngestRequest struct {
+	Bucket string   `json:"bucket"`
+	Keys   []string `json:"keys"`
+}
+
+// NewAdminApi - create the admin API
+func NewAdminApi(cfg *ServiceConfig, s3Svc uva_s3.UvaS3) *AdminApi {
+	return &AdminApi{cfg: cfg, s3Svc: s3Svc, ingest: make(chan []InboundFile, 1)}
+}
+
+// register the admin endpoints
+func (a *AdminApi) register(mux *http.ServeMux) {
+	mux.HandleFunc("/status", a.authorized("GET", a.status))
+	mux.HandleFunc("/pause", a.authorized("POST", a.pause))
+	mux.HandleFunc("/resume", a.authorized("POST", a.resume))
+	mux.HandleFunc("/abort", a.authorized("POST", a.abort))
+	mux.HandleFunc("/ingest", a.authorized("POST", a.requestIngest))
+	mux.HandleFunc("/runs", a.authorized("GET", a.runs))
+}
+
+// ensure the method is correct and the request has the admin token
+func (a *AdminApi) authorized(method string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			writeJsonError(w, http.StatusMethodNotAllowed, fmt.Sprintf("%s required", method))
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.cfg.AdminToken)) != 1 {
+			log.Printf("WARNING: unauthorized admin request %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+			writeJsonError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		log.Printf("INFO: admin request %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+		handler(w, r)
+	}
+}
+
+func (a *AdminApi) status(w http.ResponseWriter, r *http.Request) {
+	run := getActiveRun()
+	if run == nil {
+		writeJson(w, http.StatusOK, map[string]interface{}{"state": "idle", "ingest_pending": len(a.ingest) != 0})
+		return
+	}
+	writeJson(w, http.StatusOK, map[string]interface{}{"state": "running", "run": run.Status()})
+}
+
+func (a *AdminApi) pause(w http.ResponseWriter, r *http.Request) {
+	run := getActiveRun()
+	if run == nil {
+		writeJsonError(w, http.StatusConflict, "no run in progress")
+		return
+	}
+	log.Printf("INFO: pausing run %s", run.Status().RunId)
+	run.control.Pause()
+	writeJson(w, http.StatusOK, run.Status())
+}
+
+func (a *AdminApi) resume(w http.ResponseWriter, r *http.Request) {
+	run := getActiveRun()
+	if run == nil {
+		writeJsonError(w, http.StatusConflict, "no run in progress")
+		return
+	}
+	log.Printf("INFO: resuming run %s", run.Status().RunId)
+	run.control.Resume()
+	writeJson(w, http.StatusOK, run.Status())
+}
+
+func (a *AdminApi) abort(w http.ResponseWriter, r *http.Request) {
+	run := getActiveRun()
+	if run == nil {
+		writeJsonError(w, http.StatusConflict, "no run in progress")
+		return
+	}
+	log.Printf("INFO: aborting run %s", run.Status().RunId)
+	run.control.Abort()
+	writeJson(w, http.StatusAccepted, run.Status())
+}
+
+func (a *AdminApi) requestIngest(w http.ResponseWriter, r *http.Request) {
+
+	request := IngestRequest{}
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil || request.Bucket == "" || len(request.Keys) == 0 {
+		writeJsonError(w, http.StatusBadRequest, "a bucket and one or more keys are required")
+		return
+	}
+
+	if getActiveRun() != nil {
+		writeJsonError(w, http.StatusConflict, "a run is already in progress")
+		return
+	}
+
+	// make sure the files exist, we also need their sizes
+	inbound := make([]InboundFile, 0, len(request.Keys))
+	for _, key := range request.Keys {
+		o, err := a.s3Svc.StatObject(uva_s3.NewUvaS3Object(request.Bucket, key))
+		if err != nil {
+			writeJsonError(w, http.StatusBadRequest, fmt.Sprintf("%s/%s: %s", request.Bucket, key, err.Error()))
+			return
+		}
+		inbound = append(inbound, InboundFile{SourceBucket: request.Bucket, SourceKey: key, ObjectSize: o.Size()})
+	}
+
+	select {
+	case a.ingest <- inbound:
+		log.Printf("INFO: ingest of %d file(s) from %s requested", len(inbound), request.Bucket)
+		writeJson(w, http.StatusAccepted, map[string]interface{}{"files": inbound})
+	default:
+		writeJsonError(w, http.StatusConflict, "an ingest request is already pending")
+	}
+}
+
+func (a *AdminApi) runs(w http.ResponseWriter, r *http.Request) {
+
+	if a.cfg.RunLedger == false {
+		writeJsonError(w, http.StatusNotFound, "run ledger is not enabled")
+		return
+	}
+
+	limit := 20
+	if s := r.URL.Query().Get("limit"); s != "" {
+		l, err := strconv.Atoi(s)
+		if err != nil || l <= 0 || l > maxRunsListed {
+			writeJsonError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxRunsListed))
+			return
+		}
+		limit = l
+	}
+
+	runs, err := ledgerListRuns(limit)
+	if err != nil {
+		log.Printf("ERROR: listing runs (%s)", err.Error())
+		writeJsonError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJson(w, http.StatusOK, runs)
+}
+
+func writeJson(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(body)
+	if err != nil {
+		log.Printf("WARNING: writing response (%s)", err.Error())
+	}
+}
+
+func writeJsonError(w http.ResponseWriter, status int, message string) {
+	writeJson(w, status, map[string]string{"error": message})
+}
+
+//
+// end of file
+//
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+
+	"github.com/uvalib/uva-aws-s3-sdk/uva-s3"
+)
+
+// save a local file as a run artifact. If an artifact bucket is configured the file is uploaded
+// and the local copy removed, otherwise the local file is left in place. A dry run never uploads
+// artifacts, a real run could mistake them for its own
+func saveArtifact(cfg *ServiceConfig, s3Svc uva_s3.UvaS3, localName string, artifactName string) error {
+
+	if cfg.ArtifactBucket == "" || cfg.DryRun == true {
+		if cfg.DryRun == true && cfg.ArtifactBucket != "" {
+			log.Printf("INFO: DRY RUN, not uploading artifact %s", artifactName)
+		}
+		log.Printf("INFO: artifact %s available locally as %s", artifactName, localName)
+		return nil
+	}
+
+	key := path.Join(cfg.ArtifactPrefix, artifactName)
+	log.Printf("INFO: uploading artifact %s to %s/%s", localName, cfg.ArtifactBucket, key)
+
+	o := uva_s3.NewUvaS3Object(cfg.ArtifactBucket, key)
+	err := s3Svc.PutFromFile(o, localName)
+	if err != nil {
+		log.Printf("ERROR: uploading artifact %s (%s)", artifactName, err.Error())
+		return err
+	}
+
+	return os.Remove(localName)
+}
+
+// generate a reasonably unique artifact name
+func artifactName(dataSource string, runId string, suffix string) string {
+	return fmt.Sprintf("%s/%s-%s", dataSource, runId, suffix)
+}
+
+//
+// end of file
+//
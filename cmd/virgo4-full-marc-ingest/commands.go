@@ -0,0 +1,582 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/uvalib/uva-aws-s3-sdk/uva-s3"
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+var ErrUsage = fmt.Errorf("usage error")
+var ErrValidationFailed = fmt.Errorf("file failed validation")
+var ErrRecordNotFound = fmt.Errorf("record not found")
+
+// the data source used by the offline commands, there is no service configuration
+var commandDataSource = "unknown"
+
+// an offline command
+type command struct {
+	usage string
+	help  string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"validate": {usage: "validate <file>", help: "validate every record and report any problems", run: validateCommand},
+	"stats":    {usage: "stats [-json] <file>", help: "report record counts, duplicate ids, lengths and record types", run: statsCommand},
+	"get":      {usage: "get [-format text|xml|json|raw] <file> <id>", help: "output the record(s) with the specified id", run: getCommand},
+	"diff":     {usage: "diff [-old-hashes] [-fields] [-json] [-tmp <dir>] <old> <new>", help: "report the ids added, removed and changed between 2 files", run: diffCommand},
+	"split":    {usage: "split -chunks <n> [-out <dir>] <file>", help: "split a file into n chunks at record boundaries", run: splitCommand},
+	"replay":   {usage: "replay [-bucket <bucket>] <spill file>", help: "resend spilled records (uses the service configuration)", run: replayCommand},
+}
+
+// the name used to list the offline commands
+var helpCommand = "help"
+
+// is the name an offline command
+func isCommand(name string) bool {
+	_, ok := commands[name]
+	return ok == true || name == helpCommand
+}
+
+// run an offline command, returns the process exit status
+func runCommand(args []string) int {
+
+	if args[0] == helpCommand {
+		commandUsage()
+		return 0
+	}
+
+	cmd, ok := commands[args[0]]
+	if ok == false {
+		commandUsage()
+		return 2
+	}
+
+	err := cmd.run(args[1:])
+	if err == ErrUsage {
+		fmt.Fprintf(os.Stderr, "usage: %s %s\n", filepath.Base(os.Args[0]), cmd.usage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err.Error())
+		return 1
+	}
+	return 0
+}
+
+func commandUsage() {
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(os.Stderr, "usage: %s (runs the ingest service)\n", filepath.Base(os.Args[0]))
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "       %s %-45s %s\n", filepath.Base(os.Args[0]), commands[name].usage, commands[name].help)
+	}
+}
+
+// parse the command flags and ensure we have the expected number of arguments
+func parseCommandFlags(flags *flag.FlagSet, args []string, expected int) error {
+
+	flags.SetOutput(ioutil.Discard)
+	err := flags.Parse(args)
+	if err != nil || flags.NArg() != expected {
+		return ErrUsage
+	}
+	return nil
+}
+
+// validate every record in the file, reporting problems as we go
+func validateCommand(args []string) error {
+
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	if parseCommandFlags(flags, args, 1) != nil {
+		return ErrUsage
+	}
+	name := flags.Arg(0)
+
+	loader, err := NewRecordLoader(commandDataSource, name, name)
+	if err != nil {
+		return err
+	}
+	defer loader.Done()
+
+	index := 0
+	problems := 0
+	offset := int64(0)
+	rec, err := loader.First(false)
+	for {
+		if err == io.EOF {
+			break
+		}
+
+		// we cannot reliably locate the next record so this is the end of the line
+		if err != nil {
+			fmt.Printf("record %d (offset %d): %s, cannot continue\n", index, offset, err.Error())
+			problems++
+			break
+		}
+
+		id, _ := rec.Id()
+		if rec.Repaired() == true {
+			fmt.Printf("record %d (offset %d, id %s): malformed record terminator, repaired\n", index, offset, id)
+			problems++
+		} else {
+			_, err = parseMarcRecord(rec.Raw())
+			if err != nil {
+				fmt.Printf("record %d (offset %d, id %s): %s\n", index, offset, id, err.Error())
+				problems++
+			} else if invalidUtf8(rec.Raw()) == true {
+				fmt.Printf("record %d (offset %d, id %s): record claims to be Unicode but contains invalid UTF-8\n", index, offset, id)
+				problems++
+			}
+		}
+
+		index++
+		offset = loader.Offset()
+		rec, err = loader.Next(false)
+	}
+
+	fmt.Printf("%s: %d records, %d problems\n", name, index, problems)
+	if problems != 0 {
+		return ErrValidationFailed
+	}
+	return nil
+}
+
+// the upper bounds of the record length histogram buckets, the last bucket holds anything larger
+var lengthBuckets = []int{1024, 2048, 4096, 8192, 16384, 32768, 65536, 100000}
+
+// the record types from leader position 06
+var recordTypes = map[byte]string{
+	'a': "language material",
+	'c': "notated music",
+	'd': "manuscript notated music",
+	'e': "cartographic material",
+	'f': "manuscript cartographic material",
+	'g': "projected medium",
+	'i': "nonmusical sound recording",
+	'j': "musical sound recording",
+	'k': "two-dimensional nonprojectable graphic",
+	'm': "computer file",
+	'o': "kit",
+	'p': "mixed materials",
+	'r': "three-dimensional artifact",
+	't': "manuscript language material",
+	'u': "holdings (unknown)",
+	'v': "holdings (multipart)",
+	'x': "holdings (single-part)",
+	'y': "holdings (serial)",
+	'z': "authority",
+}
+
+// FileStats - the statistics reported by the stats command
+type FileStats struct {
+	File            string         `json:"file"`
+	Records         int            `json:"records"`
+	Bytes           int64          `json:"bytes"`
+	UniqueIds       int            `json:"unique_ids"`
+	MergedRecords   int            `json:"merged_records"`
+	DuplicateIds    int            `json:"duplicate_ids"`
+	RepairedRecords int            `json:"repaired_records"`
+	MinLength       int            `json:"min_length"`
+	MaxLength       int            `json:"max_length"`
+	Lengths         map[string]int `json:"lengths"`
+	RecordTypes     map[string]int `json:"record_types"`
+}
+
+// report statistics on the file
+func statsCommand(args []string) error {
+
+	flags := flag.NewFlagSet("stats", flag.ContinueOnError)
+	asJson := flags.Bool("json", false, "output as JSON")
+	if parseCommandFlags(flags, args, 1) != nil {
+		return ErrUsage
+	}
+	name := flags.Arg(0)
+
+	loader, err := NewRecordLoader(commandDataSource, name, name)
+	if err != nil {
+		return err
+	}
+	defer loader.Done()
+
+	// ids go to disk, a full dump has too many to hold in memory
+	ids, err := NewIdSpool("", "marc-stats-ids-*")
+	if err != nil {
+		return err
+	}
+	defer ids.Remove()
+
+	stats := FileStats{File: name, Lengths: make(map[string]int), RecordTypes: make(map[string]int)}
+	lengthCounts := make([]int, len(lengthBuckets)+1)
+	previousId := ""
+	groups := 0
+
+	// read the physical records, adjacent records with the same id are merged during ingest
+	rec, err := loader.First(false)
+	for ; err == nil; rec, err = loader.Next(false) {
+		raw := rec.Raw()
+		id, _ := rec.Id()
+
+		stats.Records++
+		stats.Bytes += int64(len(raw))
+		if stats.MinLength == 0 || len(raw) < stats.MinLength {
+			stats.MinLength = len(raw)
+		}
+		if len(raw) > stats.MaxLength {
+			stats.MaxLength = len(raw)
+		}
+		if rec.Repaired() == true {
+			stats.RepairedRecords++
+		}
+
+		bucket := sort.SearchInts(lengthBuckets, len(raw)+1)
+		lengthCounts[bucket]++
+
+		recordType := "unknown"
+		if len(raw) > 6 {
+			if description, ok := recordTypes[raw[6]]; ok == true {
+				recordType = fmt.Sprintf("%c (%s)", raw[6], description)
+			} else {
+				recordType = fmt.Sprintf("%c (unknown)", raw[6])
+			}
+		}
+		stats.RecordTypes[recordType]++
+
+		if id == previousId {
+			stats.MergedRecords++
+			continue
+		}
+		previousId = id
+		groups++
+		err = ids.Add(id)
+		if err != nil {
+			return err
+		}
+	}
+	if err != io.EOF {
+		return fmt.Errorf("record %d (offset %d): %s", stats.Records, loader.Offset(), err.Error())
+	}
+
+	// sorting removes duplicates so the difference is the number of repeated ids
+	err = ids.Close()
+	if err != nil {
+		return err
+	}
+	sorted, err := sortSpoolFile("", ids.Name)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(sorted)
+	stats.UniqueIds, err = countSortedIds(sorted)
+	if err != nil {
+		return err
+	}
+	stats.DuplicateIds = groups - stats.UniqueIds
+
+	for ix, count := range lengthCounts {
+		if count != 0 {
+			stats.Lengths[lengthBucketLabel(ix)] = count
+		}
+	}
+
+	if *asJson == true {
+		buf, err := json.MarshalIndent(stats, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(buf))
+		return nil
+	}
+
+	fmt.Printf("file:              %s\n", stats.File)
+	fmt.Printf("records:           %d\n", stats.Records)
+	fmt.Printf("bytes:             %d\n", stats.Bytes)
+	fmt.Printf("unique ids:        %d\n", stats.UniqueIds)
+	fmt.Printf("merged records:    %d (adjacent records sharing an id)\n", stats.MergedRecords)
+	fmt.Printf("duplicate ids:     %d (non-adjacent records sharing an id)\n", stats.DuplicateIds)
+	fmt.Printf("repaired records:  %d\n", stats.RepairedRecords)
+	fmt.Printf("record length:     %d - %d\n", stats.MinLength, stats.MaxLength)
+	for ix, count := range lengthCounts {
+		fmt.Printf("  %-15s  %d\n", lengthBucketLabel(ix), count)
+	}
+	fmt.Printf("record types:\n")
+	types := make([]string, 0, len(stats.RecordTypes))
+	for t := range stats.RecordTypes {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for _, t := range types {
+		fmt.Printf("  %-45s  %d\n", t, stats.RecordTypes[t])
+	}
+	return nil
+}
+
+// the label for a record length histogram bucket
+func lengthBucketLabel(ix int) string {
+	lower := 0
+	if ix != 0 {
+		lower = lengthBuckets[ix-1]
+	}
+	if ix == len(lengthBuckets) {
+		return fmt.Sprintf(">= %d", lower)
+	}
+	return fmt.Sprintf("%d - %d", lower, lengthBuckets[ix]-1)
+}
+
+// count the ids in a sorted id file
+func countSortedIds(name string) (int, error) {
+
+	reader, err := NewIdReader(name)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	count := 0
+	for {
+		_, err = reader.Next()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		count++
+	}
+}
+
+// output the record(s) with the specified id
+func getCommand(args []string) error {
+
+	flags := flag.NewFlagSet("get", flag.ContinueOnError)
+	format := flags.String("format", "text", "output format (text, xml, json or raw)")
+	if parseCommandFlags(flags, args, 2) != nil {
+		return ErrUsage
+	}
+	name := flags.Arg(0)
+	wanted := flags.Arg(1)
+
+	if *format != "text" && *format != "xml" && *format != "json" && *format != "raw" {
+		return ErrUsage
+	}
+
+	loader, err := NewRecordLoader(commandDataSource, name, name)
+	if err != nil {
+		return err
+	}
+	defer loader.Done()
+
+	// find every physical record with the id, there may be several
+	found := make([]Record, 0)
+	rec, err := loader.First(false)
+	for ; err == nil; rec, err = loader.Next(false) {
+		id, _ := rec.Id()
+		if id == wanted {
+			found = append(found, rec)
+		}
+	}
+	if err != io.EOF {
+		return err
+	}
+	if len(found) == 0 {
+		return ErrRecordNotFound
+	}
+
+	if *format == "raw" {
+		for _, rec := range found {
+			_, err = os.Stdout.Write(rec.Raw())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	parsed := make([]*MarcRecord, 0, len(found))
+	for _, rec := range found {
+		marc, err := parseMarcRecord(rec.Raw())
+		if err != nil {
+			return err
+		}
+		parsed = append(parsed, marc)
+	}
+
+	switch *format {
+	case "xml":
+		buf, err := marcXml(parsed)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(buf))
+	case "json":
+		buf, err := marcJson(parsed)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(buf))
+	default:
+		texts := make([]string, 0, len(parsed))
+		for _, marc := range parsed {
+			texts = append(texts, marc.Text())
+		}
+		fmt.Print(strings.Join(texts, "\n"))
+	}
+	return nil
+}
+
+// split a file into chunks of roughly equal size, keeping records that share an id together
+func splitCommand(args []string) error {
+
+	flags := flag.NewFlagSet("split", flag.ContinueOnError)
+	chunks := flags.Int("chunks", 0, "the number of chunks")
+	outDir := flags.String("out", "", "the output directory (defaults to the input file directory)")
+	if parseCommandFlags(flags, args, 1) != nil || *chunks < 2 {
+		return ErrUsage
+	}
+	name := flags.Arg(0)
+
+	info, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	dir := *outDir
+	if dir == "" {
+		dir = filepath.Dir(name)
+	}
+	base := strings.TrimSuffix(filepath.Base(name), filepath.Ext(name))
+	ext := filepath.Ext(name)
+	if ext == "" {
+		ext = ".mrc"
+	}
+
+	loader, err := NewRecordLoader(commandDataSource, name, name)
+	if err != nil {
+		return err
+	}
+	defer loader.Done()
+
+	target := info.Size() / int64(*chunks)
+	chunk := 0
+	written := int64(0)
+	chunkBytes := int64(0)
+	var file *os.File
+	var writer *bufio.Writer
+
+	closeChunk := func() error {
+		if file == nil {
+			return nil
+		}
+		err := writer.Flush()
+		if err != nil {
+			file.Close()
+			return err
+		}
+		fmt.Printf("%s: %d bytes\n", file.Name(), chunkBytes)
+		return file.Close()
+	}
+
+	rec, err := loader.First(true)
+	for ; err == nil; rec, err = loader.Next(true) {
+
+		// time for the next chunk (the last chunk takes whatever is left)
+		if file == nil || (written >= target*int64(chunk) && chunk < *chunks) {
+			err = closeChunk()
+			if err != nil {
+				return err
+			}
+			chunk++
+			file, err = os.Create(filepath.Join(dir, fmt.Sprintf("%s-%04d%s", base, chunk, ext)))
+			if err != nil {
+				return err
+			}
+			writer = bufio.NewWriter(file)
+			chunkBytes = 0
+		}
+
+		_, err = writer.Write(rec.Raw())
+		if err != nil {
+			file.Close()
+			return err
+		}
+		written += int64(len(rec.Raw()))
+		chunkBytes += int64(len(rec.Raw()))
+	}
+	if err != io.EOF {
+		if file != nil {
+			file.Close()
+		}
+		return fmt.Errorf("offset %d: %s", loader.Offset(), err.Error())
+	}
+
+	return closeChunk()
+}
+
+// resend the records in a spill file using the configured outbound sink
+func replayCommand(args []string) error {
+
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	bucket := flags.String("bucket", "", "the bucket the spill file was uploaded to")
+	if parseCommandFlags(flags, args, 1) != nil {
+		return ErrUsage
+	}
+	name := flags.Arg(0)
+
+	cfg := LoadConfiguration()
+	aws, err := awssqs.NewAwsSqs(awssqs.AwsSqsConfig{MessageBucketName: cfg.MessageBucketName})
+	if err != nil {
+		return err
+	}
+	sink, err := newOutboundSink(cfg, aws)
+	if err != nil {
+		return err
+	}
+	defer sink.Close()
+
+	// spill files saved as run artifacts are downloaded first
+	if *bucket != "" {
+		s3Svc, err := uva_s3.NewUvaS3(uva_s3.UvaS3Config{Logging: true})
+		if err != nil {
+			return err
+		}
+		tmp, err := ioutil.TempFile(cfg.DownloadDir, "replay-*.jsonl")
+		if err != nil {
+			return err
+		}
+		tmp.Close()
+		defer os.Remove(tmp.Name())
+
+		err = s3Svc.GetToFile(uva_s3.NewUvaS3Object(*bucket, name), tmp.Name())
+		if err != nil {
+			return err
+		}
+		name = tmp.Name()
+	}
+
+	replayed, failedName, err := replaySpillFile(context.Background(), cfg, sink, name)
+	fmt.Printf("%d records resent\n", replayed)
+	if failedName != "" {
+		fmt.Printf("records that could not be resent are in %s\n", failedName)
+	}
+	return err
+}
+
+//
+// end of file
+//
@@ -1,10 +1,13 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 	"strconv"
 	"strings"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
 )
 
 // ServiceConfig defines all of the service configuration parameters
@@ -14,6 +17,32 @@ type ServiceConfig struct {
 	CacheQueueName string // SQS queue name for cache documents (typically records go to the cache)
 	PollTimeOut    int64  // the SQS queue timeout (in seconds)
 
+	Sink           string            // the outbound sink (sqs, file, http or kafka)
+	SourceSinks    map[string]string // data sources sent to a different sink
+	SinkFile       string            // the file written by the file sink
+	SinkFileFormat string            // the file sink format (json or marc)
+	SinkHttpUrl    string            // the endpoint the http sink posts to
+	SinkHttpToken  string            // the bearer token sent by the http sink (optional)
+	KafkaBrokers   []string          // the kafka sink brokers
+	KafkaTopic     string            // the kafka sink topic
+
+	MaxBatchBytes   int  // the maximum size of an outbound batch (in bytes)
+	CompressPayload bool // gzip the MARC before encoding the outbound payload
+	SpillFailures   bool // spill records that cannot be sent and resend them at the end of the run
+
+	Provenance      []string           // the provenance attributes attached to outbound messages, packed into one attribute for SQS (optional)
+	DuplicatePolicy string             // what to do with ids repeated within a file (all, first, last, merge or reject)
+	Filter          *RecordFilter      // the rules that exclude records from the ingest (nil if there are none)
+	Transformer     *RecordTransformer // the transform pipeline applied to records before they are sent (nil if there is none)
+	Marc8Converter  *Marc8Converter    // converts MARC-8 records to UTF-8 (nil if not converting)
+
+	MaxRecordsPerSecond   int      // the outbound record rate limit, shared by all workers (0 is unlimited)
+	MaxBatchesPerSecond   int      // the outbound batch rate limit, shared by all workers (0 is unlimited)
+	BackpressureQueues    []string // the queues monitored for backpressure
+	BackpressureHighWater int      // hold the reader when a monitored queue is deeper than this (0 disables)
+	BackpressureLowWater  int      // release the reader when no monitored queue is deeper than this
+	BackpressurePollTime  int      // the time between queue depth checks (in seconds)
+
 	DataSource        string // the name to associate the data with. Each record has metadata showing this value
 	MessageBucketName string // the bucket to use for large messages
 	DownloadDir       string // the S3 file download directory (local)
@@ -40,8 +69,70 @@ type ServiceConfig struct {
 	PostgresPass     string // database password
 	PostgresDatabase string // database name
 
+	DryRun bool // exercise the pipeline without stopping services, sending records or deleting anything
+
 	DeleteCache bool // do we delete the cache after processing
 	DeleteSolr  bool // do we delete the cache after processing
+
+	SolrCollectionSwap   bool   // ingest into a new collection and swap the aliases rather than deleting old records
+	SolrReadAlias        string // the collection alias used by clients to query the index
+	SolrWriteAlias       string // the collection alias used by the indexers to update the index
+	SolrConfigSet        string // the configset used when creating a new collection
+	SolrCollectionPrefix string // the prefix used when naming new collections
+	SolrShards           int    // the number of shards for a new collection
+	SolrReplicas         int    // the replication factor for a new collection
+	SolrMinDocPercent    int    // the minimum document count (as a percentage of records ingested) before we swap
+	SolrRetainHours      int    // the time to retain previous collections (in hours)
+
+	ReconcileDeletes    bool // delete records by comparing ids with those ingested rather than by timestamp
+	ReconcileBatchSize  int  // the number of ids queried or deleted in a single request
+	ReconcileMaxDeletes int  // the maximum number of records a reconciliation may delete (0 is unlimited)
+
+	CacheDeleteMax        int // the maximum number of cache records we will delete after processing (0 is unlimited)
+	CacheDeleteBatchSize  int // the number of cache records deleted in a single statement
+	CacheDeletePause      int // the time to pause between cache delete batches (in milliseconds)
+	CacheStatementTimeout int // the statement timeout applied to cache delete queries (in seconds, 0 is none)
+
+	RunLedger      bool // record each run in the ingest run ledger tables
+	ResumeRuns     bool // resume interrupted runs on restart (requires the run ledger)
+	ResumeAttempts int  // the number of times we will attempt to resume an interrupted run
+
+	RunLock             bool // hold a distributed lock while a run has the managed services stopped
+	RunLockStaleTimeout int  // the time without a heartbeat before a lock holder is considered stale (in seconds)
+	RunLockPollTime     int  // the time between attempts to acquire the lock (in seconds)
+	RunLockHeartbeat    int  // the time between lock holder heartbeats (in seconds)
+
+	ArtifactBucket string // the bucket to upload run artifacts to (blank leaves them in the download directory)
+	ArtifactPrefix string // the key prefix for uploaded run artifacts
+	HashStore      bool   // save the ids and hashes of the ingested records as a run artifact
+	RunReport      bool   // upload a JSON report at the end of each run
+	ReportBucket   string // the bucket for run reports (blank puts them next to the input)
+	ReportPrefix   string // the key prefix for run reports when a report bucket is configured
+
+	HttpListen string // the HTTP listen address for metrics (blank disables the HTTP server)
+	AdminToken string // the bearer token required by the admin API (blank disables the admin API)
+
+	NotifyWebhooks     []string // generic webhooks sent run notifications
+	NotifySlackWebhook string   // a Slack compatible incoming webhook sent run notifications
+	NotifyEvents       []string // the events notified (start, success, failure, warning)
+	SmtpHost           string   // the SMTP server for email notifications (blank disables email)
+	SmtpPort           int      // the SMTP server port
+	SmtpUser           string   // the SMTP user (blank for no authentication)
+	SmtpPass           string   // the SMTP password
+	SmtpFrom           string   // the email sender
+	SmtpTo             []string // the email recipients
+
+	TraceEndpoint    string  // the OTLP/HTTP collector URL for traces (blank disables tracing)
+	TraceServiceName string  // the service name reported with traces
+	TraceSampleRatio float64 // the fraction of runs traced
+
+	PhaseTimeout int // the longest a run phase is expected to take before the service is considered unhealthy (in seconds)
+	MinFreeSpace int // the free space required in the download directory for the service to be ready (in MB)
+
+	LogFormat       string   // the log format (text or json)
+	LogLevel        LogLevel // the minimum level logged
+	RecordLogLevel  LogLevel // the minimum level logged for per-record lines from the MARC loader
+	RecordLogSample int      // only log 1 in this many per-record lines below ERROR
 }
 
 func envWithDefault(env string, defaultValue string) string {
@@ -93,19 +184,126 @@ func envToBool(env string, defValue string) bool {
 	return b
 }
 
+func envToIntWithDefault(env string, defValue string) int {
+
+	number := envWithDefault(env, defValue)
+	n, err := strconv.Atoi(number)
+	fatalIfError(err)
+	return n
+}
+
+func envToFloatWithDefault(env string, defValue string) float64 {
+
+	number := envWithDefault(env, defValue)
+	n, err := strconv.ParseFloat(number, 64)
+	fatalIfError(err)
+	return n
+}
+
 func splitMultiple(env string) []string {
 	return strings.Split(env, " ")
 }
 
+// like splitMultiple but a blank value is an empty list
+func splitOptional(env string) []string {
+	return strings.Fields(env)
+}
+
+// parse a list of source=sink pairs
+func splitSourceSinks(env string) map[string]string {
+	sinks := make(map[string]string)
+	for _, pair := range splitOptional(env) {
+		source, sink, found := strings.Cut(pair, "=")
+		if found == false || source == "" || sink == "" {
+			log.Printf("FATAL ERROR: bad source sink [%s], expected source=sink", pair)
+			os.Exit(1)
+		}
+		sinks[source] = sink
+	}
+	return sinks
+}
+
+// is the specified sink used as the default or for any data source
+func (cfg *ServiceConfig) usesSink(name string) bool {
+	if cfg.Sink == name {
+		return true
+	}
+	for _, s := range cfg.SourceSinks {
+		if s == name {
+			return true
+		}
+	}
+	return false
+}
+
+// secrets are never logged but it is useful to know if they are set
+func redactIfSet(value string) string {
+	if value == "" {
+		return ""
+	}
+	return "REDACTED"
+}
+
 // LoadConfiguration will load the service configuration from env/cmdline
 // and return a pointer to it. Any failures are fatal.
 func LoadConfiguration() *ServiceConfig {
 
 	var cfg ServiceConfig
 
+	// configure logging first so everything else is logged as configured
+	var err error
+	cfg.LogFormat = envWithDefault("VIRGO4_FULL_MARC_INGEST_LOG_FORMAT", "text")
+	cfg.LogLevel, err = parseLogLevel(envWithDefault("VIRGO4_FULL_MARC_INGEST_LOG_LEVEL", "info"))
+	fatalIfError(err)
+	cfg.RecordLogLevel, err = parseLogLevel(envWithDefault("VIRGO4_FULL_MARC_INGEST_RECORD_LOG_LEVEL", "info"))
+	fatalIfError(err)
+	cfg.RecordLogSample = envToIntWithDefault("VIRGO4_FULL_MARC_INGEST_RECORD_LOG_SAMPLE", "1")
+	if cfg.LogFormat != "text" && cfg.LogFormat != "json" {
+		log.Printf("FATAL ERROR: log format must be text or json")
+		os.Exit(1)
+	}
+	configureLogging(cfg.LogFormat, cfg.LogLevel, cfg.RecordLogLevel, cfg.RecordLogSample)
+
 	cfg.InQueueName = ensureSetAndNonEmpty("VIRGO4_FULL_MARC_INGEST_IN_QUEUE")
-	cfg.OutQueueName = ensureSetAndNonEmpty("VIRGO4_FULL_MARC_INGEST_OUT_QUEUE")
-	cfg.CacheQueueName = envWithDefault("VIRGO4_FULL_MARC_INGEST_CACHE_QUEUE", "")
+	cfg.Sink = envWithDefault("VIRGO4_FULL_MARC_INGEST_SINK", SinkSqs)
+	cfg.SourceSinks = splitSourceSinks(envWithDefault("VIRGO4_FULL_MARC_INGEST_SOURCE_SINKS", ""))
+	cfg.MaxBatchBytes = envToIntWithDefault("VIRGO4_FULL_MARC_INGEST_MAX_BATCH_BYTES", fmt.Sprintf("%d", awssqs.MAX_SQS_BLOCK_SIZE))
+	cfg.CompressPayload = envToBool("VIRGO4_FULL_MARC_INGEST_COMPRESS_PAYLOAD", "false")
+	cfg.SpillFailures = envToBool("VIRGO4_FULL_MARC_INGEST_SPILL_FAILURES", "true")
+	cfg.Provenance, err = splitProvenance(envWithDefault("VIRGO4_FULL_MARC_INGEST_PROVENANCE", ""))
+	fatalIfError(err)
+	cfg.DuplicatePolicy = envWithDefault("VIRGO4_FULL_MARC_INGEST_DUPLICATE_POLICY", DuplicatesSendAll)
+	fatalIfError(checkDuplicatePolicy(cfg.DuplicatePolicy))
+	cfg.Filter, err = NewRecordFilter(envWithDefault("VIRGO4_FULL_MARC_INGEST_FILTER_RULES", ""))
+	fatalIfError(err)
+	cfg.Transformer, err = NewRecordTransformer(envWithDefault("VIRGO4_FULL_MARC_INGEST_TRANSFORMS", ""))
+	fatalIfError(err)
+	if envToBool("VIRGO4_FULL_MARC_INGEST_CONVERT_MARC8", "false") == true {
+		cfg.Marc8Converter, err = NewMarc8Converter(envWithDefault("VIRGO4_FULL_MARC_INGEST_MARC8_CODE_TABLES", ""))
+		fatalIfError(err)
+	}
+	if cfg.usesSink(SinkSqs) == true {
+		cfg.OutQueueName = ensureSetAndNonEmpty("VIRGO4_FULL_MARC_INGEST_OUT_QUEUE")
+		cfg.CacheQueueName = envWithDefault("VIRGO4_FULL_MARC_INGEST_CACHE_QUEUE", "")
+	}
+	cfg.MaxRecordsPerSecond = envToIntWithDefault("VIRGO4_FULL_MARC_INGEST_MAX_RECORDS_PER_SECOND", "0")
+	cfg.MaxBatchesPerSecond = envToIntWithDefault("VIRGO4_FULL_MARC_INGEST_MAX_BATCHES_PER_SECOND", "0")
+	cfg.BackpressureQueues = splitOptional(envWithDefault("VIRGO4_FULL_MARC_INGEST_BACKPRESSURE_QUEUES", cfg.OutQueueName))
+	cfg.BackpressureHighWater = envToIntWithDefault("VIRGO4_FULL_MARC_INGEST_BACKPRESSURE_HIGH_WATER", "0")
+	cfg.BackpressureLowWater = envToIntWithDefault("VIRGO4_FULL_MARC_INGEST_BACKPRESSURE_LOW_WATER", fmt.Sprintf("%d", cfg.BackpressureHighWater/2))
+	cfg.BackpressurePollTime = envToIntWithDefault("VIRGO4_FULL_MARC_INGEST_BACKPRESSURE_POLL_TIME", "30")
+	if cfg.usesSink(SinkFile) == true {
+		cfg.SinkFile = ensureSetAndNonEmpty("VIRGO4_FULL_MARC_INGEST_SINK_FILE")
+		cfg.SinkFileFormat = envWithDefault("VIRGO4_FULL_MARC_INGEST_SINK_FILE_FORMAT", SinkFormatJson)
+	}
+	if cfg.usesSink(SinkHttp) == true {
+		cfg.SinkHttpUrl = ensureSetAndNonEmpty("VIRGO4_FULL_MARC_INGEST_SINK_HTTP_URL")
+		cfg.SinkHttpToken = envWithDefault("VIRGO4_FULL_MARC_INGEST_SINK_HTTP_TOKEN", "")
+	}
+	if cfg.usesSink(SinkKafka) == true {
+		cfg.KafkaBrokers = splitMultiple(ensureSetAndNonEmpty("VIRGO4_FULL_MARC_INGEST_KAFKA_BROKERS"))
+		cfg.KafkaTopic = ensureSetAndNonEmpty("VIRGO4_FULL_MARC_INGEST_KAFKA_TOPIC")
+	}
 	cfg.PollTimeOut = int64(envToInt("VIRGO4_FULL_MARC_INGEST_QUEUE_POLL_TIMEOUT"))
 	cfg.DataSource = envWithDefault("VIRGO4_FULL_MARC_INGEST_DATA_SOURCE", "unknown")
 	cfg.MessageBucketName = ensureSetAndNonEmpty("VIRGO4_SQS_MESSAGE_BUCKET")
@@ -130,12 +328,107 @@ func LoadConfiguration() *ServiceConfig {
 	cfg.PostgresPass = ensureSetAndNonEmpty("VIRGO4_FULL_MARC_INGEST_POSTGRES_PASS")
 	cfg.PostgresDatabase = ensureSetAndNonEmpty("VIRGO4_FULL_MARC_INGEST_POSTGRES_DATABASE")
 
+	cfg.DryRun = envToBool("VIRGO4_FULL_MARC_INGEST_DRY_RUN", "false")
 	cfg.DeleteCache = envToBool("VIRGO4_FULL_MARC_INGEST_DELETE_CACHE", "false")
 	cfg.DeleteSolr = envToBool("VIRGO4_FULL_MARC_INGEST_DELETE_SOLR", "false")
 
+	cfg.ReconcileDeletes = envToBool("VIRGO4_FULL_MARC_INGEST_RECONCILE_DELETES", "false")
+	cfg.ReconcileBatchSize = envToIntWithDefault("VIRGO4_FULL_MARC_INGEST_RECONCILE_BATCH_SIZE", "1000")
+	cfg.ReconcileMaxDeletes = envToIntWithDefault("VIRGO4_FULL_MARC_INGEST_RECONCILE_MAX_DELETES", "0")
+
+	cfg.CacheDeleteMax = envToIntWithDefault("VIRGO4_FULL_MARC_INGEST_CACHE_DELETE_MAX", "0")
+	cfg.CacheDeleteBatchSize = envToIntWithDefault("VIRGO4_FULL_MARC_INGEST_CACHE_DELETE_BATCH_SIZE", "10000")
+	cfg.CacheDeletePause = envToIntWithDefault("VIRGO4_FULL_MARC_INGEST_CACHE_DELETE_PAUSE", "500")
+	cfg.CacheStatementTimeout = envToIntWithDefault("VIRGO4_FULL_MARC_INGEST_CACHE_STATEMENT_TIMEOUT", "300")
+
+	cfg.RunLedger = envToBool("VIRGO4_FULL_MARC_INGEST_RUN_LEDGER", "false")
+	cfg.ResumeRuns = envToBool("VIRGO4_FULL_MARC_INGEST_RESUME_RUNS", "false")
+	cfg.ResumeAttempts = envToIntWithDefault("VIRGO4_FULL_MARC_INGEST_RESUME_ATTEMPTS", "3")
+	cfg.RunLock = envToBool("VIRGO4_FULL_MARC_INGEST_RUN_LOCK", "false")
+	cfg.RunLockStaleTimeout = envToIntWithDefault("VIRGO4_FULL_MARC_INGEST_RUN_LOCK_STALE_TIMEOUT", "600")
+	cfg.RunLockPollTime = envToIntWithDefault("VIRGO4_FULL_MARC_INGEST_RUN_LOCK_POLL_TIME", "30")
+	cfg.RunLockHeartbeat = envToIntWithDefault("VIRGO4_FULL_MARC_INGEST_RUN_LOCK_HEARTBEAT", "30")
+
+	cfg.ArtifactBucket = envWithDefault("VIRGO4_FULL_MARC_INGEST_ARTIFACT_BUCKET", "")
+	cfg.ArtifactPrefix = envWithDefault("VIRGO4_FULL_MARC_INGEST_ARTIFACT_PREFIX", "full-marc-ingest")
+	cfg.HashStore = envToBool("VIRGO4_FULL_MARC_INGEST_HASH_STORE", "false")
+	cfg.RunReport = envToBool("VIRGO4_FULL_MARC_INGEST_RUN_REPORT", "false")
+	cfg.ReportBucket = envWithDefault("VIRGO4_FULL_MARC_INGEST_REPORT_BUCKET", "")
+	cfg.ReportPrefix = envWithDefault("VIRGO4_FULL_MARC_INGEST_REPORT_PREFIX", "full-marc-ingest-reports")
+
+	cfg.HttpListen = envWithDefault("VIRGO4_FULL_MARC_INGEST_HTTP_LISTEN", ":8080")
+	cfg.AdminToken = envWithDefault("VIRGO4_FULL_MARC_INGEST_ADMIN_TOKEN", "")
+
+	cfg.NotifyWebhooks = splitOptional(envWithDefault("VIRGO4_FULL_MARC_INGEST_NOTIFY_WEBHOOKS", ""))
+	cfg.NotifySlackWebhook = envWithDefault("VIRGO4_FULL_MARC_INGEST_NOTIFY_SLACK_WEBHOOK", "")
+	cfg.NotifyEvents = splitOptional(envWithDefault("VIRGO4_FULL_MARC_INGEST_NOTIFY_EVENTS", "start success failure warning"))
+	cfg.SmtpHost = envWithDefault("VIRGO4_FULL_MARC_INGEST_SMTP_HOST", "")
+	if cfg.SmtpHost != "" {
+		cfg.SmtpPort = envToIntWithDefault("VIRGO4_FULL_MARC_INGEST_SMTP_PORT", "25")
+		cfg.SmtpUser = envWithDefault("VIRGO4_FULL_MARC_INGEST_SMTP_USER", "")
+		cfg.SmtpPass = envWithDefault("VIRGO4_FULL_MARC_INGEST_SMTP_PASS", "")
+		cfg.SmtpFrom = ensureSetAndNonEmpty("VIRGO4_FULL_MARC_INGEST_SMTP_FROM")
+		cfg.SmtpTo = splitOptional(ensureSetAndNonEmpty("VIRGO4_FULL_MARC_INGEST_SMTP_TO"))
+	}
+
+	cfg.TraceEndpoint = envWithDefault("VIRGO4_FULL_MARC_INGEST_TRACE_ENDPOINT", "")
+	cfg.TraceServiceName = envWithDefault("VIRGO4_FULL_MARC_INGEST_TRACE_SERVICE_NAME", "virgo4-full-marc-ingest")
+	cfg.TraceSampleRatio = envToFloatWithDefault("VIRGO4_FULL_MARC_INGEST_TRACE_SAMPLE_RATIO", "1.0")
+
+	cfg.PhaseTimeout = envToIntWithDefault("VIRGO4_FULL_MARC_INGEST_PHASE_TIMEOUT", "21600")
+	cfg.MinFreeSpace = envToIntWithDefault("VIRGO4_FULL_MARC_INGEST_MIN_FREE_SPACE", "1024")
+
+	cfg.SolrCollectionSwap = envToBool("VIRGO4_FULL_MARC_INGEST_SOLR_COLLECTION_SWAP", "false")
+	if cfg.SolrCollectionSwap == true {
+		cfg.SolrReadAlias = ensureSetAndNonEmpty("VIRGO4_FULL_MARC_INGEST_SOLR_READ_ALIAS")
+		cfg.SolrWriteAlias = ensureSetAndNonEmpty("VIRGO4_FULL_MARC_INGEST_SOLR_WRITE_ALIAS")
+		cfg.SolrConfigSet = ensureSetAndNonEmpty("VIRGO4_FULL_MARC_INGEST_SOLR_CONFIGSET")
+		cfg.SolrCollectionPrefix = ensureSetAndNonEmpty("VIRGO4_FULL_MARC_INGEST_SOLR_COLLECTION_PREFIX")
+		cfg.SolrShards = envToIntWithDefault("VIRGO4_FULL_MARC_INGEST_SOLR_SHARDS", "1")
+		cfg.SolrReplicas = envToIntWithDefault("VIRGO4_FULL_MARC_INGEST_SOLR_REPLICAS", "1")
+		cfg.SolrMinDocPercent = envToIntWithDefault("VIRGO4_FULL_MARC_INGEST_SOLR_MIN_DOC_PERCENT", "95")
+		cfg.SolrRetainHours = envToIntWithDefault("VIRGO4_FULL_MARC_INGEST_SOLR_RETAIN_HOURS", "72")
+	}
+
 	log.Printf("[CONFIG] InQueueName          = [%s]", cfg.InQueueName)
-	log.Printf("[CONFIG] OutQueueName         = [%s]", cfg.OutQueueName)
-	log.Printf("[CONFIG] CacheQueueName       = [%s]", cfg.CacheQueueName)
+	log.Printf("[CONFIG] Sink                 = [%s]", cfg.Sink)
+	log.Printf("[CONFIG] SourceSinks          = [%v]", cfg.SourceSinks)
+	log.Printf("[CONFIG] MaxBatchBytes        = [%d]", cfg.MaxBatchBytes)
+	log.Printf("[CONFIG] CompressPayload      = [%t]", cfg.CompressPayload)
+	log.Printf("[CONFIG] SpillFailures        = [%t]", cfg.SpillFailures)
+	log.Printf("[CONFIG] Provenance           = [%s]", strings.Join(cfg.Provenance, " "))
+	log.Printf("[CONFIG] DuplicatePolicy      = [%s]", cfg.DuplicatePolicy)
+	if cfg.Filter != nil {
+		log.Printf("[CONFIG] FilterRules          = [%s]", strings.Join(cfg.Filter.Names(), " "))
+	}
+	if cfg.Transformer != nil {
+		log.Printf("[CONFIG] Transforms           = [%s]", strings.Join(cfg.Transformer.Ops(), " "))
+	}
+	if cfg.Marc8Converter != nil {
+		log.Printf("[CONFIG] Marc8Charsets        = [%s]", strings.Join(cfg.Marc8Converter.Charsets(), " "))
+	}
+	log.Printf("[CONFIG] MaxRecordsPerSecond  = [%d]", cfg.MaxRecordsPerSecond)
+	log.Printf("[CONFIG] MaxBatchesPerSecond  = [%d]", cfg.MaxBatchesPerSecond)
+	log.Printf("[CONFIG] BackpressureQueues   = [%s]", strings.Join(cfg.BackpressureQueues, " "))
+	log.Printf("[CONFIG] BackpressureHighWater = [%d]", cfg.BackpressureHighWater)
+	log.Printf("[CONFIG] BackpressureLowWater = [%d]", cfg.BackpressureLowWater)
+	log.Printf("[CONFIG] BackpressurePollTime = [%d]", cfg.BackpressurePollTime)
+	if cfg.usesSink(SinkSqs) == true {
+		log.Printf("[CONFIG] OutQueueName         = [%s]", cfg.OutQueueName)
+		log.Printf("[CONFIG] CacheQueueName       = [%s]", cfg.CacheQueueName)
+	}
+	if cfg.usesSink(SinkFile) == true {
+		log.Printf("[CONFIG] SinkFile             = [%s]", cfg.SinkFile)
+		log.Printf("[CONFIG] SinkFileFormat       = [%s]", cfg.SinkFileFormat)
+	}
+	if cfg.usesSink(SinkHttp) == true {
+		log.Printf("[CONFIG] SinkHttpUrl          = [%s]", cfg.SinkHttpUrl)
+		log.Printf("[CONFIG] SinkHttpToken        = [%s]", redactIfSet(cfg.SinkHttpToken))
+	}
+	if cfg.usesSink(SinkKafka) == true {
+		log.Printf("[CONFIG] KafkaBrokers         = [%s]", strings.Join(cfg.KafkaBrokers, " "))
+		log.Printf("[CONFIG] KafkaTopic           = [%s]", cfg.KafkaTopic)
+	}
 	log.Printf("[CONFIG] PollTimeOut          = [%d]", cfg.PollTimeOut)
 	log.Printf("[CONFIG] DataSource           = [%s]", cfg.DataSource)
 	log.Printf("[CONFIG] MessageBucketName    = [%s]", cfg.MessageBucketName)
@@ -160,14 +453,123 @@ func LoadConfiguration() *ServiceConfig {
 	log.Printf("[CONFIG] PostgresPass         = [REDACTED]")
 	log.Printf("[CONFIG] PostgresDatabase     = [%s]", cfg.PostgresDatabase)
 
+	log.Printf("[CONFIG] DryRun               = [%t]", cfg.DryRun)
 	log.Printf("[CONFIG] DeleteCache          = [%t]", cfg.DeleteCache)
 	log.Printf("[CONFIG] DeleteSolr           = [%t]", cfg.DeleteSolr)
 
+	log.Printf("[CONFIG] ReconcileDeletes     = [%t]", cfg.ReconcileDeletes)
+	log.Printf("[CONFIG] ReconcileBatchSize   = [%d]", cfg.ReconcileBatchSize)
+	log.Printf("[CONFIG] ReconcileMaxDeletes  = [%d]", cfg.ReconcileMaxDeletes)
+
+	log.Printf("[CONFIG] CacheDeleteMax       = [%d]", cfg.CacheDeleteMax)
+	log.Printf("[CONFIG] CacheDeleteBatchSize = [%d]", cfg.CacheDeleteBatchSize)
+	log.Printf("[CONFIG] CacheDeletePause     = [%d]", cfg.CacheDeletePause)
+	log.Printf("[CONFIG] CacheStmtTimeout     = [%d]", cfg.CacheStatementTimeout)
+
+	log.Printf("[CONFIG] RunLedger            = [%t]", cfg.RunLedger)
+	log.Printf("[CONFIG] ResumeRuns           = [%t]", cfg.ResumeRuns)
+	log.Printf("[CONFIG] ResumeAttempts       = [%d]", cfg.ResumeAttempts)
+	log.Printf("[CONFIG] RunLock              = [%t]", cfg.RunLock)
+	log.Printf("[CONFIG] RunLockStaleTimeout  = [%d]", cfg.RunLockStaleTimeout)
+	log.Printf("[CONFIG] RunLockPollTime      = [%d]", cfg.RunLockPollTime)
+	log.Printf("[CONFIG] RunLockHeartbeat     = [%d]", cfg.RunLockHeartbeat)
+
+	log.Printf("[CONFIG] ArtifactBucket       = [%s]", cfg.ArtifactBucket)
+	log.Printf("[CONFIG] ArtifactPrefix       = [%s]", cfg.ArtifactPrefix)
+	log.Printf("[CONFIG] HashStore            = [%t]", cfg.HashStore)
+	log.Printf("[CONFIG] RunReport            = [%t]", cfg.RunReport)
+	log.Printf("[CONFIG] ReportBucket         = [%s]", cfg.ReportBucket)
+	log.Printf("[CONFIG] ReportPrefix         = [%s]", cfg.ReportPrefix)
+
+	log.Printf("[CONFIG] HttpListen           = [%s]", cfg.HttpListen)
+	log.Printf("[CONFIG] AdminToken           = [REDACTED]")
+
+	log.Printf("[CONFIG] NotifyWebhooks       = [%s]", strings.Join(cfg.NotifyWebhooks, " "))
+	log.Printf("[CONFIG] NotifySlackWebhook   = [%s]", redactIfSet(cfg.NotifySlackWebhook))
+	log.Printf("[CONFIG] NotifyEvents         = [%s]", strings.Join(cfg.NotifyEvents, " "))
+	log.Printf("[CONFIG] SmtpHost             = [%s]", cfg.SmtpHost)
+	if cfg.SmtpHost != "" {
+		log.Printf("[CONFIG] SmtpPort             = [%d]", cfg.SmtpPort)
+		log.Printf("[CONFIG] SmtpUser             = [%s]", cfg.SmtpUser)
+		log.Printf("[CONFIG] SmtpPass             = [REDACTED]")
+		log.Printf("[CONFIG] SmtpFrom             = [%s]", cfg.SmtpFrom)
+		log.Printf("[CONFIG] SmtpTo               = [%s]", strings.Join(cfg.SmtpTo, " "))
+	}
+
+	log.Printf("[CONFIG] TraceEndpoint        = [%s]", cfg.TraceEndpoint)
+	log.Printf("[CONFIG] TraceServiceName     = [%s]", cfg.TraceServiceName)
+	log.Printf("[CONFIG] TraceSampleRatio     = [%0.2f]", cfg.TraceSampleRatio)
+
+	log.Printf("[CONFIG] PhaseTimeout         = [%d]", cfg.PhaseTimeout)
+	log.Printf("[CONFIG] MinFreeSpace         = [%d]", cfg.MinFreeSpace)
+
+	log.Printf("[CONFIG] LogFormat            = [%s]", cfg.LogFormat)
+	log.Printf("[CONFIG] LogLevel             = [%s]", logLevelNames[cfg.LogLevel])
+	log.Printf("[CONFIG] RecordLogLevel       = [%s]", logLevelNames[cfg.RecordLogLevel])
+	log.Printf("[CONFIG] RecordLogSample      = [%d]", cfg.RecordLogSample)
+
+	log.Printf("[CONFIG] SolrCollectionSwap   = [%t]", cfg.SolrCollectionSwap)
+	if cfg.SolrCollectionSwap == true {
+		log.Printf("[CONFIG] SolrReadAlias        = [%s]", cfg.SolrReadAlias)
+		log.Printf("[CONFIG] SolrWriteAlias       = [%s]", cfg.SolrWriteAlias)
+		log.Printf("[CONFIG] SolrConfigSet        = [%s]", cfg.SolrConfigSet)
+		log.Printf("[CONFIG] SolrCollectionPrefix = [%s]", cfg.SolrCollectionPrefix)
+		log.Printf("[CONFIG] SolrShards           = [%d]", cfg.SolrShards)
+		log.Printf("[CONFIG] SolrReplicas         = [%d]", cfg.SolrReplicas)
+		log.Printf("[CONFIG] SolrMinDocPercent    = [%d]", cfg.SolrMinDocPercent)
+		log.Printf("[CONFIG] SolrRetainHours      = [%d]", cfg.SolrRetainHours)
+	}
+
 	// ensure the services and SOLR endpoints exist
 	fatalIfError(ensureServicesExist(cfg.ECSClusterName, cfg.ManagedECSServices))
 	fatalIfError(ensureSOLREndpointExists(cfg.SolrMaster, cfg.SolrCore, cfg.SolrTimeout))
 
-	if cfg.CacheQueueName == "" {
+	if cfg.SolrCollectionSwap == true && cfg.DeleteSolr == true {
+		log.Printf("INFO: SOLR collection swap is enabled, old SOLR records will not be deleted")
+	}
+
+	if cfg.ReconcileDeletes == true && cfg.ReconcileBatchSize <= 0 {
+		log.Printf("FATAL ERROR: reconcile batch size must be greater than zero")
+		os.Exit(1)
+	}
+
+	// a dry run should leave no trace in the production database
+	if cfg.DryRun == true {
+		log.Printf("INFO: DRY RUN, services will not be stopped, records will not be sent and nothing will be deleted")
+		if cfg.RunLedger == true || cfg.ResumeRuns == true || cfg.RunLock == true {
+			log.Printf("INFO: DRY RUN, disabling the run ledger, run resume and run lock")
+			cfg.RunLedger = false
+			cfg.ResumeRuns = false
+			cfg.RunLock = false
+		}
+	}
+
+	if cfg.ResumeRuns == true && cfg.RunLedger == false {
+		log.Printf("FATAL ERROR: resuming runs requires the run ledger")
+		os.Exit(1)
+	}
+
+	if cfg.CacheDeleteBatchSize <= 0 {
+		log.Printf("FATAL ERROR: cache delete batch size must be greater than zero")
+		os.Exit(1)
+	}
+
+	if cfg.BackpressureHighWater > 0 && cfg.BackpressureLowWater >= cfg.BackpressureHighWater {
+		log.Printf("FATAL ERROR: backpressure low water mark must be below the high water mark")
+		os.Exit(1)
+	}
+
+	if cfg.MaxBatchBytes <= 0 {
+		log.Printf("FATAL ERROR: maximum batch bytes must be greater than zero")
+		os.Exit(1)
+	}
+
+	// duplicates are found on the ids in the file, not the ids the transforms produce
+	if cfg.DuplicatePolicy != DuplicatesSendAll && cfg.Transformer != nil && cfg.Transformer.ChangesField("001") == true {
+		log.Printf("WARNING: the transforms can change record ids, the duplicate policy applies to the ids before they are transformed")
+	}
+
+	if cfg.usesSink(SinkSqs) == true && cfg.CacheQueueName == "" {
 		log.Printf("INFO: cache queue name is blank, record caching is DISABLED!!")
 	}
 
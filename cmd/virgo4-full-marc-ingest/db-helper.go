@@ -9,7 +9,15 @@ import (
 	_ "github.com/lib/pq"
 )
 
-const cacheDeleteQuery = "DELETE FROM source_cache WHERE source = {:source} AND updated_at < {:before}"
+// the cache purge pages through the old records by primary key (keyset pagination). The source_cache id is
+// the record id, a text column. The range comparisons and the ORDER BY both use the column collation so the
+// batches neither skip nor repeat rows whatever that collation is, and the empty string sorts before every
+// id so it starts the first batch
+const cacheCountQuery = "SELECT COUNT(*) FROM source_cache WHERE source = {:source} AND updated_at < {:before}"
+const cacheBatchQuery = "SELECT id FROM source_cache WHERE source = {:source} AND updated_at < {:before} AND id > {:after} ORDER BY id LIMIT {:limit}"
+const cacheDeleteQuery = "DELETE FROM source_cache WHERE source = {:source} AND updated_at < {:before} AND id > {:after} AND id <= {:last}"
+
+var ErrCacheDeleteThreshold = fmt.Errorf("cache delete count exceeds the configured maximum")
 
 var dbHandle *dbx.DB
 
@@ -29,26 +37,118 @@ func newDBConnection(cfg *ServiceConfig) error {
 	return nil
 }
 
-func deleteOldCacheRecords(dataSource string, olderThan time.Time) error {
+func deleteOldCacheRecords(cfg *ServiceConfig, dataSource string, olderThan time.Time) (int64, error) {
 	log.Printf("INFO: deleting cache records (%s) older than %s", dataSource, olderThan.UTC())
 
 	//
 	// note that the updated_at field in the database is stored in UTC so the time does not need to be localized
 	//
 
-	q := dbHandle.NewQuery(cacheDeleteQuery)
-	q.Bind(dbx.Params{"source": dataSource})
-	q.Bind(dbx.Params{"before": olderThan})
-	start := time.Now()
-	_, err := q.Execute()
+	// find out how much we are about to delete
+	total, err := cacheTransaction(cfg, func(tx *dbx.Tx) (int64, error) {
+		var count int64
+		q := tx.NewQuery(cacheCountQuery)
+		q.Bind(dbx.Params{"source": dataSource})
+		q.Bind(dbx.Params{"before": olderThan})
+		err := q.Row(&count)
+		return count, err
+	})
 	if err != nil {
-		log.Printf("ERROR: deleting old cache records (%s)", err.Error())
-		return err
+		log.Printf("ERROR: counting old cache records (%s)", err.Error())
+		return 0, err
 	}
+
+	log.Printf("INFO: %d cache records (%s) to delete", total, dataSource)
+
+	// during a dry run we only report what we would have done
+	if cfg.DryRun == true {
+		log.Printf("INFO: DRY RUN, not deleting %d cache records", total)
+		return total, nil
+	}
+
+	// sanity check before we delete anything
+	if cfg.CacheDeleteMax != 0 && total > int64(cfg.CacheDeleteMax) {
+		log.Printf("ERROR: %d cache records to delete exceeds the maximum of %d, not deleting", total, cfg.CacheDeleteMax)
+		return 0, ErrCacheDeleteThreshold
+	}
+
+	start := time.Now()
+	deleted := int64(0)
+	after := "" // before every (text) id, see cacheBatchQuery
+	for {
+		// get the next range of primary keys to delete
+		ids := make([]string, 0, cfg.CacheDeleteBatchSize)
+		_, err = cacheTransaction(cfg, func(tx *dbx.Tx) (int64, error) {
+			q := tx.NewQuery(cacheBatchQuery)
+			q.Bind(dbx.Params{"source": dataSource})
+			q.Bind(dbx.Params{"before": olderThan})
+			q.Bind(dbx.Params{"after": after})
+			q.Bind(dbx.Params{"limit": cfg.CacheDeleteBatchSize})
+			err := q.Column(&ids)
+			return int64(len(ids)), err
+		})
+		if err != nil {
+			log.Printf("ERROR: selecting old cache records (%s)", err.Error())
+			return deleted, err
+		}
+
+		// are we done
+		if len(ids) == 0 {
+			break
+		}
+
+		last := ids[len(ids)-1]
+		count, err := cacheTransaction(cfg, func(tx *dbx.Tx) (int64, error) {
+			q := tx.NewQuery(cacheDeleteQuery)
+			q.Bind(dbx.Params{"source": dataSource})
+			q.Bind(dbx.Params{"before": olderThan})
+			q.Bind(dbx.Params{"after": after})
+			q.Bind(dbx.Params{"last": last})
+			res, err := q.Execute()
+			if err != nil {
+				return 0, err
+			}
+			return res.RowsAffected()
+		})
+
+		if err != nil {
+			log.Printf("ERROR: deleting old cache records (%s)", err.Error())
+			return deleted, err
+		}
+
+		deleted += count
+		after = last
+		log.Printf("INFO: deleted %d of %d cache records", deleted, total)
+
+		// give everyone else a chance
+		time.Sleep(time.Duration(cfg.CacheDeletePause) * time.Millisecond)
+	}
+
 	duration := time.Since(start)
-	log.Printf("INFO: cache delete done in %0.2f seconds", duration.Seconds())
+	log.Printf("INFO: cache delete done in %0.2f seconds, %d records deleted", duration.Seconds(), deleted)
 
-	return nil
+	return deleted, nil
+}
+
+// run a cache query within a transaction that has the configured statement timeout applied
+func cacheTransaction(cfg *ServiceConfig, fn func(tx *dbx.Tx) (int64, error)) (int64, error) {
+
+	var count int64
+	err := dbHandle.Transactional(func(tx *dbx.Tx) error {
+
+		if cfg.CacheStatementTimeout != 0 {
+			_, err := tx.NewQuery(fmt.Sprintf("SET LOCAL statement_timeout = %d", cfg.CacheStatementTimeout*1000)).Execute()
+			if err != nil {
+				return err
+			}
+		}
+
+		var err error
+		count, err = fn(tx)
+		return err
+	})
+
+	return count, err
 }
 
 //
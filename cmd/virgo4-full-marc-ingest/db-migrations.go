@@ -0,0 +1,128 @@
+package main
+
+import (
+	"log"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+)
+
+// an arbitrary key used to serialize migrations across service instances
+const migrationLockKey = 4242001
+
+// the schema migrations, applied in order. Never change an existing migration, always add a new one
+var schemaMigrations = []string{
+
+	// 1: the run ledger
+	`CREATE TABLE ingest_runs (
+		id              VARCHAR(64) PRIMARY KEY,
+		data_source     VARCHAR(255) NOT NULL,
+		inbound_message TEXT NOT NULL DEFAULT '',
+		started_at      TIMESTAMPTZ NOT NULL,
+		ingest_at       TIMESTAMPTZ,
+		finished_at     TIMESTAMPTZ,
+		total_records   INTEGER NOT NULL DEFAULT 0,
+		merged_records  INTEGER NOT NULL DEFAULT 0,
+		bad_records     INTEGER NOT NULL DEFAULT 0,
+		solr_deleted    BIGINT NOT NULL DEFAULT 0,
+		cache_deleted   BIGINT NOT NULL DEFAULT 0,
+		phase_timings   JSONB NOT NULL DEFAULT '[]',
+		outcome         VARCHAR(32) NOT NULL,
+		error           TEXT NOT NULL DEFAULT ''
+	);
+	CREATE TABLE ingest_run_files (
+		run_id      VARCHAR(64) NOT NULL REFERENCES ingest_runs(id) ON DELETE CASCADE,
+		file_index  INTEGER NOT NULL,
+		bucket      VARCHAR(255) NOT NULL,
+		s3_key      TEXT NOT NULL,
+		size        BIGINT NOT NULL DEFAULT 0,
+		checksum    VARCHAR(64) NOT NULL DEFAULT '',
+		records     INTEGER NOT NULL DEFAULT 0,
+		merged      INTEGER NOT NULL DEFAULT 0,
+		bad         INTEGER NOT NULL DEFAULT 0,
+		duration_ms BIGINT NOT NULL DEFAULT 0,
+		PRIMARY KEY (run_id, file_index)
+	);
+	CREATE INDEX ingest_runs_started_at_idx ON ingest_runs (started_at)`,
+
+	// 2: resumable run state
+	`ALTER TABLE ingest_runs
+		ADD COLUMN phase               VARCHAR(32) NOT NULL DEFAULT '',
+		ADD COLUMN new_collection      VARCHAR(255) NOT NULL DEFAULT '',
+		ADD COLUMN previous_collection VARCHAR(255) NOT NULL DEFAULT '',
+		ADD COLUMN resume_count        INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE ingest_run_files
+		ADD COLUMN confirmed INTEGER NOT NULL DEFAULT 0;
+	CREATE INDEX ingest_runs_outcome_idx ON ingest_runs (outcome)`,
+
+	// 3: the run lock holder
+	`CREATE TABLE ingest_run_lock (
+		name         VARCHAR(64) PRIMARY KEY,
+		holder       VARCHAR(255) NOT NULL,
+		run_id       VARCHAR(64) NOT NULL,
+		backend_pid  INTEGER NOT NULL,
+		acquired_at  TIMESTAMPTZ NOT NULL,
+		heartbeat_at TIMESTAMPTZ NOT NULL
+	)`,
+
+	// 4: the remaining run counters, so they survive a resume
+	`ALTER TABLE ingest_runs
+		ADD COLUMN outbound_messages BIGINT NOT NULL DEFAULT 0,
+		ADD COLUMN warnings          JSONB NOT NULL DEFAULT '[]',
+		ADD COLUMN spilled           INTEGER NOT NULL DEFAULT 0,
+		ADD COLUMN replayed          INTEGER NOT NULL DEFAULT 0,
+		ADD COLUMN error_queue_count INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE ingest_run_files
+		ADD COLUMN duplicates   INTEGER NOT NULL DEFAULT 0,
+		ADD COLUMN filtered     JSONB NOT NULL DEFAULT '{}',
+		ADD COLUMN converted    INTEGER NOT NULL DEFAULT 0,
+		ADD COLUMN invalid_utf8 INTEGER NOT NULL DEFAULT 0`,
+}
+
+// apply any outstanding schema migrations
+func runMigrations() error {
+
+	log.Printf("INFO: checking schema migrations")
+
+	return dbHandle.Transactional(func(tx *dbx.Tx) error {
+
+		// serialize against any other instance doing the same thing
+		_, err := tx.NewQuery("SELECT pg_advisory_xact_lock({:key})").Bind(dbx.Params{"key": migrationLockKey}).Execute()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.NewQuery(`CREATE TABLE IF NOT EXISTS ingest_schema_migrations (
+			version    INTEGER PRIMARY KEY,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+		)`).Execute()
+		if err != nil {
+			return err
+		}
+
+		var current int
+		err = tx.NewQuery("SELECT COALESCE(MAX(version), 0) FROM ingest_schema_migrations").Row(&current)
+		if err != nil {
+			return err
+		}
+
+		for ix := current; ix < len(schemaMigrations); ix++ {
+			version := ix + 1
+			log.Printf("INFO: applying schema migration %d", version)
+			_, err = tx.NewQuery(schemaMigrations[ix]).Execute()
+			if err != nil {
+				log.Printf("ERROR: schema migration %d failed (%s)", version, err.Error())
+				return err
+			}
+			_, err = tx.Insert("ingest_schema_migrations", dbx.Params{"version": version}).Execute()
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+//
+// end of file
+//
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// DiffChange - a single difference between two dumps
+type DiffChange struct {
+	Id            string   `json:"id"`
+	Change        string   `json:"change"` // added, removed or changed
+	RemovedFields []string `json:"removed_fields,omitempty"`
+	AddedFields   []string `json:"added_fields,omitempty"`
+}
+
+// DiffSummary - the overall differences between two dumps
+type DiffSummary struct {
+	Old       int `json:"old"`
+	New       int `json:"new"`
+	Added     int `json:"added"`
+	Removed   int `json:"removed"`
+	Changed   int `json:"changed"`
+	Unchanged int `json:"unchanged"`
+}
+
+// compare two dumps by record id. The old dump can be a MARC file or the hash store from a previous run
+func diffCommand(args []string) error {
+
+	flags := flag.NewFlagSet("diff", flag.ContinueOnError)
+	oldHashes := flags.Bool("old-hashes", false, "the old file is a hash store from a previous run")
+	fields := flags.Bool("fields", false, "include a field level diff for changed records")
+	asJson := flags.Bool("json", false, "output as JSON lines")
+	tmpDir := flags.String("tmp", "", "the directory used for the on-disk indexes")
+	if parseCommandFlags(flags, args, 2) != nil {
+		return ErrUsage
+	}
+	oldName := flags.Arg(0)
+	newName := flags.Arg(1)
+
+	if *fields == true && *oldHashes == true {
+		return fmt.Errorf("a field level diff needs the old MARC file, not a hash store")
+	}
+
+	// index both files, a hash store is already a sorted index
+	oldIndex := oldName
+	if *oldHashes == false {
+		index, count, repeated, err := indexMarcFile(*tmpDir, oldName)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(index)
+		oldIndex = index
+		fmt.Fprintf(os.Stderr, "INFO: indexed %s, %d records (%d repeated ids)\n", oldName, count, repeated)
+	}
+
+	newIndex, count, repeated, err := indexMarcFile(*tmpDir, newName)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(newIndex)
+	fmt.Fprintf(os.Stderr, "INFO: indexed %s, %d records (%d repeated ids)\n", newName, count, repeated)
+
+	// we need the original files to diff the fields
+	var oldLoader, newLoader RecordLoader
+	if *fields == true {
+		oldLoader, err = NewRecordLoader(commandDataSource, oldName, oldName)
+		if err != nil {
+			return err
+		}
+		defer oldLoader.Done()
+		newLoader, err = NewRecordLoader(commandDataSource, newName, newName)
+		if err != nil {
+			return err
+		}
+		defer newLoader.Done()
+	}
+
+	report := func(change DiffChange) error {
+		if *asJson == true {
+			buf, err := json.Marshal(change)
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(buf))
+			return nil
+		}
+		fmt.Printf("%-8s %s\n", change.Change, change.Id)
+		for _, f := range change.RemovedFields {
+			fmt.Printf("  - %s\n", f)
+		}
+		for _, f := range change.AddedFields {
+			fmt.Printf("  + %s\n", f)
+		}
+		return nil
+	}
+
+	summary := DiffSummary{}
+	err = walkIndexes(oldIndex, newIndex, func(oldEntry *IndexEntry, newEntry *IndexEntry) error {
+		if oldEntry != nil {
+			summary.Old++
+		}
+		if newEntry != nil {
+			summary.New++
+		}
+
+		switch {
+		case oldEntry == nil:
+			summary.Added++
+			return report(DiffChange{Id: newEntry.Id, Change: "added"})
+		case newEntry == nil:
+			summary.Removed++
+			return report(DiffChange{Id: oldEntry.Id, Change: "removed"})
+		case oldEntry.Hash == newEntry.Hash:
+			summary.Unchanged++
+			return nil
+		}
+
+		summary.Changed++
+		change := DiffChange{Id: newEntry.Id, Change: "changed"}
+		if *fields == true {
+			change.RemovedFields, change.AddedFields, err = diffRecordFields(oldLoader, oldEntry.Offset, newLoader, newEntry.Offset)
+			if err != nil {
+				return fmt.Errorf("%s: %s", newEntry.Id, err.Error())
+			}
+		}
+		return report(change)
+	})
+	if err != nil {
+		return err
+	}
+
+	if *asJson == true {
+		buf, err := json.Marshal(map[string]DiffSummary{"summary": summary})
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(buf))
+		return nil
+	}
+
+	fmt.Printf("old: %d, new: %d, added: %d, removed: %d, changed: %d, unchanged: %d\n",
+		summary.Old, summary.New, summary.Added, summary.Removed, summary.Changed, summary.Unchanged)
+	return nil
+}
+
+// walk 2 sorted indexes calling the supplied function with each id and its entries in either index
+// (nil where the id is missing)
+func walkIndexes(first string, second string, fn func(*IndexEntry, *IndexEntry) error) error {
+
+	r1, err := NewIndexReader(first)
+	if err != nil {
+		return err
+	}
+	defer r1.Close()
+
+	r2, err := NewIndexReader(second)
+	if err != nil {
+		return err
+	}
+	defer r2.Close()
+
+	e1, err1 := r1.Next()
+	e2, err2 := r2.Next()
+	for {
+		if err1 != nil && err1 != io.EOF {
+			return err1
+		}
+		if err2 != nil && err2 != io.EOF {
+			return err2
+		}
+		if err1 == io.EOF && err2 == io.EOF {
+			return nil
+		}
+
+		switch {
+		case err2 == io.EOF || (err1 == nil && e1.Id < e2.Id):
+			err = fn(e1, nil)
+			e1, err1 = r1.Next()
+		case err1 == io.EOF || e2.Id < e1.Id:
+			err = fn(nil, e2)
+			e2, err2 = r2.Next()
+		default:
+			err = fn(e1, e2)
+			e1, err1 = r1.Next()
+			e2, err2 = r2.Next()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// compare the fields of 2 records, returns the fields only in the first and those only in the second
+func diffRecordFields(oldLoader RecordLoader, oldOffset int64, newLoader RecordLoader, newOffset int64) ([]string, []string, error) {
+
+	oldFields, err := recordFieldLines(oldLoader, oldOffset)
+	if err != nil {
+		return nil, nil, err
+	}
+	newFields, err := recordFieldLines(newLoader, newOffset)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// fields can repeat so count them
+	counts := make(map[string]int)
+	for _, f := range newFields {
+		counts[f]++
+	}
+	removed := make([]string, 0)
+	for _, f := range oldFields {
+		if counts[f] > 0 {
+			counts[f]--
+		} else {
+			removed = append(removed, f)
+		}
+	}
+
+	counts = make(map[string]int)
+	for _, f := range oldFields {
+		counts[f]++
+	}
+	added := make([]string, 0)
+	for _, f := range newFields {
+		if counts[f] > 0 {
+			counts[f]--
+		} else {
+			added = append(added, f)
+		}
+	}
+
+	return removed, added, nil
+}
+
+// read the record at the specified offset and return its fields as text lines
+func recordFieldLines(loader RecordLoader, offset int64) ([]string, error) {
+
+	err := loader.SeekTo(offset)
+	if err != nil {
+		return nil, err
+	}
+	rec, err := loader.Next(true)
+	if err != nil {
+		return nil, err
+	}
+	records, err := parseMarcRecords(rec.Raw())
+	if err != nil {
+		return nil, err
+	}
+
+	lines := make([]string, 0)
+	for _, r := range records {
+		lines = append(lines, strings.Split(strings.TrimSuffix(r.Text(), "\n"), "\n")...)
+	}
+	return lines, nil
+}
+
+//
+// end of file
+//
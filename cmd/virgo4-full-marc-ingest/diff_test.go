@@ -0,0 +1,212 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// write records to a MARC file
+func testMarcFile(t *testing.T, dir string, records ...[]byte) string {
+	t.Helper()
+	name := filepath.Join(dir, "test.mrc")
+	raw := make([]byte, 0)
+	for _, r := range records {
+		raw = append(raw, r...)
+	}
+	if err := os.WriteFile(name, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return name
+}
+
+// write lines to a sorted index
+func testIndex(t *testing.T, dir string, lines ...string) string {
+	t.Helper()
+	return testSpool(t, dir, lines).Name
+}
+
+// the entries of an index
+func readIndex(t *testing.T, name string) []IndexEntry {
+	t.Helper()
+	reader, err := NewIndexReader(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	entries := make([]IndexEntry, 0)
+	for {
+		e, err := reader.Next()
+		if err != nil {
+			return entries
+		}
+		entries = append(entries, *e)
+	}
+}
+
+func TestWalkIndexes(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		first    []string
+		second   []string
+		expected []string
+	}{
+		{"identical", []string{"a\th1", "b\th2"}, []string{"a\th1", "b\th2"}, []string{"a=a", "b=b"}},
+		{"added", []string{"b\th2"}, []string{"a\th1", "b\th2", "c\th3"}, []string{"+a", "b=b", "+c"}},
+		{"removed", []string{"a\th1", "b\th2", "c\th3"}, []string{"b\th2"}, []string{"-a", "b=b", "-c"}},
+		{"disjoint", []string{"a\th1", "c\th3"}, []string{"b\th2", "d\th4"}, []string{"-a", "+b", "-c", "+d"}},
+		{"first empty", []string{}, []string{"a\th1"}, []string{"+a"}},
+		{"second empty", []string{"a\th1"}, []string{}, []string{"-a"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			got := make([]string, 0)
+			err := walkIndexes(testIndex(t, dir, test.first...), testIndex(t, dir, test.second...), func(e1 *IndexEntry, e2 *IndexEntry) error {
+				switch {
+				case e1 == nil:
+					got = append(got, "+"+e2.Id)
+				case e2 == nil:
+					got = append(got, "-"+e1.Id)
+				default:
+					got = append(got, e1.Id+"="+e2.Id)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reflect.DeepEqual(got, test.expected) == false {
+				t.Errorf("got %v, expected %v", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestIndexMarcFile(t *testing.T) {
+
+	a1 := testMarcRecord('a', "001 a", "245 00‡aFirst a")
+	b := testMarcRecord('a', "001 b", "245 00‡aOnly b")
+	a2 := testMarcRecord('a', "001 a", "245 00‡aSecond a")
+
+	tests := []struct {
+		name     string
+		records  [][]byte
+		ids      []string
+		hashes   []string
+		repeated int
+	}{
+		{"unique ids", [][]byte{b, a1}, []string{"a", "b"}, []string{recordHash(a1), recordHash(b)}, 0},
+		{"adjacent copies are merged", [][]byte{a1, a2, b}, []string{"a", "b"}, []string{recordHash(append(append([]byte{}, a1...), a2...)), recordHash(b)}, 0},
+		{"the last copy wins", [][]byte{a1, b, a2}, []string{"a", "b"}, []string{recordHash(a2), recordHash(b)}, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			index, _, repeated, err := indexMarcFile(dir, testMarcFile(t, dir, test.records...))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if repeated != test.repeated {
+				t.Errorf("got %d repeated ids, expected %d", repeated, test.repeated)
+			}
+			ids, hashes := make([]string, 0), make([]string, 0)
+			for _, e := range readIndex(t, index) {
+				ids = append(ids, e.Id)
+				hashes = append(hashes, e.Hash)
+			}
+			if reflect.DeepEqual(ids, test.ids) == false {
+				t.Errorf("got ids %v, expected %v", ids, test.ids)
+			}
+			if reflect.DeepEqual(hashes, test.hashes) == false {
+				t.Errorf("got hashes %v, expected %v", hashes, test.hashes)
+			}
+		})
+	}
+}
+
+// a hash store saved by a run compares as unchanged against the file that was ingested
+func TestHashStoreMatchesIndex(t *testing.T) {
+
+	tests := []struct {
+		name    string
+		filter  string
+		records [][]byte
+	}{
+		{"unique ids", "", [][]byte{
+			testMarcRecord('a', "001 u2", "245 00‡aTwo"),
+			testMarcRecord('a', "001 u1", "245 00‡aOne"),
+		}},
+		{"repeated ids", "", [][]byte{
+			testMarcRecord('a', "001 u1", "245 00‡aOne"),
+			testMarcRecord('a', "001 u2", "245 00‡aTwo"),
+			testMarcRecord('a', "001 u1", "245 00‡aOne again"),
+		}},
+		{"MARC-8", "", [][]byte{
+			testMarcRecord(' ', "001 u1", "245 00‡aCaf\xe2e"),
+		}},
+		{"repeated and filtered", `[{"name": "shadowed", "field": "999"}]`, [][]byte{
+			testMarcRecord('a', "001 u1", "245 00‡aOne"),
+			testMarcRecord('a', "001 u2", "245 00‡aTwo", "999   ‡aShadowed"),
+			testMarcRecord('a', "001 u1", "245 00‡aOne again", "999   ‡aShadowed"),
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			name := testMarcFile(t, dir, test.records...)
+
+			// as the run saves it, from the records as loaded whether or not they are filtered
+			filter, err := NewRecordFilter(test.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			spool, err := NewIdSpool(dir, "hashes-*.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			run := &IngestRun{cfg: &ServiceConfig{DuplicatePolicy: DuplicatesSendAll, Filter: filter}, hashes: spool}
+			loader, err := NewRecordLoader(commandDataSource, name, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec, err := loader.First(true)
+			for ; err == nil; rec, err = loader.Next(true) {
+				run.addHash(rec)
+				run.dropRecord(rec, 0, nil, nil, make(map[string]int), false)
+			}
+			loader.Done()
+			if err != io.EOF {
+				t.Fatal(err)
+			}
+			hashes, _, err := sortIndexSpool(dir, spool)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			index, _, _, err := indexMarcFile(dir, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = walkIndexes(hashes, index, func(e1 *IndexEntry, e2 *IndexEntry) error {
+				if e1 == nil || e2 == nil || e1.Hash != e2.Hash {
+					t.Errorf("hash store and index differ (%v, %v)", e1, e2)
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+//
+// end of file
+//
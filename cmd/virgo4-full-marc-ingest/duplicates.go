@@ -0,0 +1,235 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/uvalib/uva-aws-s3-sdk/uva-s3"
+)
+
+var ErrUnknownDuplicatePolicy = fmt.Errorf("unknown duplicate policy (all, first, last, merge or reject)")
+var ErrDuplicateIds = fmt.Errorf("file contains repeated record ids")
+
+// the policies for ids that appear more than once in a file. Adjacent records with the same id are
+// always merged by the loader, these apply to the copies that are not adjacent. Duplicates are the ids
+// in the file, the policy is applied before MARC-8 conversion and the transforms so records a transform
+// gives the same id are not duplicates (and records it gives different ids still are)
+const (
+	DuplicatesSendAll   = "all"    // send every copy, whichever is indexed last wins
+	DuplicatesKeepFirst = "first"  // send the first copy only
+	DuplicatesKeepLast  = "last"   // send the last copy only
+	DuplicatesMerge     = "merge"  // append the later copies to the first, as adjacent records are
+	DuplicatesReject    = "reject" // the file is invalid
+)
+
+// the number of repeated ids logged when a file is rejected
+var duplicatesLogLimit = 20
+
+// DuplicateId - an id that appears more than once in a file
+type DuplicateId struct {
+	Id      string
+	Indexes []int   // the record index of each copy, in file order
+	Offsets []int64 // the file offset of each copy
+}
+
+// DuplicateIds - the repeated ids in a file
+type DuplicateIds struct {
+	Ids   []*DuplicateId          // the repeated ids, sorted
+	Extra int                     // the number of records that repeat an earlier id
+	byId  map[string]*DuplicateId // for lookup
+}
+
+func checkDuplicatePolicy(policy string) error {
+	switch policy {
+	case DuplicatesSendAll, DuplicatesKeepFirst, DuplicatesKeepLast, DuplicatesMerge, DuplicatesReject:
+		return nil
+	}
+	return ErrUnknownDuplicatePolicy
+}
+
+// read every record in a file and locate the repeated ids. The ids are spooled to disk and sorted so
+// only the repeated ones are held in memory
+func scanDuplicateIds(dir string, loader RecordLoader) (*DuplicateIds, error) {
+
+	spool, err := NewIdSpool(dir, "dup-scan-*")
+	if err != nil {
+		return nil, err
+	}
+	defer spool.Remove()
+
+	index := 0
+	rec, err := loader.First(true)
+	for err == nil {
+		id, _ := rec.Id()
+		// the index is zero padded so the copies of an id sort in file order
+		err = spool.Add(fmt.Sprintf("%s\t%016d\t%d", id, index, rec.Offset()))
+		if err != nil {
+			return nil, err
+		}
+		index++
+		rec, err = loader.Next(true)
+	}
+	if err != io.EOF {
+		return nil, err
+	}
+
+	err = spool.Close()
+	if err != nil {
+		return nil, err
+	}
+	sorted, err := sortSpoolFile(dir, spool.Name)
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(sorted)
+
+	reader, err := NewIdReader(sorted)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	dups := &DuplicateIds{Ids: make([]*DuplicateId, 0), byId: make(map[string]*DuplicateId)}
+	var current *DuplicateId
+	done := func() {
+		if current != nil && len(current.Indexes) > 1 {
+			dups.Ids = append(dups.Ids, current)
+			dups.byId[current.Id] = current
+			dups.Extra += len(current.Indexes) - 1
+		}
+	}
+	for {
+		line, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		tokens := strings.Split(line, "\t")
+		if len(tokens) != 3 {
+			return nil, ErrBadIndexEntry
+		}
+		ix, err := strconv.Atoi(tokens[1])
+		if err != nil {
+			return nil, ErrBadIndexEntry
+		}
+		offset, err := strconv.ParseInt(tokens[2], 10, 64)
+		if err != nil {
+			return nil, ErrBadIndexEntry
+		}
+
+		if current == nil || current.Id != tokens[0] {
+			done()
+			current = &DuplicateId{Id: tokens[0]}
+		}
+		current.Indexes = append(current.Indexes, ix)
+		current.Offsets = append(current.Offsets, offset)
+	}
+	done()
+
+	return dups, nil
+}
+
+// apply the policy to the record at the specified index. Returns true if the record is sent and, when
+// merging, the offsets of the later copies to append to it
+func (d *DuplicateIds) Keep(policy string, id string, index int) (bool, []int64) {
+
+	dup, ok := d.byId[id]
+	if ok == false {
+		return true, nil
+	}
+
+	switch policy {
+	case DuplicatesKeepFirst:
+		return index == dup.Indexes[0], nil
+	case DuplicatesKeepLast:
+		return index == dup.Indexes[len(dup.Indexes)-1], nil
+	case DuplicatesMerge:
+		if index == dup.Indexes[0] {
+			return true, dup.Offsets[1:]
+		}
+		return false, nil
+	}
+	return true, nil
+}
+
+// the repeated ids as report lines: "<id>\t<copies>\t<record indexes>"
+func (d *DuplicateIds) Lines() []string {
+	lines := make([]string, 0, len(d.Ids))
+	for _, dup := range d.Ids {
+		indexes := make([]string, 0, len(dup.Indexes))
+		for _, ix := range dup.Indexes {
+			indexes = append(indexes, strconv.Itoa(ix))
+		}
+		lines = append(lines, fmt.Sprintf("%s\t%d\t%s", dup.Id, len(dup.Indexes), strings.Join(indexes, ",")))
+	}
+	return lines
+}
+
+// log the repeated ids, up to a limit
+func (d *DuplicateIds) Log(name string) {
+	for ix, dup := range d.Ids {
+		if ix == duplicatesLogLimit {
+			log.Printf("WARNING: %s: %d more repeated ids not shown", name, len(d.Ids)-ix)
+			break
+		}
+		log.Printf("WARNING: %s: id %s appears %d times (records %v)", name, dup.Id, len(dup.Indexes), dup.Indexes)
+	}
+}
+
+// save the repeated ids as a run artifact
+func saveDuplicateReport(cfg *ServiceConfig, s3Svc uva_s3.UvaS3, runId string, fileIx int, dups *DuplicateIds) error {
+
+	if len(dups.Ids) == 0 {
+		return nil
+	}
+
+	out, err := NewIdSpool(cfg.DownloadDir, "duplicates-*.txt")
+	if err != nil {
+		return err
+	}
+	for _, line := range dups.Lines() {
+		if err = out.Add(line); err != nil {
+			out.Remove()
+			return err
+		}
+	}
+	if err = out.Close(); err != nil {
+		out.Remove()
+		return err
+	}
+
+	return saveArtifact(cfg, s3Svc, out.Name, artifactName(cfg.DataSource, runId, fmt.Sprintf("duplicates-%d.txt", fileIx)))
+}
+
+// append the record at the specified offset to a record, as the loader does for adjacent records
+func mergeRecordAt(loader RecordLoader, rec Record, offset int64) error {
+
+	err := loader.SeekTo(offset)
+	if err != nil {
+		return err
+	}
+	next, err := loader.Next(true)
+	if err != nil {
+		return err
+	}
+
+	impl, ok := rec.(*recordImpl)
+	if ok == false {
+		return ErrBadRecord
+	}
+	impl.RawBytes = append(impl.Raw(), next.Raw()...)
+	impl.merged += 1 + next.Merged()
+	impl.payload = nil
+	return nil
+}
+
+//
+// end of file
+//
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// the titles (245$a) of a record and any merged into it
+func testTitles(t *testing.T, rec Record) string {
+	t.Helper()
+	records, err := parseMarcRecords(rec.Raw())
+	if err != nil {
+		t.Fatal(err)
+	}
+	titles := make([]string, 0, len(records))
+	for _, r := range records {
+		titles = append(titles, r.Field("245").Subfields[0].Value)
+	}
+	return strings.Join(titles, "+")
+}
+
+func TestDuplicatePolicies(t *testing.T) {
+
+	record := func(id string, title string) []byte {
+		return testMarcRecord('a', "001 "+id, "245 00‡a"+title)
+	}
+	file := [][]byte{
+		record("a", "a1"),
+		record("b", "b1"),
+		record("a", "a2"),
+		record("c", "c1"),
+		record("c", "c2"), // adjacent, merged by the loader
+		record("b", "b2"),
+		record("a", "a3"),
+	}
+
+	tests := []struct {
+		policy   string
+		expected []string
+	}{
+		{DuplicatesSendAll, []string{"a1", "b1", "a2", "c1+c2", "b2", "a3"}},
+		{DuplicatesKeepFirst, []string{"a1", "b1", "c1+c2"}},
+		{DuplicatesKeepLast, []string{"c1+c2", "b2", "a3"}},
+		{DuplicatesMerge, []string{"a1+a2+a3", "b1+b2", "c1+c2"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			dir := t.TempDir()
+			name := testMarcFile(t, dir, file...)
+			loader, err := NewRecordLoader("test", name, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer loader.Done()
+			merger, err := NewRecordLoader("test", name, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer merger.Done()
+
+			dups, err := scanDuplicateIds(dir, loader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dups.Extra != 3 {
+				t.Errorf("got %d extra copies, expected 3", dups.Extra)
+			}
+
+			// as the run applies the policy
+			got := make([]string, 0)
+			index := -1
+			rec, err := loader.First(true)
+			for ; err == nil; rec, err = loader.Next(true) {
+				index++
+				id, _ := rec.Id()
+				keep, others := dups.Keep(test.policy, id, index)
+				if keep == false {
+					continue
+				}
+				for _, offset := range others {
+					if err = mergeRecordAt(merger, rec, offset); err != nil {
+						t.Fatal(err)
+					}
+				}
+				got = append(got, testTitles(t, rec))
+			}
+			if err != io.EOF {
+				t.Fatal(err)
+			}
+			if reflect.DeepEqual(got, test.expected) == false {
+				t.Errorf("got %v, expected %v", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestDuplicateIdsLines(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		ids      []string
+		expected []string
+	}{
+		{"no repeats", []string{"a", "b", "c"}, []string{}},
+		{"repeats", []string{"b", "a", "b", "c", "a", "b"}, []string{"a\t2\t1,4", "b\t3\t0,2,5"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			records := make([][]byte, 0, len(test.ids))
+			for _, id := range test.ids {
+				records = append(records, testMarcRecord('a', "001 "+id))
+			}
+			name := testMarcFile(t, dir, records...)
+			loader, err := NewRecordLoader("test", name, name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer loader.Done()
+
+			dups, err := scanDuplicateIds(dir, loader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := dups.Lines(); reflect.DeepEqual(got, test.expected) == false {
+				t.Errorf("got %q, expected %q", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestCheckDuplicatePolicy(t *testing.T) {
+
+	tests := []struct {
+		policy string
+		valid  bool
+	}{
+		{DuplicatesSendAll, true},
+		{DuplicatesKeepFirst, true},
+		{DuplicatesKeepLast, true},
+		{DuplicatesMerge, true},
+		{DuplicatesReject, true},
+		{"", false},
+		{"First", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			err := checkDuplicatePolicy(test.policy)
+			if (err == nil) != test.valid {
+				t.Errorf("got %v, expected valid %t", err, test.valid)
+			}
+		})
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var ErrBadFilterRule = fmt.Errorf("bad filter rule")
+
+// the field name used by rules that test the leader
+var filterLeaderField = "leader"
+
+// FilterRule - a rule that excludes matching records. For example:
+//
+//	{"name": "deleted", "field": "leader", "position": "05", "match": "^d$"}
+//	{"name": "shadowed", "field": "999", "subfield": "x", "match": "(?i)shadow"}
+//	{"name": "special-collections", "field": "852", "subfield": "b", "match": "^SPEC-", "sources": ["sirsi"]}
+//	{"name": "has-590", "field": "590"}
+type FilterRule struct {
+	Name     string   `json:"name"`               // reported in the run summary
+	Sources  []string `json:"sources,omitempty"`  // the data sources the rule applies to (blank is all)
+	Field    string   `json:"field"`              // the field tag or "leader"
+	Subfield string   `json:"subfield,omitempty"` // the subfield code (data fields only)
+	Position string   `json:"position,omitempty"` // a character position or range, e.g. "05" or "35-37" (leader and control fields only)
+	Match    string   `json:"match,omitempty"`    // a regex the value must match, blank tests for presence only
+
+	start   int            // the parsed position
+	end     int            // the end of the parsed position (exclusive)
+	pattern *regexp.Regexp // the compiled match
+}
+
+// RecordFilter - the configured filter rules
+type RecordFilter struct {
+	rules []*FilterRule
+}
+
+// NewRecordFilter - parse the filter rules (a JSON array), returns nil if there are none
+func NewRecordFilter(config string) (*RecordFilter, error) {
+
+	if strings.TrimSpace(config) == "" {
+		return nil, nil
+	}
+
+	rules := make([]*FilterRule, 0)
+	err := json.Unmarshal([]byte(config), &rules)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadFilterRule, err.Error())
+	}
+
+	names := make(map[string]bool)
+	for _, rule := range rules {
+		err = rule.prepare()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %s", ErrBadFilterRule, rule.Name, err.Error())
+		}
+		if names[rule.Name] == true {
+			return nil, fmt.Errorf("%w: %s: duplicate name", ErrBadFilterRule, rule.Name)
+		}
+		names[rule.Name] = true
+	}
+
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	return &RecordFilter{rules: rules}, nil
+}
+
+func (r *FilterRule) prepare() error {
+
+	if r.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if r.Field != filterLeaderField && len(r.Field) != 3 {
+		return fmt.Errorf("field must be a 3 character tag or %s", filterLeaderField)
+	}
+	control := r.Field == filterLeaderField || strings.HasPrefix(r.Field, "00")
+	if r.Subfield != "" && (control == true || len(r.Subfield) != 1) {
+		return fmt.Errorf("subfield must be a single code for a data field")
+	}
+	if r.Position != "" {
+		if control == false {
+			return fmt.Errorf("position applies to the leader and control fields only")
+		}
+		from, to, found := strings.Cut(r.Position, "-")
+		start, err := strconv.Atoi(from)
+		if err != nil || start < 0 {
+			return fmt.Errorf("position invalid (%s)", r.Position)
+		}
+		end := start
+		if found == true {
+			end, err = strconv.Atoi(to)
+			if err != nil || end < start {
+				return fmt.Errorf("position invalid (%s)", r.Position)
+			}
+		}
+		r.start, r.end = start, end+1
+	}
+	if r.Match != "" {
+		pattern, err := regexp.Compile(r.Match)
+		if err != nil {
+			return err
+		}
+		r.pattern = pattern
+	}
+	return nil
+}
+
+// Names - the rule names, in order
+func (f *RecordFilter) Names() []string {
+	names := make([]string, 0, len(f.rules))
+	for _, rule := range f.rules {
+		names = append(names, rule.Name)
+	}
+	return names
+}
+
+// Match - the name of the first rule that excludes the record, blank if it is not excluded. Records
+// that cannot be parsed are never excluded
+func (f *RecordFilter) Match(record Record) string {
+
+	var parsed []*MarcRecord
+	for _, rule := range f.rules {
+		if appliesToSource(rule.Sources, record.Source()) == false {
+			continue
+		}
+
+		// only parse the record if one of the rules applies
+		if parsed == nil {
+			var err error
+			parsed, err = parseMarcRecords(record.Raw())
+			if err != nil {
+				id, _ := record.Id()
+				logRecordf(LevelWarning, id, record.Offset(), "unable to parse the record for filtering (%s)", err.Error())
+				return ""
+			}
+		}
+
+		// records sharing an id are merged, any of them can match
+		for _, m := range parsed {
+			if rule.matches(m) == true {
+				return rule.Name
+			}
+		}
+	}
+	return ""
+}
+
+// does a rule configured for the specified data sources apply to a record from the source, no sources is all
+func appliesToSource(sources []string, source string) bool {
+	if len(sources) == 0 {
+		return true
+	}
+	for _, s := range sources {
+		if s == source {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *FilterRule) matches(record *MarcRecord) bool {
+
+	if r.Field == filterLeaderField {
+		return r.matchValue(record.Leader)
+	}
+
+	for ix := range record.Fields {
+		field := &record.Fields[ix]
+		if field.Tag != r.Field {
+			continue
+		}
+		if r.Subfield == "" {
+			if field.IsControl() == true {
+				if r.matchValue(field.Value) == true {
+					return true
+				}
+				continue
+			}
+			// presence of a data field, or any subfield value matches
+			if r.pattern == nil {
+				return true
+			}
+			for _, sub := range field.Subfields {
+				if r.pattern.MatchString(sub.Value) == true {
+					return true
+				}
+			}
+			continue
+		}
+		for _, sub := range field.Subfields {
+			if sub.Code == r.Subfield[0] && r.matchValue(sub.Value) == true {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// test a value, applying the position first (if any)
+func (r *FilterRule) matchValue(value string) bool {
+	if r.Position != "" {
+		if r.end > len(value) {
+			return false
+		}
+		value = value[r.start:r.end]
+	}
+	if r.pattern == nil {
+		return true
+	}
+	return r.pattern.MatchString(value)
+}
+
+//
+// end of file
+//
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestNewRecordFilter(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		config string
+		rules  int
+		err    bool
+	}{
+		{"blank", "", 0, false},
+		{"empty array", "[]", 0, false},
+		{"leader position", `[{"name": "deleted", "field": "leader", "position": "05", "match": "^d$"}]`, 1, false},
+		{"position range", `[{"name": "r", "field": "008", "position": "35-37", "match": "eng"}]`, 1, false},
+		{"subfield", `[{"name": "s", "field": "999", "subfield": "x", "match": "(?i)shadow"}]`, 1, false},
+		{"presence", `[{"name": "p", "field": "590"}, {"name": "q", "field": "591"}]`, 2, false},
+		{"not JSON", `{"name": "x"`, 0, true},
+		{"no name", `[{"field": "590"}]`, 0, true},
+		{"duplicate name", `[{"name": "x", "field": "590"}, {"name": "x", "field": "591"}]`, 0, true},
+		{"bad tag", `[{"name": "x", "field": "59"}]`, 0, true},
+		{"subfield of a control field", `[{"name": "x", "field": "008", "subfield": "a"}]`, 0, true},
+		{"long subfield code", `[{"name": "x", "field": "245", "subfield": "ab"}]`, 0, true},
+		{"position of a data field", `[{"name": "x", "field": "245", "position": "01"}]`, 0, true},
+		{"bad position", `[{"name": "x", "field": "leader", "position": "x"}]`, 0, true},
+		{"reversed range", `[{"name": "x", "field": "leader", "position": "07-05"}]`, 0, true},
+		{"bad regex", `[{"name": "x", "field": "245", "match": "("}]`, 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter, err := NewRecordFilter(test.config)
+			if test.err == true {
+				if errors.Is(err, ErrBadFilterRule) == false {
+					t.Errorf("got %v, expected %v", err, ErrBadFilterRule)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			rules := 0
+			if filter != nil {
+				rules = len(filter.Names())
+			}
+			if rules != test.rules {
+				t.Errorf("got %d rules, expected %d", rules, test.rules)
+			}
+		})
+	}
+}
+
+func TestRecordFilterMatch(t *testing.T) {
+
+	plain := testMarcRecord('a', "001 u1", "008 850101s1985    xx            000 0 eng d", "245 00‡aTitle", "999   ‡aX1‡xSHADOWED")
+	deletedRecord := append([]byte{}, plain...)
+	deletedRecord[5] = 'd'
+
+	tests := []struct {
+		name     string
+		config   string
+		raw      []byte
+		source   string
+		expected string
+	}{
+		{"leader position", `[{"name": "deleted", "field": "leader", "position": "05", "match": "^d$"}]`, deletedRecord, "test", "deleted"},
+		{"leader position no match", `[{"name": "deleted", "field": "leader", "position": "05", "match": "^d$"}]`, plain, "test", ""},
+		{"control field range", `[{"name": "english", "field": "008", "position": "35-37", "match": "^eng$"}]`, plain, "test", "english"},
+		{"position beyond the value", `[{"name": "x", "field": "001", "position": "10", "match": "."}]`, plain, "test", ""},
+		{"subfield", `[{"name": "shadowed", "field": "999", "subfield": "x", "match": "(?i)shadow"}]`, plain, "test", "shadowed"},
+		{"other subfield", `[{"name": "shadowed", "field": "999", "subfield": "a", "match": "(?i)shadow"}]`, plain, "test", ""},
+		{"any subfield", `[{"name": "x1", "field": "999", "match": "^X1$"}]`, plain, "test", "x1"},
+		{"field present", `[{"name": "has-245", "field": "245"}]`, plain, "test", "has-245"},
+		{"field absent", `[{"name": "has-590", "field": "590"}]`, plain, "test", ""},
+		{"first rule wins", `[{"name": "a", "field": "245"}, {"name": "b", "field": "999"}]`, plain, "test", "a"},
+		{"later rule", `[{"name": "a", "field": "590"}, {"name": "b", "field": "999"}]`, plain, "test", "b"},
+		{"source matches", `[{"name": "s", "field": "245", "sources": ["sirsi"]}]`, plain, "sirsi", "s"},
+		{"other source", `[{"name": "s", "field": "245", "sources": ["sirsi"]}]`, plain, "hathi", ""},
+		{"merged record", `[{"name": "deleted", "field": "leader", "position": "05", "match": "^d$"}]`, append(append([]byte{}, plain...), deletedRecord...), "test", "deleted"},
+		{"unparseable record", `[{"name": "has-245", "field": "245"}]`, plain[:len(plain)-2], "test", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter, err := NewRecordFilter(test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := testRecord(test.raw)
+			rec.SetSource(test.source)
+			if got := filter.Match(rec); got != test.expected {
+				t.Errorf("got %q, expected %q", got, test.expected)
+			}
+		})
+	}
+}
+
+//
+// end of file
+//
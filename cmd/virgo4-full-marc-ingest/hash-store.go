@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+//
+// A hash store is a sorted text file with one line per record id: "<id>\t<hash>". A run can save one as
+// an artifact so the next dump can be compared with what was actually ingested. A record index built
+// from a MARC file has the same layout with the record offset appended: "<id>\t<hash>\t<offset>".
+//
+
+var ErrBadIndexEntry = fmt.Errorf("bad index entry")
+
+// IndexEntry - a single record id with the hash of its contents and (if known) its file offset
+type IndexEntry struct {
+	Id     string
+	Hash   string
+	Offset int64 // -1 when the index came from a hash store
+}
+
+// the hash of a record as ingested
+func recordHash(raw []byte) string {
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// format an index spool line. The sequence number means that after sorting, the last occurrence of
+// a repeated id is the last line in its group, which is the version that ends up indexed
+func indexSpoolLine(id string, sequence int, hash string, offset int64) string {
+	if offset < 0 {
+		return fmt.Sprintf("%s\t%016d\t%s", id, sequence, hash)
+	}
+	return fmt.Sprintf("%s\t%016d\t%s\t%d", id, sequence, hash, offset)
+}
+
+// sort an index spool and collapse it to one entry per id, returns the index file name and the
+// number of repeated ids that were dropped
+func sortIndexSpool(dir string, spool *IdSpool) (string, int, error) {
+
+	err := spool.Close()
+	if err != nil {
+		return "", 0, err
+	}
+
+	sorted, err := sortSpoolFile(dir, spool.Name)
+	if err != nil {
+		return "", 0, err
+	}
+	defer os.Remove(sorted)
+
+	reader, err := NewIdReader(sorted)
+	if err != nil {
+		return "", 0, err
+	}
+	defer reader.Close()
+
+	out, err := NewIdSpool(dir, "index-*.txt")
+	if err != nil {
+		return "", 0, err
+	}
+
+	repeated := 0
+	pendingId, pending := "", ""
+	for {
+		line, err := reader.Next()
+		if err != nil && err != io.EOF {
+			out.Remove()
+			return "", 0, err
+		}
+
+		id := ""
+		if err == nil {
+			id = strings.SplitN(line, "\t", 2)[0]
+		}
+
+		// a new id (or the end) so write the last line of the previous group
+		if pending != "" && (err == io.EOF || id != pendingId) {
+			tokens := strings.SplitN(pending, "\t", 3)
+			if len(tokens) != 3 {
+				out.Remove()
+				return "", 0, ErrBadIndexEntry
+			}
+			if e := out.Add(tokens[0] + "\t" + tokens[2]); e != nil {
+				out.Remove()
+				return "", 0, e
+			}
+		} else if pending != "" {
+			repeated++
+		}
+
+		if err == io.EOF {
+			break
+		}
+		pendingId, pending = id, line
+	}
+
+	err = out.Close()
+	if err != nil {
+		out.Remove()
+		return "", 0, err
+	}
+	return out.Name, repeated, nil
+}
+
+// IndexReader - sequential access to a sorted index or hash store
+type IndexReader struct {
+	reader *IdReader
+}
+
+// NewIndexReader - open a sorted index or hash store for reading
+func NewIndexReader(name string) (*IndexReader, error) {
+	reader, err := NewIdReader(name)
+	if err != nil {
+		return nil, err
+	}
+	return &IndexReader{reader: reader}, nil
+}
+
+// Next - get the next entry, returns io.EOF at the end
+func (r *IndexReader) Next() (*IndexEntry, error) {
+
+	line, err := r.reader.Next()
+	if err != nil {
+		return nil, err
+	}
+
+	tokens := strings.Split(line, "\t")
+	if len(tokens) < 2 || len(tokens) > 3 {
+		log.Printf("ERROR: bad index entry (%s)", line)
+		return nil, ErrBadIndexEntry
+	}
+
+	entry := &IndexEntry{Id: tokens[0], Hash: tokens[1], Offset: -1}
+	if len(tokens) == 3 {
+		entry.Offset, err = strconv.ParseInt(tokens[2], 10, 64)
+		if err != nil {
+			log.Printf("ERROR: bad index entry offset (%s)", line)
+			return nil, ErrBadIndexEntry
+		}
+	}
+	return entry, nil
+}
+
+// Close - close the reader
+func (r *IndexReader) Close() {
+	r.reader.Close()
+}
+
+// build a sorted index of a MARC file, records with the same id are merged as they are during ingest.
+// Returns the index file name, the number of records and the number of repeated ids
+func indexMarcFile(dir string, name string) (string, int, int, error) {
+
+	loader, err := NewRecordLoader(commandDataSource, name, name)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	defer loader.Done()
+
+	spool, err := NewIdSpool(dir, "index-spool-*.txt")
+	if err != nil {
+		return "", 0, 0, err
+	}
+	defer spool.Remove()
+
+	count := 0
+	offset := int64(0)
+	rec, err := loader.First(true)
+	for ; err == nil; rec, err = loader.Next(true) {
+		id, _ := rec.Id()
+		err = spool.Add(indexSpoolLine(id, count, recordHash(rec.Raw()), offset))
+		if err != nil {
+			return "", 0, 0, err
+		}
+		count++
+		offset = loader.Offset()
+	}
+	if err != io.EOF {
+		return "", 0, 0, fmt.Errorf("%s: offset %d: %s", name, offset, err.Error())
+	}
+
+	index, repeated, err := sortIndexSpool(dir, spool)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	return index, count, repeated, nil
+}
+
+//
+// end of file
+//
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// allowance on top of the expected duration before something is considered stuck
+var healthSlack = 120 * time.Second
+
+// the timeout for each readiness dependency check
+var readyCheckTimeout = 5 * time.Second
+
+// when the main loop last showed signs of life (unix nanoseconds)
+var loopHeartbeat int64
+
+// note that the main loop is alive
+func noteLoopAlive() {
+	atomic.StoreInt64(&loopHeartbeat, time.Now().UnixNano())
+}
+
+// Health - the health and readiness endpoints
+type Health struct {
+	cfg *ServiceConfig
+	aws awssqs.AWS_SQS
+
+	stateLock sync.Mutex
+	failing   map[string]bool // the readiness checks currently failing
+}
+
+// HealthCheck - the result of a single check
+type HealthCheck struct {
+	Name    string `json:"name"`
+	Healthy bool   `json:"healthy"`
+	Message string `json:"message,omitempty"`
+}
+
+// NewHealth - create the health endpoints
+func NewHealth(cfg *ServiceConfig, aws awssqs.AWS_SQS) *Health {
+	return &Health{cfg: cfg, aws: aws, failing: make(map[string]bool)}
+}
+
+// register the health endpoints
+func (h *Health) register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", h.healthz)
+	mux.HandleFunc("/readyz", h.readyz)
+}
+
+// the process is alive and not stuck
+func (h *Health) healthz(w http.ResponseWriter, r *http.Request) {
+
+	checks := make([]HealthCheck, 0, 1)
+	run := getActiveRun()
+	if run == nil {
+		// waiting for notifications, each poll should take no longer than the poll timeout
+		check := HealthCheck{Name: "loop", Healthy: true}
+		since := time.Since(time.Unix(0, atomic.LoadInt64(&loopHeartbeat)))
+		if since > time.Duration(h.cfg.PollTimeOut)*time.Second+healthSlack {
+			check.Healthy = false
+			check.Message = fmt.Sprintf("no notification poll for %0.0f seconds", since.Seconds())
+		}
+		checks = append(checks, check)
+	} else {
+		status := run.Status()
+		check := HealthCheck{Name: "phase", Healthy: true}
+		expected := h.expectedPhaseDuration(status.Phase)
+		// time spent paused or held by backpressure does not count
+		since := time.Since(status.PhaseStarted) - time.Duration(status.Stalled*float64(time.Second))
+		if status.Paused == false && status.Held == false && status.PhaseStarted.IsZero() == false && since > expected {
+			check.Healthy = false
+			check.Message = fmt.Sprintf("run %s in phase %s for %0.0f seconds (expected at most %0.0f)", status.RunId, status.Phase, since.Seconds(), expected.Seconds())
+		}
+		checks = append(checks, check)
+	}
+
+	writeHealthChecks(w, checks)
+}
+
+// the expected maximum duration of a phase
+func (h *Health) expectedPhaseDuration(phase RunPhase) time.Duration {
+	switch phase {
+	case PhaseIdleWait:
+		return time.Duration(h.cfg.WaitForIdleStart)*time.Second + healthSlack
+	case PhaseDrain:
+		return time.Duration(h.cfg.WaitForIdleEnd+h.cfg.PhaseTimeout)*time.Second + healthSlack
+	default:
+		return time.Duration(h.cfg.PhaseTimeout)*time.Second + healthSlack
+	}
+}
+
+// our dependencies are available
+func (h *Health) readyz(w http.ResponseWriter, r *http.Request) {
+
+	checks := make([]HealthCheck, 0, 4)
+	checks = append(checks, h.healthCheck("postgres", h.checkPostgres()))
+	checks = append(checks, h.healthCheck("solr", pingSOLREndpoint(h.cfg.SolrMaster, h.cfg.SolrCore, readyCheckTimeout)))
+	checks = append(checks, h.healthCheck("sqs", h.checkQueues()))
+	checks = append(checks, h.healthCheck("download-dir", h.checkDownloadDir()))
+	writeHealthChecks(w, checks)
+}
+
+func (h *Health) checkPostgres() error {
+	ctx, cancel := context.WithTimeout(context.Background(), readyCheckTimeout)
+	defer cancel()
+	return dbHandle.DB().PingContext(ctx)
+}
+
+func (h *Health) checkQueues() error {
+	queues := []string{h.cfg.InQueueName, h.cfg.ErrorQueue}
+	if h.cfg.OutQueueName != "" {
+		queues = append(queues, h.cfg.OutQueueName)
+	}
+	if h.cfg.CacheQueueName != "" {
+		queues = append(queues, h.cfg.CacheQueueName)
+	}
+	for _, q := range append(queues, h.cfg.WaitIdleQueues...) {
+		_, err := h.aws.QueueHandle(q)
+		if err != nil {
+			return fmt.Errorf("queue %s: %s", q, err.Error())
+		}
+	}
+	return nil
+}
+
+// the download directory is writable and has enough free space
+func (h *Health) checkDownloadDir() error {
+
+	f, err := ioutil.TempFile(h.cfg.DownloadDir, "readyz-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	_ = os.Remove(f.Name())
+
+	var stat syscall.Statfs_t
+	err = syscall.Statfs(h.cfg.DownloadDir, &stat)
+	if err != nil {
+		return err
+	}
+
+	free := uint64(stat.Bavail) * uint64(stat.Bsize) / (1024 * 1024)
+	if free < uint64(h.cfg.MinFreeSpace) {
+		return fmt.Errorf("%d MB free, %d MB required", free, h.cfg.MinFreeSpace)
+	}
+	return nil
+}
+
+// the result of a readiness check. The checks are probed frequently so we only log when one starts failing
+// or recovers
+func (h *Health) healthCheck(name string, err error) HealthCheck {
+
+	h.stateLock.Lock()
+	wasFailing := h.failing[name]
+	h.failing[name] = err != nil
+	h.stateLock.Unlock()
+
+	if err != nil {
+		if wasFailing == false {
+			log.Printf("WARNING: readiness check %s failed (%s)", name, err.Error())
+		}
+		return HealthCheck{Name: name, Healthy: false, Message: err.Error()}
+	}
+	if wasFailing == true {
+		log.Printf("INFO: readiness check %s recovered", name)
+	}
+	return HealthCheck{Name: name, Healthy: true}
+}
+
+func writeHealthChecks(w http.ResponseWriter, checks []HealthCheck) {
+	status := http.StatusOK
+	for _, c := range checks {
+		if c.Healthy == false {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	writeJson(w, status, map[string]interface{}{"healthy": status == http.StatusOK, "checks": checks})
+}
+
+//
+// end of file
+//
@@ -2,23 +2,72 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"os"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
 var maxHttpRetries = 3
 var retrySleepTime = 100 * time.Millisecond
 
+// functions called before we terminate because of a fatal error
+var fatalHooks = make([]func(error), 0)
+var fatalInProgress = int32(0)
+var fatalHooksDone = make(chan struct{})
+
+// how long a fatal error waits for the hooks run by another one
+var fatalHookTimeout = 30 * time.Second
+
+// register a function to be called before we terminate because of a fatal error
+func onFatalError(hook func(error)) {
+	fatalHooks = append(fatalHooks, hook)
+}
+
 func fatalIfError(err error) {
 	if err != nil {
+		// the hooks are only run once. Fatal errors on other goroutines wait for them to finish, with a
+		// timeout in case it is a hook itself failing fatally
+		if atomic.CompareAndSwapInt32(&fatalInProgress, 0, 1) == true {
+			for _, hook := range fatalHooks {
+				hook(err)
+			}
+			close(fatalHooksDone)
+		} else {
+			select {
+			case <-fatalHooksDone:
+			case <-time.After(fatalHookTimeout):
+			}
+		}
 		log.Fatalf("FATAL ERROR: %s", err.Error())
 	}
 }
 
+// calculate the SHA256 checksum of a file
+func fileChecksum(name string) (string, error) {
+
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
 func httpGet(httpClient *http.Client, url string) ([]byte, error) {
 
 	req, err := http.NewRequest("GET", url, nil)
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// start the HTTP server used for metrics, health checks and the admin API (if enabled)
+func startHttpServer(cfg *ServiceConfig, health *Health, admin *AdminApi) {
+
+	if cfg.HttpListen == "" {
+		log.Printf("INFO: HTTP server disabled")
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	health.register(mux)
+	if admin != nil {
+		admin.register(mux)
+	} else {
+		log.Printf("INFO: admin API disabled, no token configured")
+	}
+
+	log.Printf("INFO: starting HTTP server on %s", cfg.HttpListen)
+	go func() {
+		err := http.ListenAndServe(cfg.HttpListen, mux)
+		fatalIfError(err)
+	}()
+}
+
+//
+// end of file
+//
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// the number of ids we sort in memory before spilling a sorted run to disk
+var spoolSortChunkSize = 1000000
+
+// IdSpool - an on-disk list of record ids, one per line
+type IdSpool struct {
+	Name   string        // the spool file name
+	file   *os.File      // the spool file handle
+	writer *bufio.Writer // buffered writes
+	Count  int           // the number of ids written
+}
+
+// NewIdSpool - create a new, empty spool file in the specified directory
+func NewIdSpool(dir string, pattern string) (*IdSpool, error) {
+
+	file, err := ioutil.TempFile(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	return &IdSpool{Name: file.Name(), file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+// Add - add an id to the spool
+func (s *IdSpool) Add(id string) error {
+	s.Count++
+	_, err := s.writer.WriteString(id + "\n")
+	return err
+}
+
+// Close - flush and close the spool, the file remains available
+func (s *IdSpool) Close() error {
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.writer.Flush()
+	if err != nil {
+		s.file.Close()
+		s.file = nil
+		return err
+	}
+	err = s.file.Close()
+	s.file = nil
+	return err
+}
+
+// Remove - close and remove the spool file
+func (s *IdSpool) Remove() {
+	_ = s.Close()
+	_ = os.Remove(s.Name)
+}
+
+// sort a spool file removing any duplicate lines and return the name of the sorted file. Large files
+// are sorted in chunks which are then merged so we never hold more than a chunk in memory
+func sortSpoolFile(dir string, name string) (string, error) {
+
+	in, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	runs := make([]string, 0)
+	defer func() {
+		for _, r := range runs {
+			_ = os.Remove(r)
+		}
+	}()
+
+	scanner := bufio.NewScanner(in)
+	chunk := make([]string, 0, spoolSortChunkSize)
+	for {
+		more := scanner.Scan()
+		if more == true {
+			chunk = append(chunk, scanner.Text())
+		}
+
+		// write a sorted run when the chunk is full or we have reached the end of the input
+		if len(chunk) == spoolSortChunkSize || (more == false && len(chunk) != 0) {
+			sort.Strings(chunk)
+			run, err := writeSortedRun(dir, chunk)
+			if err != nil {
+				return "", err
+			}
+			runs = append(runs, run)
+			chunk = chunk[:0]
+		}
+
+		if more == false {
+			break
+		}
+	}
+
+	if err = scanner.Err(); err != nil {
+		return "", err
+	}
+
+	out, err := NewIdSpool(dir, "sorted-*.ids")
+	if err != nil {
+		return "", err
+	}
+
+	err = mergeSortedRuns(runs, out)
+	if err != nil {
+		out.Remove()
+		return "", err
+	}
+
+	err = out.Close()
+	if err != nil {
+		out.Remove()
+		return "", err
+	}
+
+	return out.Name, nil
+}
+
+func writeSortedRun(dir string, lines []string) (string, error) {
+
+	run, err := NewIdSpool(dir, "run-*.ids")
+	if err != nil {
+		return "", err
+	}
+
+	for _, l := range lines {
+		if err = run.Add(l); err != nil {
+			run.Remove()
+			return "", err
+		}
+	}
+
+	if err = run.Close(); err != nil {
+		run.Remove()
+		return "", err
+	}
+	return run.Name, nil
+}
+
+// a sorted run being merged
+type mergeSource struct {
+	scanner *bufio.Scanner
+	current string
+}
+
+// a min heap of merge sources ordered by their current line
+type mergeHeap []*mergeSource
+
+func (h mergeHeap) Len() int            { return len(h) }
+func (h mergeHeap) Less(i, j int) bool  { return h[i].current < h[j].current }
+func (h mergeHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x interface{}) { *h = append(*h, x.(*mergeSource)) }
+func (h *mergeHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[0 : n-1]
+	return x
+}
+
+func mergeSortedRuns(runs []string, out *IdSpool) error {
+
+	h := make(mergeHeap, 0, len(runs))
+	for _, r := range runs {
+		f, err := os.Open(r)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		s := bufio.NewScanner(f)
+		if s.Scan() == true {
+			h = append(h, &mergeSource{scanner: s, current: s.Text()})
+		} else if s.Err() != nil {
+			return s.Err()
+		}
+	}
+	heap.Init(&h)
+
+	first := true
+	last := ""
+	for h.Len() != 0 {
+		src := h[0]
+
+		// ignore duplicates
+		if first == true || src.current != last {
+			if err := out.Add(src.current); err != nil {
+				return err
+			}
+			last = src.current
+			first = false
+		}
+
+		if src.scanner.Scan() == true {
+			src.current = src.scanner.Text()
+			heap.Fix(&h, 0)
+		} else {
+			if src.scanner.Err() != nil {
+				return src.scanner.Err()
+			}
+			heap.Pop(&h)
+		}
+	}
+
+	return nil
+}
+
+// IdReader - sequential access to a sorted id file
+type IdReader struct {
+	file    *os.File
+	scanner *bufio.Scanner
+}
+
+// NewIdReader - open a sorted id file for reading
+func NewIdReader(name string) (*IdReader, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &IdReader{file: f, scanner: bufio.NewScanner(f)}, nil
+}
+
+// Next - get the next id, returns io.EOF at the end
+func (r *IdReader) Next() (string, error) {
+	if r.scanner.Scan() == true {
+		return r.scanner.Text(), nil
+	}
+	if r.scanner.Err() != nil {
+		return "", r.scanner.Err()
+	}
+	return "", io.EOF
+}
+
+// Close - close the reader
+func (r *IdReader) Close() {
+	r.file.Close()
+}
+
+// walk 2 sorted id files and call the supplied function for each id that appears in the first
+// but not in the second
+func subtractSortedIds(first string, second string, fn func(string) error) error {
+
+	r1, err := NewIdReader(first)
+	if err != nil {
+		return err
+	}
+	defer r1.Close()
+
+	r2, err := NewIdReader(second)
+	if err != nil {
+		return err
+	}
+	defer r2.Close()
+
+	id2, err2 := r2.Next()
+	if err2 != nil && err2 != io.EOF {
+		return err2
+	}
+
+	for {
+		id1, err1 := r1.Next()
+		if err1 != nil {
+			if err1 == io.EOF {
+				return nil
+			}
+			return err1
+		}
+
+		// advance the second list until it catches up with the first
+		for err2 == nil && id2 < id1 {
+			id2, err2 = r2.Next()
+			if err2 != nil && err2 != io.EOF {
+				return err2
+			}
+		}
+
+		// the id is not in the second list
+		if err2 == io.EOF || id2 != id1 {
+			if err := fn(id1); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// the number of ids in a spool that repeat an earlier id, the spool is closed
+func countDuplicateIds(dir string, spool *IdSpool) (int, error) {
+
+	err := spool.Close()
+	if err != nil {
+		return 0, err
+	}
+	sorted, err := sortSpoolFile(dir, spool.Name)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(sorted)
+
+	unique, err := countSortedIds(sorted)
+	if err != nil {
+		return 0, err
+	}
+	return spool.Count - unique, nil
+}
+
+//
+// end of file
+//
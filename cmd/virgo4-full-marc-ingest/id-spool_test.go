@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// write the ids to a spool in the specified directory
+func testSpool(t *testing.T, dir string, ids []string) *IdSpool {
+	t.Helper()
+	spool, err := NewIdSpool(dir, "test-*.ids")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range ids {
+		if err = spool.Add(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = spool.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return spool
+}
+
+// read a sorted id file
+func readIds(t *testing.T, name string) []string {
+	t.Helper()
+	reader, err := NewIdReader(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	ids := make([]string, 0)
+	for {
+		id, err := reader.Next()
+		if err == io.EOF {
+			return ids
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+}
+
+func TestSortSpoolFile(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		chunkSize int
+		ids       []string
+		expected  []string
+	}{
+		{"empty", 3, []string{}, []string{}},
+		{"single chunk", 10, []string{"u3", "u1", "u2"}, []string{"u1", "u2", "u3"}},
+		{"exact chunks", 2, []string{"u4", "u3", "u2", "u1"}, []string{"u1", "u2", "u3", "u4"}},
+		{"partial last chunk", 3, []string{"u7", "u2", "u9", "u1", "u5", "u3", "u8"}, []string{"u1", "u2", "u3", "u5", "u7", "u8", "u9"}},
+		{"chunk of one", 1, []string{"c", "a", "b"}, []string{"a", "b", "c"}},
+		{"duplicates within a chunk", 4, []string{"b", "a", "b", "a"}, []string{"a", "b"}},
+		{"duplicates across chunks", 2, []string{"b", "a", "c", "b", "a", "c"}, []string{"a", "b", "c"}},
+		{"byte order", 2, []string{"u10", "u9", "U1", "u1"}, []string{"U1", "u1", "u10", "u9"}},
+	}
+
+	defer func(size int) { spoolSortChunkSize = size }(spoolSortChunkSize)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			spoolSortChunkSize = test.chunkSize
+			spool := testSpool(t, dir, test.ids)
+
+			sorted, err := sortSpoolFile(dir, spool.Name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := readIds(t, sorted)
+			if reflect.DeepEqual(got, test.expected) == false {
+				t.Errorf("got %v, expected %v", got, test.expected)
+			}
+
+			// the sorted runs are removed, only the spool and the result remain
+			entries, err := os.ReadDir(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 2 {
+				t.Errorf("got %d files in the spool directory, expected 2", len(entries))
+			}
+		})
+	}
+}
+
+func TestSubtractSortedIds(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		first    []string
+		second   []string
+		expected []string
+	}{
+		{"all in the second", []string{"a", "b"}, []string{"a", "b"}, []string{}},
+		{"second empty", []string{"a", "b"}, []string{}, []string{"a", "b"}},
+		{"some in the second", []string{"a", "b", "c", "d"}, []string{"b", "d", "e"}, []string{"a", "c"}},
+		{"first empty", []string{}, []string{"a"}, []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			first := testSpool(t, dir, test.first)
+			second := testSpool(t, dir, test.second)
+
+			got := make([]string, 0)
+			err := subtractSortedIds(first.Name, second.Name, func(id string) error {
+				got = append(got, id)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if reflect.DeepEqual(got, test.expected) == false {
+				t.Errorf("got %v, expected %v", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestCountDuplicateIds(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		ids      []string
+		expected int
+	}{
+		{"no ids", []string{}, 0},
+		{"unique", []string{"c", "a", "b"}, 0},
+		{"repeated", []string{"a", "b", "a", "c", "a", "b"}, 3},
+	}
+
+	defer func(size int) { spoolSortChunkSize = size }(spoolSortChunkSize)
+	spoolSortChunkSize = 2
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			spool := testSpool(t, dir, test.ids)
+			got, err := countDuplicateIds(dir, spool)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.expected {
+				t.Errorf("got %d, expected %d", got, test.expected)
+			}
+		})
+	}
+}
+
+//
+// end of file
+//
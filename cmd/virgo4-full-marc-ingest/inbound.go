@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
 	"log"
@@ -14,10 +16,21 @@ type InboundFile struct {
 	ObjectSize   int64
 }
 
-func getInboundNotification(config ServiceConfig, aws awssqs.AWS_SQS, inQueueHandle awssqs.QueueHandle) ([]InboundFile, awssqs.ReceiptHandle, error) {
+func getInboundNotification(config ServiceConfig, aws awssqs.AWS_SQS, inQueueHandle awssqs.QueueHandle, requests <-chan []InboundFile) ([]InboundFile, awssqs.Message, error) {
 
 	for {
 
+		noteLoopAlive()
+
+		// has a run been requested through the admin API. There is no inbound message to delete
+		select {
+		case inboundFiles := <-requests:
+			log.Printf("INFO: received an ingest request")
+			payload, _ := json.Marshal(inboundFiles)
+			return inboundFiles, awssqs.Message{Payload: payload}, nil
+		default:
+		}
+
 		// get the next message if one is available
 		messages, err := aws.BatchMessageGet(inQueueHandle, 1, time.Duration(config.PollTimeOut)*time.Second)
 		if err != nil {
@@ -40,7 +53,7 @@ func getInboundNotification(config ServiceConfig, aws awssqs.AWS_SQS, inQueueHan
 			// assume the message is an S3 event containing a list of one or more new objecxts
 			newS3objects, err := decodeS3Event(messages[0])
 			if err != nil {
-				return nil, "", err
+				return nil, awssqs.Message{}, err
 			}
 
 			// we have some objects to download
@@ -51,7 +64,7 @@ func getInboundNotification(config ServiceConfig, aws awssqs.AWS_SQS, inQueueHan
 					// some file names may be HTML encoded... un-encode them here...
 					key, err := url.QueryUnescape(s3.S3.Object.Key)
 					if err != nil {
-						return nil, "", err
+						return nil, awssqs.Message{}, err
 					}
 
 					inboundFiles = append(inboundFiles,
@@ -61,7 +74,7 @@ func getInboundNotification(config ServiceConfig, aws awssqs.AWS_SQS, inQueueHan
 							ObjectSize:   s3.S3.Object.Size})
 				}
 
-				return inboundFiles, messages[0].ReceiptHandle, nil
+				return inboundFiles, messages[0], nil
 			} else {
 				log.Printf("WARNING: not an interesting notification, ignoring it")
 			}
@@ -72,6 +85,12 @@ func getInboundNotification(config ServiceConfig, aws awssqs.AWS_SQS, inQueueHan
 	}
 }
 
+// identify a notification so a redelivered one can be recognised
+func notificationKey(message awssqs.Message) string {
+	sum := sha256.Sum256(message.Payload)
+	return hex.EncodeToString(sum[:])
+}
+
 // turn a message received from the inbound queue into a list of zero or more new S3 objects
 func decodeS3Event(message awssqs.Message) ([]S3EventRecord, error) {
 
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrBadLogLevel = fmt.Errorf("unknown log level")
+
+// LogLevel - the severity of a log line
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarning
+	LevelError
+	LevelFatal
+)
+
+var logLevelNames = map[LogLevel]string{
+	LevelDebug:   "debug",
+	LevelInfo:    "info",
+	LevelWarning: "warning",
+	LevelError:   "error",
+	LevelFatal:   "fatal",
+}
+
+// the line prefixes used throughout the code and the levels they represent, longest first
+var logLevelPrefixes = []struct {
+	prefix string
+	level  LogLevel
+}{
+	{"FATAL ERROR: ", LevelFatal},
+	{"WARNING: ", LevelWarning},
+	{"ERROR: ", LevelError},
+	{"DEBUG: ", LevelDebug},
+	{"INFO: ", LevelInfo},
+}
+
+// LogContext - the fields added to every log line
+type LogContext struct {
+	RunId      string
+	DataSource string
+	File       string
+}
+
+// the structured logger that log.Printf output is routed through
+type structuredLogger struct {
+	sync.Mutex
+	out          io.Writer
+	json         bool
+	level        LogLevel
+	recordLevel  LogLevel // the level for per-record lines
+	recordSample uint64   // only 1 in this many per-record lines (below ERROR) are logged
+	recordCount  uint64   // per-record lines seen
+	context      LogContext
+}
+
+// the defaults are suitable for the offline commands
+var logger = &structuredLogger{out: os.Stderr, level: LevelInfo, recordLevel: LevelInfo, recordSample: 1}
+
+func parseLogLevel(name string) (LogLevel, error) {
+	for level, n := range logLevelNames {
+		if strings.EqualFold(n, name) {
+			return level, nil
+		}
+	}
+	return LevelInfo, ErrBadLogLevel
+}
+
+// route all log output through the structured logger
+func configureLogging(format string, level LogLevel, recordLevel LogLevel, recordSample int) {
+
+	logger.Lock()
+	logger.json = format == "json"
+	logger.level = level
+	logger.recordLevel = recordLevel
+	logger.recordSample = 1
+	if recordSample > 1 {
+		logger.recordSample = uint64(recordSample)
+	}
+	logger.Unlock()
+
+	log.SetFlags(0)
+	log.SetOutput(logger)
+}
+
+// set the fields added to every log line
+func setLogContext(context LogContext) {
+	logger.Lock()
+	defer logger.Unlock()
+	logger.context = context
+}
+
+// set the current file in the log context
+func setLogContextFile(file string) {
+	logger.Lock()
+	defer logger.Unlock()
+	logger.context.File = file
+}
+
+// Write - called by the log package with each line
+func (l *structuredLogger) Write(line []byte) (int, error) {
+
+	message := strings.TrimSuffix(string(line), "\n")
+	level := LevelInfo
+	for _, p := range logLevelPrefixes {
+		if strings.HasPrefix(message, p.prefix) {
+			level = p.level
+			break
+		}
+	}
+
+	l.emit(level, message, nil)
+	return len(line), nil
+}
+
+// log a line about a specific record, these can be suppressed or sampled on noisy files
+func logRecordf(level LogLevel, id string, offset int64, format string, args ...interface{}) {
+
+	logger.Lock()
+	recordLevel, recordSample := logger.recordLevel, logger.recordSample
+	logger.Unlock()
+
+	if level < recordLevel {
+		return
+	}
+	if level < LevelError && recordSample > 1 {
+		if atomic.AddUint64(&logger.recordCount, 1)%recordSample != 1 {
+			return
+		}
+	}
+
+	fields := map[string]interface{}{"offset": offset}
+	if id != "" {
+		fields["record_id"] = id
+	}
+	prefix := strings.ToUpper(logLevelNames[level]) + ": "
+	logger.emit(level, prefix+fmt.Sprintf(format, args...), fields)
+}
+
+func (l *structuredLogger) emit(level LogLevel, message string, fields map[string]interface{}) {
+
+	l.Lock()
+	defer l.Unlock()
+
+	if level < l.level {
+		return
+	}
+
+	now := time.Now()
+	if l.json == true {
+		entry := map[string]interface{}{
+			"time":    now.UTC().Format(time.RFC3339Nano),
+			"level":   logLevelNames[level],
+			"message": stripLevelPrefix(message),
+		}
+		if l.context.RunId != "" {
+			entry["run_id"] = l.context.RunId
+		}
+		if l.context.DataSource != "" {
+			entry["data_source"] = l.context.DataSource
+		}
+		if l.context.File != "" {
+			entry["file"] = l.context.File
+		}
+		for k, v := range fields {
+			entry[k] = v
+		}
+		buf, err := json.Marshal(entry)
+		if err != nil {
+			buf = []byte(fmt.Sprintf(`{"level":"error","message":"unable to log line (%s)"}`, err.Error()))
+		}
+		_, _ = l.out.Write(append(buf, '\n'))
+		return
+	}
+
+	// text lines look as they always have with any context appended
+	var buf strings.Builder
+	buf.WriteString(now.Format("2006/01/02 15:04:05 "))
+	buf.WriteString(message)
+	if l.context.RunId != "" {
+		buf.WriteString(fmt.Sprintf(" [run=%s source=%s", l.context.RunId, l.context.DataSource))
+		if l.context.File != "" {
+			buf.WriteString(fmt.Sprintf(" file=%s", l.context.File))
+		}
+		buf.WriteString("]")
+	}
+	if id, ok := fields["record_id"]; ok == true {
+		buf.WriteString(fmt.Sprintf(" [record=%v]", id))
+	}
+	if offset, ok := fields["offset"]; ok == true {
+		buf.WriteString(fmt.Sprintf(" [offset=%v]", offset))
+	}
+	buf.WriteString("\n")
+	_, _ = l.out.Write([]byte(buf.String()))
+}
+
+func stripLevelPrefix(message string) string {
+	for _, p := range logLevelPrefixes {
+		if strings.HasPrefix(message, p.prefix) {
+			return strings.TrimPrefix(message, p.prefix)
+		}
+	}
+	return message
+}
+
+//
+// end of file
+//
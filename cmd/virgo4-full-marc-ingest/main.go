@@ -2,11 +2,8 @@ package main
 
 import (
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"os"
-	"time"
 
 	"github.com/uvalib/uva-aws-s3-sdk/uva-s3"
 	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
@@ -14,15 +11,19 @@ import (
 
 var ErrTooManyUnprocessedItems = fmt.Errorf("too many unprocessed items")
 
-type NameTuple struct {
-	LocalName  string
-	RemoteName string
-}
-
 // main entry point
 func main() {
 
+	// offline commands do not need the service configuration. Anything else on the command line (the
+	// container entrypoint may pass flags) runs the service
+	if len(os.Args) > 1 && isCommand(os.Args[1]) == true {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	log.Printf("===> %s service staring up (version: %s) <===", os.Args[0], Version())
+	if len(os.Args) > 1 {
+		log.Printf("INFO: ignoring command line arguments %v", os.Args[1:])
+	}
 
 	// Get config params and use them to init service context. Any issues are fatal
 	cfg := LoadConfiguration()
@@ -31,6 +32,12 @@ func main() {
 	err := newDBConnection(cfg)
 	fatalIfError(err)
 
+	// ensure the run ledger and lock schema is up to date
+	if cfg.RunLedger == true || cfg.RunLock == true {
+		err = runMigrations()
+		fatalIfError(err)
+	}
+
 	// load our AWS sqs helper object
 	aws, err := awssqs.NewAwsSqs(awssqs.AwsSqsConfig{MessageBucketName: cfg.MessageBucketName})
 	fatalIfError(err)
@@ -40,92 +47,89 @@ func main() {
 	fatalIfError(err)
 
 	// ensure the queues exist
-	fatalIfError(ensureQueuesExist(aws, append(cfg.WaitIdleQueues, cfg.ErrorQueue)))
+	queues := append(append([]string{cfg.ErrorQueue}, cfg.WaitIdleQueues...), cfg.BackpressureQueues...)
+	fatalIfError(ensureQueuesExist(aws, queues))
 
 	// get the queue handles from the queue name
 	inQueueHandle, err := aws.QueueHandle(cfg.InQueueName)
 	fatalIfError(err)
 
-	outQueueHandle, err := aws.QueueHandle(cfg.OutQueueName)
+	// where the records go
+	sink, err := newOutboundSink(cfg, aws)
 	fatalIfError(err)
+	outboundSink = sink
 
-	var cacheQueueHandle awssqs.QueueHandle
-	if cfg.CacheQueueName != "" {
-		cacheQueueHandle, err = aws.QueueHandle(cfg.CacheQueueName)
+	// records that cannot be sent are spilled and resent at the end of the run
+	if cfg.SpillFailures == true {
+		outboundSpill, err = NewSpillFile(cfg.DownloadDir)
 		fatalIfError(err)
 	}
 
 	// create the record channel
 	recordsChan := make(chan Record, cfg.WorkerQueueSize)
+	registerRecordsChannelMetric(recordsChan)
 
-	// start workers here
+	// run notifications
+	initNotifiers(cfg)
+
+	// metrics, health checks and the admin API
+	var admin *AdminApi
+	if cfg.AdminToken != "" {
+		admin = NewAdminApi(cfg, s3Svc)
+	}
+	noteLoopAlive()
+	startHttpServer(cfg, NewHealth(cfg, aws), admin)
+	ingestRequests := make(<-chan []InboundFile)
+	if admin != nil {
+		ingestRequests = admin.ingest
+	}
+
+	// used to track records until they have been sent
+	tracker := NewRecordTracker()
+
+	// start workers here, they share the outbound rate limit
+	throttle := NewOutboundThrottle(cfg)
 	for w := 1; w <= cfg.Workers; w++ {
-		go worker(w, *cfg, aws, outQueueHandle, cacheQueueHandle, recordsChan)
+		go worker(w, *cfg, sink, throttle, tracker, recordsChan)
 	}
 
-	for {
-		// top of our processing loop
-		err = nil
+	// record the failure of any run in progress
+	onFatalError(func(err error) {
+		run := getActiveRun()
+		if run != nil {
+			run.Fail(err)
+		}
+	})
 
-		// notification that there is one or more new ingest files to be processed
-		inbound, receiptHandle, e := getInboundNotification(*cfg, aws, inQueueHandle)
-		fatalIfError(e)
+	// tracing is configured after the run failure hook so the spans of a failed run are flushed
+	initTracing(cfg)
 
-		// download each file and validate it
-		fileSets := make([]NameTuple, 0)
-		for _, f := range inbound {
+	// resume anything that was interrupted
+	if cfg.ResumeRuns == true {
+		resumeIncompleteRuns(cfg, aws, s3Svc, recordsChan, tracker)
+	}
 
-			// save the remote name, we will need it later
-			file := NameTuple{
-				RemoteName: fmt.Sprintf("%s/%s", f.SourceBucket, f.SourceKey),
-			}
+	// the notifications a dry run has already processed, they remain on the queue and are redelivered
+	dryRunSeen := make(map[string]bool)
 
-			// VIRGONEW-2419
-			if f.ObjectSize == 0 {
-				log.Printf("INFO: notification is reporting %s is ZERO length, ignoring", file.RemoteName)
-				continue
-			}
+	for {
+		// notification that there is one or more new ingest files to be processed
+		inbound, message, err := getInboundNotification(*cfg, aws, inQueueHandle, ingestRequests)
+		fatalIfError(err)
 
-			// create temp file
-			tmp, e := ioutil.TempFile(cfg.DownloadDir, "")
-			fatalIfError(e)
-			tmp.Close()
-			file.LocalName = tmp.Name()
-
-			// download the file
-			o := uva_s3.NewUvaS3Object(f.SourceBucket, f.SourceKey)
-			e = s3Svc.GetToFile(o, file.LocalName)
-			fatalIfError(e)
-
-			// update our lost of files to be processed
-			fileSets = append(fileSets, file)
-
-			log.Printf("INFO: validating %s (%s)", file.RemoteName, file.LocalName)
-
-			// create a new loader
-			loader, e := NewRecordLoader(cfg.DataSource, file.RemoteName, file.LocalName)
-			fatalIfError(e)
-
-			// validate the file
-			e = loader.Validate()
-			loader.Done()
-			if e == nil {
-				log.Printf("INFO: %s (%s) appears to be OK, ready for ingest", file.RemoteName, file.LocalName)
-			} else {
-				log.Printf("ERROR: %s (%s) appears to be invalid, ignoring it (%s)", file.RemoteName, file.LocalName, e.Error())
-				err = e
-				break
+		if message.ReceiptHandle != "" && cfg.DryRun == true {
+			key := notificationKey(message)
+			if dryRunSeen[key] == true {
+				log.Printf("INFO: DRY RUN, notification already processed, ignoring it")
+				continue
 			}
+			dryRunSeen[key] = true
 		}
 
-		// one of the files was invalid, we need to ignore the entire batch and delete the local files
-		if err != nil {
-			for _, f := range fileSets {
-				log.Printf("INFO: removing invalid file %s", f.LocalName)
-				e := os.Remove(f.LocalName)
-				fatalIfError(e)
-			}
+		run := NewIngestRun(cfg, aws, s3Svc, recordsChan, tracker, NewRunSummary(cfg.DataSource, string(message.Payload), cfg.DryRun))
 
+		// download and validate the inbound files
+		if run.Prepare(inbound) == false {
 			// go back to waiting for the next notification
 			continue
 		}
@@ -133,141 +137,33 @@ func main() {
 		// if we got here without an error then all the files can be processed... we can delete the inbound message
 		// because it has been processed
 
-		delMessages := make([]awssqs.Message, 0, 1)
-		delMessages = append(delMessages, awssqs.Message{ReceiptHandle: receiptHandle})
-		opStatus, err := aws.BatchMessageDelete(inQueueHandle, delMessages)
-		if err != nil {
-			if err != awssqs.ErrOneOrMoreOperationsUnsuccessful {
-				fatalIfError(err)
-			}
-		}
-
-		// check the operation results
-		for ix, op := range opStatus {
-			if op == false {
-				log.Printf("ERROR: message %d failed to delete", ix)
-			}
-		}
-
-		//
-		// the inbound file(s) have been downloaded and validated, we need to do the other pre-processing steps now
-		//
-
-		// disable the ingest services
-		err = stopManagedServices(cfg.ECSClusterName, cfg.ManagedECSServices)
-		fatalIfError(err)
-
-		// wait until the work queues are idle
-		err = ensureQueuesIdle(aws, cfg.WaitIdleQueues, int(cfg.PollTimeOut), cfg.WaitForIdleStart)
-		fatalIfError(err)
-
-		// once processing is complete, we will delete old records so we need to capture the time we start
-		startIngest := time.Now()
-		//startIngest := time.Date(2018, 0, 1, 0, 0, 0, 0, time.UTC)
-
-		// now we can process each of the inbound files
-		for _, file := range fileSets {
-
-			start := time.Now()
-			log.Printf("INFO: processing %s (%s)", file.RemoteName, file.LocalName)
-
-			loader, err := NewRecordLoader(cfg.DataSource, file.RemoteName, file.LocalName)
-			// fatal fail here because we have already validated the file and believe it to be correct so this
-			// is some other sort of failure
-			fatalIfError(err)
-
-			// get the first record
-			count := 0
-			rec, err := loader.First(true)
+		// runs requested through the admin API have no inbound message. A dry run leaves the message for the
+		// real run, it will be delivered again once its visibility timeout expires and is then ignored
+		if message.ReceiptHandle != "" && cfg.DryRun == true {
+			log.Printf("INFO: DRY RUN, not deleting the inbound notification")
+		} else if message.ReceiptHandle != "" {
+			delMessages := make([]awssqs.Message, 0, 1)
+			delMessages = append(delMessages, awssqs.Message{ReceiptHandle: message.ReceiptHandle})
+			opStatus, err := aws.BatchMessageDelete(inQueueHandle, delMessages)
 			if err != nil {
-				// are we done
-				if err == io.EOF {
-					log.Printf("WARNING: EOF on first read, unexpected empty file")
-				} else {
-					// fatal fail here because we have already validated the file and believe it to be correct so this
-					// is some other sort of failure
-					log.Fatal(err)
+				if err != awssqs.ErrOneOrMoreOperationsUnsuccessful {
+					fatalIfError(err)
 				}
 			}
 
-			// we can get here with an error if the first read yields EOF
-			if err == nil {
-				for {
-
-					// here we overwrite the record source if configured to do so, otherwise we use the
-					// one from the loader, determined by the filename.
-
-					if cfg.DataSource != "" {
-						rec.SetSource(cfg.DataSource)
-					}
-
-					count++
-					recordsChan <- rec
-
-					rec, err = loader.Next(true)
-					if err != nil {
-						if err == io.EOF {
-							// this is expected, break out of the processing loop
-							break
-						}
-						// fatal fail here because we have already validated the file and believe it to be correct so this
-						// is some other sort of failure
-						log.Fatal(err)
-					}
+			// check the operation results
+			for ix, op := range opStatus {
+				if op == false {
+					log.Printf("ERROR: message %d failed to delete", ix)
 				}
 			}
-
-			loader.Done()
-			duration := time.Since(start)
-			log.Printf("INFO: done processing %s (%s). %d records (%0.2f tps)", file.RemoteName, file.LocalName, count, float64(count)/duration.Seconds())
-
-			// file has been ingested, remove it
-			log.Printf("INFO: removing processed file %s", file.LocalName)
-			err = os.Remove(file.LocalName)
-			fatalIfError(err)
 		}
 
-		// wait until we have processed all outbound items
-		for {
-			pending := len(recordsChan)
-			// is our queue empty
-			if pending == 0 {
-				// wait until the workers have flushed their queues
-				time.Sleep(flushTimeout)
-				break
-			} else {
-				log.Printf("INFO: waiting for all records to be queued (%d remain)", pending)
-				time.Sleep(flushTimeout)
-			}
-		}
-
-		// wait until the work queues are idle
-		err = ensureQueuesIdle(aws, cfg.WaitIdleQueues, int(cfg.PollTimeOut), cfg.WaitForIdleEnd)
-		fatalIfError(err)
-
-		// delete old SOLR stuff
-		if cfg.DeleteSolr == true {
-			err = deleteOldSolrRecords(cfg.SolrMaster, cfg.SolrCore, cfg.SolrTimeout, cfg.DataSource, startIngest)
-			//fatalIfError(err)
-		}
-
-		// delete old cache stuff
-		if cfg.DeleteCache == true {
-			err = deleteOldCacheRecords(cfg.DataSource, startIngest)
-			//fatalIfError(err)
-		}
-
-		// determine of we have unprocessed items and abort if we have too many
-		unprocessed, err := getQueueMessageCount(aws, cfg.ErrorQueue)
-		fatalIfError(err)
-		if unprocessed >= uint(cfg.ErrorThreshold) {
-			log.Printf("ERROR: too many unprocessed items (%d)", unprocessed)
-			fatalIfError(ErrTooManyUnprocessedItems)
-		}
+		//
+		// the inbound file(s) have been downloaded and validated, we need to do the other processing steps now
+		//
 
-		// re-enable the ingest services
-		err = startManagedServices(cfg.ECSClusterName, cfg.ManagedECSServices)
-		fatalIfError(err)
+		run.Process(PhaseStopServices)
 	}
 }
 
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// the MARC subfield delimiter
+var subfieldDelimiter = byte(0x1f)
+
+// the MARC leader size
+var marcLeaderSize = 24
+
+// MarcRecord - a parsed MARC record
+type MarcRecord struct {
+	Leader string      // the 24 byte leader
+	Fields []MarcField // the fields in directory order
+}
+
+// MarcField - a parsed MARC field; control fields have a value, data fields have indicators and subfields
+type MarcField struct {
+	Tag        string
+	Value      string
+	Indicator1 byte
+	Indicator2 byte
+	Subfields  []MarcSubfield
+}
+
+// MarcSubfield - a parsed MARC subfield
+type MarcSubfield struct {
+	Code  byte
+	Value string
+}
+
+// IsControl - is this a control field (tags 001 - 009)
+func (f *MarcField) IsControl() bool {
+	return strings.HasPrefix(f.Tag, "00")
+}
+
+// parseMarcRecord - parse a raw MARC record, reporting the first structural problem found
+func parseMarcRecord(raw []byte) (*MarcRecord, error) {
+
+	if len(raw) < marcLeaderSize {
+		return nil, fmt.Errorf("record shorter than the leader (%d bytes)", len(raw))
+	}
+
+	leader := string(raw[0:marcLeaderSize])
+	length, err := strconv.Atoi(leader[0:5])
+	if err != nil {
+		return nil, fmt.Errorf("leader record length invalid (%s)", leader[0:5])
+	}
+	if length != len(raw) {
+		return nil, fmt.Errorf("leader record length %d does not match the actual length %d", length, len(raw))
+	}
+
+	baseAddress, err := strconv.Atoi(leader[12:17])
+	if err != nil {
+		return nil, fmt.Errorf("leader base address invalid (%s)", leader[12:17])
+	}
+	if baseAddress <= marcLeaderSize || baseAddress > len(raw) {
+		return nil, fmt.Errorf("leader base address %d out of range", baseAddress)
+	}
+	if raw[baseAddress-1] != fieldTerminator {
+		return nil, fmt.Errorf("directory terminator missing at offset %d", baseAddress-1)
+	}
+	if (baseAddress-1-marcLeaderSize)%marcRecordFieldDirEntrySize != 0 {
+		return nil, fmt.Errorf("directory length %d is not a multiple of %d", baseAddress-1-marcLeaderSize, marcRecordFieldDirEntrySize)
+	}
+
+	record := &MarcRecord{Leader: leader, Fields: make([]MarcField, 0, (baseAddress-marcLeaderSize)/marcRecordFieldDirEntrySize)}
+	for offset := marcLeaderSize; offset < baseAddress-1; offset += marcRecordFieldDirEntrySize {
+		entry := raw[offset : offset+marcRecordFieldDirEntrySize]
+		tag := string(entry[0:3])
+		fieldLength, err := strconv.Atoi(string(entry[3:7]))
+		if err != nil {
+			return nil, fmt.Errorf("field %s length invalid (%s)", tag, string(entry[3:7]))
+		}
+		fieldOffset, err := strconv.Atoi(string(entry[7:12]))
+		if err != nil {
+			return nil, fmt.Errorf("field %s offset invalid (%s)", tag, string(entry[7:12]))
+		}
+
+		start := baseAddress + fieldOffset
+		end := start + fieldLength
+		if fieldLength == 0 || end > len(raw) {
+			return nil, fmt.Errorf("field %s (offset %d, length %d) lies outside the record", tag, fieldOffset, fieldLength)
+		}
+		if raw[end-1] != fieldTerminator {
+			return nil, fmt.Errorf("field %s is not terminated", tag)
+		}
+
+		field, err := parseMarcField(tag, raw[start:end-1])
+		if err != nil {
+			return nil, err
+		}
+		record.Fields = append(record.Fields, *field)
+	}
+
+	return record, nil
+}
+
+// parseMarcRecords - parse one or more concatenated raw MARC records (records sharing an id are merged
+// this way during ingest)
+func parseMarcRecords(raw []byte) ([]*MarcRecord, error) {
+
+	records := make([]*MarcRecord, 0, 1)
+	for len(raw) != 0 {
+		if len(raw) < marcRecordHeaderSize {
+			return nil, fmt.Errorf("trailing data after record %d", len(records))
+		}
+		length, err := strconv.Atoi(string(raw[0:marcRecordHeaderSize]))
+		if err != nil || length > len(raw) || length < marcLeaderSize {
+			return nil, fmt.Errorf("record %d length invalid (%s)", len(records), string(raw[0:marcRecordHeaderSize]))
+		}
+		record, err := parseMarcRecord(raw[0:length])
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+		raw = raw[length:]
+	}
+	return records, nil
+}
+
+func parseMarcField(tag string, data []byte) (*MarcField, error) {
+
+	field := &MarcField{Tag: tag}
+	if field.IsControl() == true {
+		field.Value = string(data)
+		return field, nil
+	}
+
+	if len(data) < 2 {
+		return nil, fmt.Errorf("field %s has no indicators", tag)
+	}
+
+	field.Indicator1 = data[0]
+	field.Indicator2 = data[1]
+	field.Subfields = make([]MarcSubfield, 0)
+	for ix, sub := range bytes.Split(data[2:], []byte{subfieldDelimiter}) {
+		// anything before the first delimiter should be empty
+		if ix == 0 {
+			if len(sub) != 0 {
+				return nil, fmt.Errorf("field %s has data before the first subfield", tag)
+			}
+			continue
+		}
+		if len(sub) == 0 {
+			return nil, fmt.Errorf("field %s has an empty subfield", tag)
+		}
+		field.Subfields = append(field.Subfields, MarcSubfield{Code: sub[0], Value: string(sub[1:])})
+	}
+
+	return field, nil
+}
+
+// Field - the first field with the specified tag (or nil)
+func (r *MarcRecord) Field(tag string) *MarcField {
+	for ix := range r.Fields {
+		if r.Fields[ix].Tag == tag {
+			return &r.Fields[ix]
+		}
+	}
+	return nil
+}
+
+// Text - the record as human readable text, one field per line
+func (r *MarcRecord) Text() string {
+
+	var buf strings.Builder
+	buf.WriteString(fmt.Sprintf("LDR    %s\n", r.Leader))
+	for _, f := range r.Fields {
+		if f.IsControl() == true {
+			buf.WriteString(fmt.Sprintf("%s    %s\n", f.Tag, f.Value))
+			continue
+		}
+		buf.WriteString(fmt.Sprintf("%s %c%c ", f.Tag, f.Indicator1, f.Indicator2))
+		for _, s := range f.Subfields {
+			buf.WriteString(fmt.Sprintf("$%c%s", s.Code, s.Value))
+		}
+		buf.WriteString("\n")
+	}
+	return buf.String()
+}
+
+// Bytes - the record serialized as ISO 2709, the leader length and base address are recalculated
+func (r *MarcRecord) Bytes() ([]byte, error) {
+
+	if len(r.Leader) != marcLeaderSize {
+		return nil, fmt.Errorf("leader must be %d bytes", marcLeaderSize)
+	}
+
+	var directory, data bytes.Buffer
+	for _, f := range r.Fields {
+		if len(f.Tag) != 3 {
+			return nil, fmt.Errorf("field tag invalid (%s)", f.Tag)
+		}
+		start := data.Len()
+		if f.IsControl() == true {
+			data.WriteString(f.Value)
+		} else {
+			data.WriteByte(f.Indicator1)
+			data.WriteByte(f.Indicator2)
+			for _, s := range f.Subfields {
+				data.WriteByte(subfieldDelimiter)
+				data.WriteByte(s.Code)
+				data.WriteString(s.Value)
+			}
+		}
+		data.WriteByte(fieldTerminator)
+
+		length := data.Len() - start
+		if length > 9999 || start > 99999 {
+			return nil, fmt.Errorf("field %s is too large to serialize", f.Tag)
+		}
+		directory.WriteString(fmt.Sprintf("%s%04d%05d", f.Tag, length, start))
+	}
+	directory.WriteByte(fieldTerminator)
+
+	baseAddress := marcLeaderSize + directory.Len()
+	total := baseAddress + data.Len() + 1
+	if total > 99999 {
+		return nil, fmt.Errorf("record is too large to serialize (%d bytes)", total)
+	}
+
+	leader := []byte(r.Leader)
+	copy(leader[0:5], fmt.Sprintf("%05d", total))
+	copy(leader[12:17], fmt.Sprintf("%05d", baseAddress))
+
+	buf := make([]byte, 0, total)
+	buf = append(buf, leader...)
+	buf = append(buf, directory.Bytes()...)
+	buf = append(buf, data.Bytes()...)
+	return append(buf, recordTerminator), nil
+}
+
+// the MARCXML representation
+type marcXmlCollection struct {
+	XMLName xml.Name        `xml:"http://www.loc.gov/MARC21/slim collection"`
+	Records []marcXmlRecord `xml:"record"`
+}
+
+type marcXmlRecord struct {
+	Leader        string                `xml:"leader"`
+	ControlFields []marcXmlControlField `xml:"controlfield"`
+	DataFields    []marcXmlDataField    `xml:"datafield"`
+}
+
+type marcXmlControlField struct {
+	Tag   string `xml:"tag,attr"`
+	Value string `xml:",chardata"`
+}
+
+type marcXmlDataField struct {
+	Tag       string            `xml:"tag,attr"`
+	Ind1      string            `xml:"ind1,attr"`
+	Ind2      string            `xml:"ind2,attr"`
+	Subfields []marcXmlSubfield `xml:"subfield"`
+}
+
+type marcXmlSubfield struct {
+	Code  string `xml:"code,attr"`
+	Value string `xml:",chardata"`
+}
+
+// marcXml - the records as a MARCXML collection
+func marcXml(records []*MarcRecord) ([]byte, error) {
+
+	collection := marcXmlCollection{Records: make([]marcXmlRecord, 0, len(records))}
+	for _, r := range records {
+		rec := marcXmlRecord{Leader: r.Leader}
+		for _, f := range r.Fields {
+			if f.IsControl() == true {
+				rec.ControlFields = append(rec.ControlFields, marcXmlControlField{Tag: f.Tag, Value: f.Value})
+				continue
+			}
+			df := marcXmlDataField{Tag: f.Tag, Ind1: string(f.Indicator1), Ind2: string(f.Indicator2)}
+			for _, s := range f.Subfields {
+				df.Subfields = append(df.Subfields, marcXmlSubfield{Code: string(s.Code), Value: s.Value})
+			}
+			rec.DataFields = append(rec.DataFields, df)
+		}
+		collection.Records = append(collection.Records, rec)
+	}
+
+	buf, err := xml.MarshalIndent(collection, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), buf...), nil
+}
+
+// marcJson - the records in MARC-in-JSON format
+func marcJson(records []*MarcRecord) ([]byte, error) {
+
+	out := make([]interface{}, 0, len(records))
+	for _, r := range records {
+		fields := make([]interface{}, 0, len(r.Fields))
+		for _, f := range r.Fields {
+			if f.IsControl() == true {
+				fields = append(fields, map[string]string{f.Tag: f.Value})
+				continue
+			}
+			subfields := make([]interface{}, 0, len(f.Subfields))
+			for _, s := range f.Subfields {
+				subfields = append(subfields, map[string]string{string(s.Code): s.Value})
+			}
+			fields = append(fields, map[string]interface{}{
+				f.Tag: map[string]interface{}{
+					"ind1":      string(f.Indicator1),
+					"ind2":      string(f.Indicator2),
+					"subfields": subfields,
+				},
+			})
+		}
+		out = append(out, map[string]interface{}{"leader": r.Leader, "fields": fields})
+	}
+
+	return json.MarshalIndent(out, "", "  ")
+}
+
+//
+// end of file
+//
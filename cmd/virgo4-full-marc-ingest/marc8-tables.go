@@ -0,0 +1,104 @@
+package main
+
+// the built in non Latin character sets, from the Library of Congress code tables. The EACC ideographs
+// are too many to build in and must be loaded from the code tables file
+
+// add a range of consecutive codes mapped to consecutive Unicode characters
+func (c *Marc8Converter) addRange(set byte, first uint32, last uint32, r rune, combining bool) {
+	for code := first; code <= last; code++ {
+		c.add(set, code, r+rune(code-first), combining)
+	}
+}
+
+// the ASCII punctuation and digits shared by several of the sets
+func (c *Marc8Converter) addPunctuation(set byte, codes string) {
+	for _, b := range []byte(codes) {
+		c.add(set, uint32(b), rune(b), false)
+	}
+}
+
+func (c *Marc8Converter) addBuiltinScripts() {
+
+	// basic Greek
+	greekCombining := map[uint32]rune{
+		0x21: 0x0300, 0x22: 0x0301, 0x23: 0x0308, 0x24: 0x0342, 0x25: 0x0313, 0x26: 0x0314, 0x27: 0x0345,
+	}
+	for code, r := range greekCombining {
+		c.add(marc8Greek, code, r, true)
+	}
+	greek := map[uint32]rune{
+		0x30: 0x00ab, 0x31: 0x00bb, 0x32: 0x201c, 0x33: 0x201d, 0x34: 0x0374, 0x35: 0x0375, 0x3b: 0x0387,
+		0x3f: 0x037e, 0x41: 0x0391, 0x42: 0x0392, 0x44: 0x0393, 0x45: 0x0394, 0x46: 0x0395, 0x47: 0x03da,
+		0x48: 0x03dc, 0x49: 0x0396, 0x4a: 0x0397, 0x4b: 0x0398, 0x4c: 0x0399, 0x4d: 0x039a, 0x4e: 0x039b,
+		0x4f: 0x039c, 0x50: 0x039d, 0x51: 0x039e, 0x52: 0x039f, 0x53: 0x03a0, 0x54: 0x03de, 0x55: 0x03a1,
+		0x56: 0x03a3, 0x58: 0x03a4, 0x59: 0x03a5, 0x5a: 0x03a6, 0x5b: 0x03a7, 0x5c: 0x03a8, 0x5d: 0x03a9,
+		0x5e: 0x03e0, 0x61: 0x03b1, 0x62: 0x03b2, 0x63: 0x03d0, 0x64: 0x03b3, 0x65: 0x03b4, 0x66: 0x03b5,
+		0x67: 0x03db, 0x68: 0x03dd, 0x69: 0x03b6, 0x6a: 0x03b7, 0x6b: 0x03b8, 0x6c: 0x03b9, 0x6d: 0x03ba,
+		0x6e: 0x03bb, 0x6f: 0x03bc, 0x70: 0x03bd, 0x71: 0x03be, 0x72: 0x03bf, 0x73: 0x03c0, 0x74: 0x03df,
+		0x75: 0x03c1, 0x76: 0x03c3, 0x77: 0x03c2, 0x78: 0x03c4, 0x79: 0x03c5, 0x7a: 0x03c6, 0x7b: 0x03c7,
+		0x7c: 0x03c8, 0x7d: 0x03c9, 0x7e: 0x03e1,
+	}
+	for code, r := range greek {
+		c.add(marc8Greek, code, r, false)
+	}
+	c.addPunctuation(marc8Greek, "(),-./:")
+
+	// basic Cyrillic, the letters are in KOI-8 order
+	c.addPunctuation(marc8BasicCyrillic, "!\"#$%&'()*+,-./0123456789:;<=>?")
+	cyrillic := []rune("юабцдефгхийклмнопярстужвьызшэщчъЮАБЦДЕФГХИЙКЛМНОПЯРСТУЖВЬЫЗШЭЩЧ")
+	for ix, r := range cyrillic {
+		c.add(marc8BasicCyrillic, uint32(0x40+ix), r, false)
+	}
+
+	// extended Cyrillic (G1)
+	extendedCyrillic := map[uint32]rune{
+		0xc0: 0x0491, 0xc1: 0x0452, 0xc2: 0x0453, 0xc3: 0x0454, 0xc4: 0x0451, 0xc5: 0x0455, 0xc6: 0x0456,
+		0xc7: 0x0457, 0xc8: 0x0458, 0xc9: 0x0459, 0xca: 0x045a, 0xcb: 0x045b, 0xcc: 0x045c, 0xcd: 0x045e,
+		0xce: 0x045f, 0xd0: 0x0463, 0xd1: 0x0473, 0xd2: 0x0475, 0xd3: 0x046b, 0xdb: 0x005b, 0xdd: 0x005d,
+		0xdf: 0x005f, 0xe0: 0x0490, 0xe1: 0x0402, 0xe2: 0x0403, 0xe3: 0x0404, 0xe4: 0x0401, 0xe5: 0x0405,
+		0xe6: 0x0406, 0xe7: 0x0407, 0xe8: 0x0408, 0xe9: 0x0409, 0xea: 0x040a, 0xeb: 0x040b, 0xec: 0x040c,
+		0xed: 0x040e, 0xee: 0x040f, 0xef: 0x042a, 0xf0: 0x0462, 0xf1: 0x0472, 0xf2: 0x0474, 0xf3: 0x046a,
+	}
+	for code, r := range extendedCyrillic {
+		c.add(marc8ExtendedCyrillic, code, r, false)
+	}
+
+	// basic Hebrew, the points are combining
+	c.addPunctuation(marc8BasicHebrew, "!\"#$%&'()*+,-./0123456789:;<=>?")
+	hebrewPoints := map[uint32]rune{
+		0x40: 0x05b7, 0x41: 0x05b8, 0x42: 0x05b6, 0x43: 0x05b5, 0x44: 0x05b4, 0x45: 0x05b9, 0x46: 0x05bb,
+		0x47: 0x05b0, 0x48: 0x05b2, 0x49: 0x05b3, 0x4a: 0x05b1, 0x4b: 0x05bc, 0x4c: 0x05bf, 0x4d: 0x05c1,
+		0x4e: 0xfb1e,
+	}
+	for code, r := range hebrewPoints {
+		c.add(marc8BasicHebrew, code, r, true)
+	}
+	c.addRange(marc8BasicHebrew, 0x60, 0x7a, 0x05d0, false)
+	c.addRange(marc8BasicHebrew, 0x7b, 0x7d, 0x05f0, false)
+
+	// basic Arabic, the vowels are combining
+	c.addPunctuation(marc8BasicArabic, "!\"#$&'()+-./:<=>")
+	arabic := map[uint32]rune{
+		0x25: 0x066a, 0x2a: 0x066d, 0x2c: 0x060c, 0x3b: 0x061b, 0x3f: 0x061f, 0x73: 0x0671,
+	}
+	for code, r := range arabic {
+		c.add(marc8BasicArabic, code, r, false)
+	}
+	c.addRange(marc8BasicArabic, 0x30, 0x39, 0x0660, false)
+	c.addRange(marc8BasicArabic, 0x41, 0x5a, 0x0621, false)
+	c.addRange(marc8BasicArabic, 0x60, 0x6a, 0x0640, false)
+	c.addRange(marc8BasicArabic, 0x6b, 0x72, 0x064b, true)
+	c.add(marc8BasicArabic, 0x74, 0x0670, true)
+
+	// extended Arabic (G1), the Persian, Urdu and other additional letters
+	c.add(marc8ExtendedArabic, 0xa1, 0x06fd, false)
+	c.addRange(marc8ExtendedArabic, 0xa2, 0xa3, 0x0672, false)
+	c.addRange(marc8ExtendedArabic, 0xa4, 0xb1, 0x0679, false)
+	c.add(marc8ExtendedArabic, 0xb2, 0x06bf, false)
+	c.addRange(marc8ExtendedArabic, 0xb3, 0xea, 0x0687, false)
+	c.addRange(marc8ExtendedArabic, 0xeb, 0xfe, 0x06c0, false)
+}
+
+//
+// end of file
+//
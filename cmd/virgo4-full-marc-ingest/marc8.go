@@ -0,0 +1,487 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+var ErrMarc8Charset = fmt.Errorf("MARC-8 character set not available")
+var ErrMarc8Unmapped = fmt.Errorf("MARC-8 character has no Unicode mapping")
+var ErrMarc8Escape = fmt.Errorf("bad MARC-8 escape sequence")
+
+//
+// MARC-8 records (leader/09 blank) select character sets with escape sequences; G0 is the 0x21 - 0x7E
+// range and G1 the 0xA1 - 0xFE range, each field starts with ASCII in G0 and ANSEL in G1. Combining
+// marks precede the character they modify, the reverse of Unicode.
+//
+// Every set except the EACC ideographs is built in, EACC is loaded from the Library of Congress code tables
+// (https://www.loc.gov/marc/specifications/codetables.xml) which can also replace the built in sets. A record
+// in a set we do not have would be left unconverted so the converter cannot be created without all of them
+//
+
+// the final character of the escape sequence that designates each character set
+const (
+	marc8Ascii            = byte('B')
+	marc8Ansel            = byte('E')
+	marc8GreekSymbols     = byte('g')
+	marc8Subscript        = byte('b')
+	marc8Superscript      = byte('p')
+	marc8Greek            = byte('S')
+	marc8BasicCyrillic    = byte('N')
+	marc8ExtendedCyrillic = byte('Q')
+	marc8BasicHebrew      = byte('2')
+	marc8BasicArabic      = byte('3')
+	marc8ExtendedArabic   = byte('4')
+	marc8Eacc             = byte('1') // 3 bytes per character
+)
+
+// every MARC-8 character set and its name
+var marc8Charsets = map[byte]string{
+	marc8Ascii:            "ASCII",
+	marc8Ansel:            "ANSEL",
+	marc8GreekSymbols:     "Greek symbols",
+	marc8Subscript:        "subscripts",
+	marc8Superscript:      "superscripts",
+	marc8Greek:            "Greek",
+	marc8BasicCyrillic:    "basic Cyrillic",
+	marc8ExtendedCyrillic: "extended Cyrillic",
+	marc8BasicHebrew:      "Hebrew",
+	marc8BasicArabic:      "basic Arabic",
+	marc8ExtendedArabic:   "extended Arabic",
+	marc8Eacc:             "EACC",
+}
+
+// the MARC-8 escape character and the intermediate characters of the designation sequences
+const (
+	marc8Escape       = byte(0x1b)
+	marc8Multibyte    = byte('$')
+	marc8G0           = byte('(')
+	marc8G0Alternate  = byte(',')
+	marc8G1           = byte(')')
+	marc8G1Alternate  = byte('-')
+	marc8Intermediate = byte('!')
+	marc8AsciiReset   = byte('s')
+)
+
+// the Unicode character for a MARC-8 code
+type marc8Char struct {
+	r         rune
+	combining bool
+}
+
+// Marc8Converter - converts MARC-8 records to UTF-8
+type Marc8Converter struct {
+	sets map[byte]map[uint32]marc8Char // by character set, then by code (high bits stripped)
+}
+
+// NewMarc8Converter - create a converter with the built in character sets and those in the LC code
+// tables file (required for EACC). Fails if any character set is missing
+func NewMarc8Converter(codeTables string) (*Marc8Converter, error) {
+
+	c := &Marc8Converter{sets: make(map[byte]map[uint32]marc8Char)}
+	c.addBuiltinSets()
+
+	if codeTables != "" {
+		err := c.loadCodeTables(codeTables)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	missing := make([]string, 0)
+	for set, name := range marc8Charsets {
+		if len(c.sets[set]) == 0 {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) != 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("%w: %s (load them from the LC code tables)", ErrMarc8Charset, strings.Join(missing, ", "))
+	}
+	return c, nil
+}
+
+// Charsets - the available character sets
+func (c *Marc8Converter) Charsets() []string {
+	sets := make([]string, 0, len(c.sets))
+	for set, codes := range c.sets {
+		sets = append(sets, fmt.Sprintf("%c(%d)", set, len(codes)))
+	}
+	sort.Strings(sets)
+	return sets
+}
+
+func (c *Marc8Converter) add(set byte, code uint32, r rune, combining bool) {
+	if c.sets[set] == nil {
+		c.sets[set] = make(map[uint32]marc8Char)
+	}
+	c.sets[set][code&0x7f7f7f] = marc8Char{r: r, combining: combining}
+}
+
+func (c *Marc8Converter) addBuiltinSets() {
+
+	for b := uint32(0x21); b <= 0x7e; b++ {
+		c.add(marc8Ascii, b, rune(b), false)
+	}
+
+	ansel := map[uint32]rune{
+		0xa1: 0x0141, 0xa2: 0x00d8, 0xa3: 0x0110, 0xa4: 0x00de, 0xa5: 0x00c6, 0xa6: 0x0152, 0xa7: 0x02b9,
+		0xa8: 0x00b7, 0xa9: 0x266d, 0xaa: 0x00ae, 0xab: 0x00b1, 0xac: 0x01a0, 0xad: 0x01af, 0xae: 0x02bc,
+		0xb0: 0x02bb, 0xb1: 0x0142, 0xb2: 0x00f8, 0xb3: 0x0111, 0xb4: 0x00fe, 0xb5: 0x00e6, 0xb6: 0x0153,
+		0xb7: 0x02ba, 0xb8: 0x0131, 0xb9: 0x00a3, 0xba: 0x00f0, 0xbc: 0x01a1, 0xbd: 0x01b0, 0xc0: 0x00b0,
+		0xc1: 0x2113, 0xc2: 0x2117, 0xc3: 0x00a9, 0xc4: 0x266f, 0xc5: 0x00bf, 0xc6: 0x00a1, 0xc7: 0x00df,
+		0xc8: 0x20ac,
+	}
+	for code, r := range ansel {
+		c.add(marc8Ansel, code, r, false)
+	}
+	anselCombining := map[uint32]rune{
+		0xe0: 0x0309, 0xe1: 0x0300, 0xe2: 0x0301, 0xe3: 0x0302, 0xe4: 0x0303, 0xe5: 0x0304, 0xe6: 0x0306,
+		0xe7: 0x0307, 0xe8: 0x0308, 0xe9: 0x030c, 0xea: 0x030a, 0xeb: 0xfe20, 0xec: 0xfe21, 0xed: 0x0315,
+		0xee: 0x030b, 0xef: 0x0310, 0xf0: 0x0327, 0xf1: 0x0328, 0xf2: 0x0323, 0xf3: 0x0324, 0xf4: 0x0325,
+		0xf5: 0x0333, 0xf6: 0x0332, 0xf7: 0x0326, 0xf8: 0x031c, 0xf9: 0x032e, 0xfa: 0xfe22, 0xfb: 0xfe23,
+		0xfe: 0x0313,
+	}
+	for code, r := range anselCombining {
+		c.add(marc8Ansel, code, r, true)
+	}
+
+	c.add(marc8GreekSymbols, 0x61, 0x03b1, false)
+	c.add(marc8GreekSymbols, 0x62, 0x03b2, false)
+	c.add(marc8GreekSymbols, 0x63, 0x03b3, false)
+
+	for b := uint32(0x30); b <= 0x39; b++ {
+		c.add(marc8Subscript, b, rune(0x2080+b-0x30), false)
+	}
+	c.add(marc8Subscript, 0x28, 0x208d, false)
+	c.add(marc8Subscript, 0x29, 0x208e, false)
+	c.add(marc8Subscript, 0x2b, 0x208a, false)
+	c.add(marc8Subscript, 0x2d, 0x208b, false)
+
+	for b := uint32(0x34); b <= 0x39; b++ {
+		c.add(marc8Superscript, b, rune(0x2074+b-0x34), false)
+	}
+	c.add(marc8Superscript, 0x30, 0x2070, false)
+	c.add(marc8Superscript, 0x31, 0x00b9, false)
+	c.add(marc8Superscript, 0x32, 0x00b2, false)
+	c.add(marc8Superscript, 0x33, 0x00b3, false)
+	c.add(marc8Superscript, 0x28, 0x207d, false)
+	c.add(marc8Superscript, 0x29, 0x207e, false)
+	c.add(marc8Superscript, 0x2b, 0x207a, false)
+	c.add(marc8Superscript, 0x2d, 0x207b, false)
+
+	c.addBuiltinScripts()
+}
+
+// the LC code tables layout
+type lcCodeTables struct {
+	Tables []struct {
+		Sets []lcCharacterSet `xml:"characterSet"`
+	} `xml:"codeTable"`
+}
+
+type lcCharacterSet struct {
+	Name    string   `xml:"name,attr"`
+	IsoCode string   `xml:"ISOcode,attr"`
+	Codes   []lcCode `xml:"code"`
+}
+
+type lcCode struct {
+	Marc      string `xml:"marc"`
+	Ucs       string `xml:"ucs"`
+	Alt       string `xml:"alt"`
+	Combining string `xml:"isCombining"`
+}
+
+// load the character sets from the LC code tables, they replace the built in ones
+func (c *Marc8Converter) loadCodeTables(name string) error {
+
+	buf, err := os.ReadFile(name)
+	if err != nil {
+		return err
+	}
+
+	tables := lcCodeTables{}
+	err = xml.Unmarshal(buf, &tables)
+	if err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	for _, table := range tables.Tables {
+		for _, set := range table.Sets {
+			final, err := strconv.ParseUint(set.IsoCode, 16, 8)
+			if err != nil {
+				return fmt.Errorf("%s: character set %s code invalid (%s)", name, set.Name, set.IsoCode)
+			}
+			for _, code := range set.Codes {
+				marc, err := hex.DecodeString(strings.TrimSpace(code.Marc))
+				if err != nil || len(marc) == 0 || len(marc) > 3 {
+					return fmt.Errorf("%s: %s code invalid (%s)", name, set.Name, code.Marc)
+				}
+				ucs := strings.TrimSpace(code.Ucs)
+				if ucs == "" {
+					ucs = strings.TrimSpace(code.Alt)
+				}
+				r, err := strconv.ParseUint(ucs, 16, 32)
+				if err != nil {
+					return fmt.Errorf("%s: %s code %s mapping invalid (%s)", name, set.Name, code.Marc, ucs)
+				}
+				value := uint32(0)
+				for _, b := range marc {
+					value = value<<8 | uint32(b)
+				}
+				c.add(byte(final), value, rune(r), strings.TrimSpace(code.Combining) == "true")
+			}
+		}
+	}
+	return nil
+}
+
+// the conversion state of a single field
+type marc8Decoder struct {
+	c  *Marc8Converter
+	g0 byte
+	g1 byte
+}
+
+func (c *Marc8Converter) newDecoder() *marc8Decoder {
+	return &marc8Decoder{c: c, g0: marc8Ascii, g1: marc8Ansel}
+}
+
+// decode a value, the character sets in use carry over to the next value in the field
+func (d *marc8Decoder) decode(in string) (string, error) {
+
+	var out strings.Builder
+	combining := make([]rune, 0)
+	flush := func() {
+		for _, r := range combining {
+			out.WriteRune(r)
+		}
+		combining = combining[:0]
+	}
+
+	for i := 0; i < len(in); {
+		b := in[i]
+
+		if b == marc8Escape {
+			n, err := d.escape(in[i:])
+			if err != nil {
+				return "", err
+			}
+			i += n
+			continue
+		}
+
+		switch {
+		case b == 0x20 || b < 0x20:
+			out.WriteByte(b)
+			flush()
+			i++
+			continue
+		case b == 0x88 || b == 0x89:
+			// non sorting markers, no longer used
+			i++
+			continue
+		case b == 0x8d:
+			out.WriteRune(0x200d)
+			i++
+			continue
+		case b == 0x8e:
+			out.WriteRune(0x200c)
+			i++
+			continue
+		}
+
+		set := d.g0
+		if b >= 0xa1 && b <= 0xfe {
+			set = d.g1
+		} else if b < 0x21 || b > 0x7e {
+			return "", fmt.Errorf("%w (0x%02x)", ErrMarc8Unmapped, b)
+		}
+
+		width := 1
+		if set == marc8Eacc {
+			width = 3
+		}
+		if i+width > len(in) {
+			return "", fmt.Errorf("%w (truncated character)", ErrMarc8Unmapped)
+		}
+		code := uint32(0)
+		for _, cb := range []byte(in[i : i+width]) {
+			code = code<<8 | uint32(cb&0x7f)
+		}
+		i += width
+
+		codes, ok := d.c.sets[set]
+		if ok == false {
+			return "", fmt.Errorf("%w (%c)", ErrMarc8Charset, set)
+		}
+		ch, ok := codes[code]
+		if ok == false {
+			return "", fmt.Errorf("%w (set %c, code 0x%x)", ErrMarc8Unmapped, set, code)
+		}
+
+		if ch.combining == true {
+			combining = append(combining, ch.r)
+			continue
+		}
+		out.WriteRune(ch.r)
+		flush()
+	}
+
+	// combining marks at the end have nothing to modify, keep them anyway
+	flush()
+	return norm.NFC.String(out.String()), nil
+}
+
+// process an escape sequence, returns its length
+func (d *marc8Decoder) escape(in string) (int, error) {
+
+	if len(in) < 2 {
+		return 0, ErrMarc8Escape
+	}
+
+	// the technique 1 sets and the return to ASCII
+	switch in[1] {
+	case marc8GreekSymbols, marc8Subscript, marc8Superscript:
+		d.g0 = in[1]
+		return 2, nil
+	case marc8AsciiReset:
+		d.g0 = marc8Ascii
+		return 2, nil
+	}
+
+	ix := 1
+	if in[ix] == marc8Multibyte {
+		ix++
+	}
+	target := &d.g0
+	if ix < len(in) {
+		switch in[ix] {
+		case marc8G0, marc8G0Alternate:
+			ix++
+		case marc8G1, marc8G1Alternate:
+			target = &d.g1
+			ix++
+		default:
+			// ESC $ F designates a multibyte set to G0
+			if ix == 1 {
+				return 0, ErrMarc8Escape
+			}
+		}
+	}
+	if ix < len(in) && in[ix] == marc8Intermediate {
+		ix++
+	}
+	if ix >= len(in) {
+		return 0, ErrMarc8Escape
+	}
+	*target = in[ix]
+	return ix + 1, nil
+}
+
+// convert a parsed MARC-8 record to UTF-8
+func (c *Marc8Converter) convertMarcRecord(record *MarcRecord) error {
+
+	for ix := range record.Fields {
+		f := &record.Fields[ix]
+		d := c.newDecoder()
+		if f.IsControl() == true {
+			value, err := d.decode(f.Value)
+			if err != nil {
+				return fmt.Errorf("field %s: %w", f.Tag, err)
+			}
+			f.Value = value
+			continue
+		}
+		for s := range f.Subfields {
+			value, err := d.decode(f.Subfields[s].Value)
+			if err != nil {
+				return fmt.Errorf("field %s$%c: %w", f.Tag, f.Subfields[s].Code, err)
+			}
+			f.Subfields[s].Value = value
+		}
+	}
+
+	leader := []byte(record.Leader)
+	leader[9] = 'a'
+	record.Leader = string(leader)
+	return nil
+}
+
+// Convert - convert a record to UTF-8 if it (or any record merged into it) is MARC-8 encoded, returns true
+// if it was converted. Records that cannot be converted are left unchanged
+func (c *Marc8Converter) Convert(record Record) (bool, error) {
+
+	if isMarc8(record.Raw()) == false {
+		return false, nil
+	}
+
+	parsed, err := parseMarcRecords(record.Raw())
+	if err != nil {
+		return false, err
+	}
+
+	// records sharing an id are merged, each is converted
+	raw := make([]byte, 0, len(record.Raw()))
+	for _, m := range parsed {
+		if m.Leader[9] == ' ' {
+			err = c.convertMarcRecord(m)
+			if err != nil {
+				return false, err
+			}
+		}
+		buf, err := m.Bytes()
+		if err != nil {
+			return false, err
+		}
+		raw = append(raw, buf...)
+	}
+
+	record.SetRaw(raw)
+	return true, nil
+}
+
+// is any of the (merged) records MARC-8 encoded
+func isMarc8(raw []byte) bool {
+	for len(raw) > 9 {
+		if raw[9] == ' ' {
+			return true
+		}
+		raw = nextMarcRecord(raw)
+	}
+	return false
+}
+
+// does any of the (merged) records claim to be Unicode but contain invalid UTF-8
+func invalidUtf8(raw []byte) bool {
+	for len(raw) > 9 {
+		length := len(raw) - len(nextMarcRecord(raw))
+		if raw[9] == 'a' && utf8.Valid(raw[:length]) == false {
+			return true
+		}
+		raw = raw[length:]
+	}
+	return false
+}
+
+// the records following the first, nothing if its length is bad
+func nextMarcRecord(raw []byte) []byte {
+	length, err := strconv.Atoi(string(raw[0:5]))
+	if err != nil || length <= 0 || length > len(raw) {
+		return nil
+	}
+	return raw[length:]
+}
+
+//
+// end of file
+//
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// a minimal LC code tables file with the EACC set (and a replacement ANSEL character)
+var testCodeTables = `<?xml version="1.0" encoding="UTF-8"?>
+<codeTables>
+  <codeTable name="East Asian ideographs">
+    <characterSet name="East Asian Character Code" ISOcode="31">
+      <code><marc>213021</marc><ucs>4E00</ucs></code>
+      <code><marc>213022</marc><ucs>4E01</ucs></code>
+      <code><marc>213023</marc><ucs></ucs><alt>4E03</alt></code>
+    </characterSet>
+  </codeTable>
+</codeTables>
+`
+
+// a converter with every character set
+func testMarc8Converter(t *testing.T) *Marc8Converter {
+	t.Helper()
+	name := filepath.Join(t.TempDir(), "codetables.xml")
+	if err := os.WriteFile(name, []byte(testCodeTables), 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err := NewMarc8Converter(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestNewMarc8Converter(t *testing.T) {
+
+	_, err := NewMarc8Converter("")
+	if errors.Is(err, ErrMarc8Charset) == false || strings.Contains(err.Error(), "EACC") == false {
+		t.Errorf("got %v, expected the EACC set to be missing", err)
+	}
+
+	_, err = NewMarc8Converter(filepath.Join(t.TempDir(), "missing.xml"))
+	if err == nil {
+		t.Errorf("expected an error for a missing code tables file")
+	}
+
+	c := testMarc8Converter(t)
+	for set, name := range marc8Charsets {
+		if len(c.sets[set]) == 0 {
+			t.Errorf("character set %s (%c) is empty", name, set)
+		}
+	}
+}
+
+func TestMarc8Decode(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		in       string
+		expected string
+	}{
+		{"ASCII", "A title, 2nd ed.", "A title, 2nd ed."},
+		{"ANSEL spacing", "\xa1\xe2od\xa5", "\u0141\u00f3d\u00c6"},
+		{"combining mark precedes", "Caf\xe2e", "Caf\u00e9"},
+		{"combining marks compose", "\xe8u\xe1e", "\u00fc\u00e8"},
+		{"two combining marks", "\xe2\xe3a", "\u00e1\u0302"},
+		{"combining mark at the end", "a\xe2", "\u00e1"},
+		{"combining mark before a space", "\xe2 a", " \u0301a"},
+		{"double diacritic", "\xebt\xecs", "t\ufe20s\ufe21"},
+		{"greek symbols", "\x1bgabc\x1bs", "αβγ"},
+		{"subscript", "H\x1bb2\x1bsO", "H₂O"},
+		{"superscript", "x\x1bp2\x1bs", "x²"},
+		{"basic Greek", "\x1b(SABD\x1b(B.", "ΑΒΓ."},
+		{"Greek accent", "\x1b(S\"a\x1b(B", "ά"},
+		{"basic Cyrillic", "\x1b(NRUS\x1b(B", "рус"},
+		{"Cyrillic capitals", "\x1b(Nmoskwa", "МОСКВА"},
+		{"Cyrillic with ANSEL combining", "\x1b(NI\xe6\x1b(B", "й"},
+		{"extended Cyrillic", "\x1b)Q\xe4\xc6", "Ёі"},
+		{"Hebrew", "\x1b(2`ab\x1b(B", "אבג"},
+		{"Hebrew point", "\x1b(2A`\x1b(B", "אָ"},
+		{"basic Arabic", "\x1b(3HG\x1b(B", "با"},
+		{"Arabic digits", "\x1b(312\x1b(B", "١٢"},
+		{"extended Arabic", "\x1b)4\xa9\xd5", "پک"},
+		{"EACC", "\x1b$1!0!!0\"\x1b(B ok", "一丁 ok"},
+		{"EACC alternate mapping", "\x1b$1!0#", "七"},
+		{"EACC to G0 with explicit intermediate", "\x1b$(1!0!", "一"},
+		{"alternate G0 intermediate", "\x1b,NR", "р"},
+		{"non sorting markers", "\x88The\x89 title", "The title"},
+		{"joiners", "a\x8db\x8ec", "a‍b‌c"},
+	}
+
+	c := testMarc8Converter(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := c.newDecoder().decode(test.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.expected {
+				t.Errorf("got %q, expected %q", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestMarc8DecodeErrors(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		in       string
+		expected error
+	}{
+		{"unmapped ANSEL", "\xaf", ErrMarc8Unmapped},
+		{"unmapped control", "\x80", ErrMarc8Unmapped},
+		{"unmapped Greek", "\x1b(S@", ErrMarc8Unmapped},
+		{"truncated EACC", "\x1b$1!0", ErrMarc8Unmapped},
+		{"unknown set", "\x1b(Za", ErrMarc8Charset},
+		{"escape at the end", "a\x1b", ErrMarc8Escape},
+		{"incomplete escape", "\x1b(", ErrMarc8Escape},
+		{"unmapped EACC", "\x1b$1!0z", ErrMarc8Unmapped},
+	}
+
+	c := testMarc8Converter(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := c.newDecoder().decode(test.in)
+			if errors.Is(err, test.expected) == false {
+				t.Errorf("got %v, expected %v", err, test.expected)
+			}
+		})
+	}
+}
+
+func TestMarc8Convert(t *testing.T) {
+
+	unicode := testMarcRecord('a', "001 u1", "245 00‡aCafé")
+	marc8 := testMarcRecord(' ', "001 u1", "245 00‡aCaf\xe2e")
+	tests := []struct {
+		name      string
+		raw       []byte
+		converted bool
+		expected  []byte
+		err       bool
+	}{
+		{"already Unicode", unicode, false, unicode, false},
+		{"MARC-8", marc8, true, unicode, false},
+		{
+			"set carries over between subfields",
+			testMarcRecord(' ', "001 u2", "245 00‡a\x1b(NRUS‡bSKIJ", "246 00‡aABC"),
+			true,
+			testMarcRecord('a', "001 u2", "245 00‡aрус‡bский", "246 00‡aABC"),
+			false,
+		},
+		{"merged, MARC-8 second", append(append([]byte{}, unicode...), marc8...), true, append(append([]byte{}, unicode...), unicode...), false},
+		{"merged, MARC-8 first", append(append([]byte{}, marc8...), unicode...), true, append(append([]byte{}, unicode...), unicode...), false},
+		{"unmapped character", testMarcRecord(' ', "001 u3", "245 00‡a\xaf"), false, testMarcRecord(' ', "001 u3", "245 00‡a\xaf"), true},
+	}
+
+	c := testMarc8Converter(t)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := testRecord(append([]byte{}, test.raw...))
+			converted, err := c.Convert(rec)
+			if test.err == true {
+				if err == nil {
+					t.Errorf("expected an error")
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if converted != test.converted {
+				t.Errorf("got converted %t, expected %t", converted, test.converted)
+			}
+			if bytes.Equal(rec.Raw(), test.expected) == false {
+				t.Errorf("got %q, expected %q", rec.Raw(), test.expected)
+			}
+		})
+	}
+}
+
+func TestMarc8Encoding(t *testing.T) {
+
+	unicode := testMarcRecord('a', "001 u1", "245 00‡aCafé")
+	marc8 := testMarcRecord(' ', "001 u1", "245 00‡aCaf\xe2e")
+	invalid := testMarcRecord('a', "001 u1", "245 00‡aCaf\xe9")
+
+	tests := []struct {
+		name    string
+		raw     []byte
+		marc8   bool
+		invalid bool
+	}{
+		{"Unicode", unicode, false, false},
+		{"MARC-8", marc8, true, false},
+		{"invalid UTF-8", invalid, false, true},
+		{"merged, MARC-8 second", append(append([]byte{}, unicode...), marc8...), true, false},
+		{"merged, invalid UTF-8 second", append(append([]byte{}, unicode...), invalid...), false, true},
+		{"merged, MARC-8 then Unicode", append(append([]byte{}, marc8...), unicode...), true, false},
+		{"too short", []byte("00005"), false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isMarc8(test.raw); got != test.marc8 {
+				t.Errorf("isMarc8 got %t, expected %t", got, test.marc8)
+			}
+			if got := invalidUtf8(test.raw); got != test.invalid {
+				t.Errorf("invalidUtf8 got %t, expected %t", got, test.invalid)
+			}
+		})
+	}
+}
+
+//
+// end of file
+//
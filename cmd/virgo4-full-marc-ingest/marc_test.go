@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// the leader of the test records, the length and base address are filled in
+var testLeader = "00000nam a2200000 a 4500"
+
+// build a raw MARC record by hand so the tests do not depend on MarcRecord.Bytes. Each field is the tag, a space
+// and its data, data fields use ‡ for the subfield delimiter. Leader/09 is the encoding
+func testMarcRecord(encoding byte, fields ...string) []byte {
+
+	var directory, data bytes.Buffer
+	for _, f := range fields {
+		value := f[4:]
+		if strings.HasPrefix(f, "00") == false {
+			value = strings.ReplaceAll(value, "‡", string(subfieldDelimiter))
+		}
+		directory.WriteString(fmt.Sprintf("%s%04d%05d", f[0:3], len(value)+1, data.Len()))
+		data.WriteString(value)
+		data.WriteByte(fieldTerminator)
+	}
+	directory.WriteByte(fieldTerminator)
+
+	base := marcLeaderSize + directory.Len()
+	leader := []byte(testLeader)
+	copy(leader[0:5], fmt.Sprintf("%05d", base+data.Len()+1))
+	copy(leader[12:17], fmt.Sprintf("%05d", base))
+	leader[9] = encoding
+
+	raw := append(leader, directory.Bytes()...)
+	raw = append(raw, data.Bytes()...)
+	return append(raw, recordTerminator)
+}
+
+// a record as the loader would return it
+func testRecord(raw []byte) Record {
+	return &recordImpl{RawBytes: raw, source: "test"}
+}
+
+func TestMarcRoundTrip(t *testing.T) {
+
+	tests := []struct {
+		name string
+		raw  []byte
+	}{
+		{"control fields only", testMarcRecord('a', "001 u1", "008 850101s1985    xx            000 0 eng d")},
+		{"data fields", testMarcRecord('a', "001 u2", "245 10‡aA title :‡bsubtitle /‡cby someone.", "650  0‡aSubject‡xSubdivision.")},
+		{"empty subfield value", testMarcRecord('a', "001 u3", "500   ‡a")},
+		{"multibyte UTF-8", testMarcRecord('a', "001 u4", "245 00‡aΚαλημέρα κόσμε")},
+		{"MARC-8 bytes", testMarcRecord(' ', "001 u5", "245 00‡aCaf\xe2e")},
+		{"no fields", testMarcRecord('a')},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			record, err := parseMarcRecord(test.raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := record.Bytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(got, test.raw) == false {
+				t.Errorf("got %q, expected %q", got, test.raw)
+			}
+		})
+	}
+}
+
+func TestMarcBytesRecomputesDirectory(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		raw      []byte
+		change   func(r *MarcRecord)
+		expected []byte
+	}{
+		{
+			"longer control field",
+			testMarcRecord('a', "001 u1", "245 00‡aTitle"),
+			func(r *MarcRecord) { r.Fields[0].Value = "u123456" },
+			testMarcRecord('a', "001 u123456", "245 00‡aTitle"),
+		},
+		{
+			"shorter subfield",
+			testMarcRecord('a', "001 u1", "245 00‡aA much longer title", "500   ‡aNote"),
+			func(r *MarcRecord) { r.Fields[1].Subfields[0].Value = "Short" },
+			testMarcRecord('a', "001 u1", "245 00‡aShort", "500   ‡aNote"),
+		},
+		{
+			"field added",
+			testMarcRecord('a', "001 u1", "245 00‡aTitle"),
+			func(r *MarcRecord) {
+				r.Fields = append(r.Fields, MarcField{Tag: "949", Indicator1: ' ', Indicator2: ' ', Subfields: []MarcSubfield{{Code: 'a', Value: "sirsi"}}})
+			},
+			testMarcRecord('a', "001 u1", "245 00‡aTitle", "949   ‡asirsi"),
+		},
+		{
+			"field removed",
+			testMarcRecord('a', "001 u1", "245 00‡aTitle", "856 40‡uhttp://example.com"),
+			func(r *MarcRecord) { r.Fields = r.Fields[:1] },
+			testMarcRecord('a', "001 u1"),
+		},
+		{
+			"leader changed",
+			testMarcRecord(' ', "001 u1"),
+			func(r *MarcRecord) { r.Leader = r.Leader[:9] + "a" + r.Leader[10:] },
+			testMarcRecord('a', "001 u1"),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			record, err := parseMarcRecord(test.raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.change(record)
+			got, err := record.Bytes()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(got, test.expected) == false {
+				t.Errorf("got %q, expected %q", got, test.expected)
+			}
+			if _, err = parseMarcRecord(got); err != nil {
+				t.Errorf("serialized record does not parse (%s)", err.Error())
+			}
+		})
+	}
+}
+
+func TestParseMarcRecords(t *testing.T) {
+
+	first := testMarcRecord('a', "001 u1", "245 00‡aFirst")
+	second := testMarcRecord(' ', "001 u1", "245 00‡aSecond")
+	tests := []struct {
+		name    string
+		raw     []byte
+		records int
+		err     bool
+	}{
+		{"single", first, 1, false},
+		{"merged", append(append([]byte{}, first...), second...), 2, false},
+		{"trailing data", append(append([]byte{}, first...), '0', '0'), 0, true},
+		{"truncated", append(append([]byte{}, first...), second[:30]...), 0, true},
+		{"bad length", append([]byte("x"), first[1:]...), 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			records, err := parseMarcRecords(test.raw)
+			if test.err == true {
+				if err == nil {
+					t.Errorf("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != test.records {
+				t.Errorf("got %d records, expected %d", len(records), test.records)
+			}
+		})
+	}
+}
+
+func TestParseMarcRecordErrors(t *testing.T) {
+
+	good := testMarcRecord('a', "001 u1", "245 00‡aTitle")
+	corrupt := func(ix int, b byte) []byte {
+		raw := append([]byte{}, good...)
+		raw[ix] = b
+		return raw
+	}
+
+	tests := []struct {
+		name string
+		raw  []byte
+	}{
+		{"shorter than the leader", good[:20]},
+		{"length mismatch", good[:len(good)-1]},
+		{"bad base address", corrupt(12, 'x')},
+		{"directory not terminated", corrupt(marcLeaderSize+2*marcRecordFieldDirEntrySize, ' ')},
+		{"bad field length", corrupt(marcLeaderSize+3, 'x')},
+		{"field not terminated", corrupt(len(good)-2, ' ')},
+		{"data before the first subfield", testMarcRecord('a', "245 00x‡aTitle")},
+		{"no indicators", testMarcRecord('a', "245 0")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseMarcRecord(test.raw)
+			if err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
+
+func TestIsCommand(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		expected bool
+	}{
+		{"validate", true},
+		{"stats", true},
+		{"get", true},
+		{"split", true},
+		{"help", true},
+		{"", false},
+		{"-config", false},
+		{"--help", false},
+		{"serve", false},
+		{"Validate", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isCommand(test.name); got != test.expected {
+				t.Errorf("got %t, expected %t", got, test.expected)
+			}
+		})
+	}
+}
+
+//
+// end of file
+//
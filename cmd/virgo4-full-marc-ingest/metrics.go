@@ -0,0 +1,176 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// the namespace for all our metrics
+var metricsNamespace = "virgo4_full_marc_ingest"
+
+// all the phases, used so the current phase gauge always exposes every phase
+var allRunPhases = []RunPhase{PhaseDownload, PhaseValidate, PhaseStopServices, PhaseIdleWait, PhaseIngest, PhaseDrain, PhaseDeletes, PhaseRestart}
+
+var (
+	metricRecordsRead = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "records_read_total",
+		Help:      "Records read from the inbound files",
+	}, []string{"data_source"})
+
+	metricBytesRead = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "bytes_read_total",
+		Help:      "Record bytes read from the inbound files",
+	}, []string{"data_source"})
+
+	metricRecordsSent = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "records_sent_total",
+		Help:      "Records sent to the outbound queues",
+	}, []string{"data_source"})
+
+	metricRecordsFailed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "records_failed_total",
+		Help:      "Records that could not be sent to the outbound queues",
+	}, []string{"data_source"})
+
+	metricBatchPutDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "batch_put_duration_seconds",
+		Help:      "The time taken to put a batch of messages, including retries",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 12),
+	}, []string{"queue"})
+
+	metricBatchPutRetries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "batch_put_retries_total",
+		Help:      "Messages retried after a partially successful batch put",
+	}, []string{"queue"})
+
+	metricBatchBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "batch_bytes",
+		Help:      "The size of each outbound batch put",
+		Buckets:   prometheus.ExponentialBuckets(4096, 2, 8),
+	}, []string{"queue"})
+
+	metricMessagesOversize = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "messages_oversize_total",
+		Help:      "Outbound messages too large for SQS that overflow to the message bucket",
+	}, []string{"queue"})
+
+	metricRecordsFiltered = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "records_filtered_total",
+		Help:      "Records excluded by a filter rule",
+	}, []string{"rule"})
+
+	metricRecordsTransformed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "records_transformed_total",
+		Help:      "Records changed by the transform pipeline",
+	}, []string{"data_source"})
+
+	metricTransformFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "transform_failures_total",
+		Help:      "Records the transform pipeline could not change, they are sent as they are",
+	}, []string{"data_source"})
+
+	metricRecordsConverted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "records_converted_total",
+		Help:      "MARC-8 records converted to UTF-8",
+	}, []string{"data_source"})
+
+	metricConversionFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "conversion_failures_total",
+		Help:      "MARC-8 records that could not be converted to UTF-8, they are sent as they are",
+	}, []string{"data_source"})
+
+	metricRecordsInvalidUtf8 = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "records_invalid_utf8_total",
+		Help:      "Records that claim to be Unicode but contain invalid UTF-8",
+	}, []string{"data_source"})
+
+	metricRecordsSpilled = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "records_spilled_total",
+		Help:      "Records that could not be sent and were written to the spill file",
+	})
+
+	metricThrottleWait = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "throttle_wait_seconds_total",
+		Help:      "Time the workers spent waiting for the outbound rate limit",
+	})
+
+	metricBackpressure = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "backpressure_engaged",
+		Help:      "1 while the reader is held because the outbound queues are backed up",
+	})
+
+	metricRunPhase = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "run_phase",
+		Help:      "The current run phase (1 for the current phase, 0 otherwise)",
+	}, []string{"phase"})
+
+	metricIdleWaitDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "idle_wait_duration_seconds",
+		Help:      "The time spent waiting for the work queues to become idle",
+		Buckets:   prometheus.ExponentialBuckets(10, 2, 12),
+	}, []string{"result"})
+
+	metricQueueDepth = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "queue_depth",
+		Help:      "The number of messages available in a queue when last polled",
+	}, []string{"queue"})
+
+	metricRecordsDeleted = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "records_deleted_total",
+		Help:      "Old records deleted after ingest",
+	}, []string{"target"})
+
+	metricDeleteDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "delete_duration_seconds",
+		Help:      "The time taken to delete old records after ingest",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 14),
+	}, []string{"target"})
+)
+
+// expose the depth of the records channel
+func registerRecordsChannelMetric(records chan Record) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "records_channel_depth",
+		Help:      "The number of records waiting for a worker",
+	}, func() float64 {
+		return float64(len(records))
+	})
+}
+
+// note the current run phase, blank when there is no active run
+func setRunPhaseMetric(current RunPhase) {
+	for _, phase := range allRunPhases {
+		if phase == current {
+			metricRunPhase.WithLabelValues(string(phase)).Set(1)
+		} else {
+			metricRunPhase.WithLabelValues(string(phase)).Set(0)
+		}
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// the notification events
+const (
+	NotifyStart   = "start"
+	NotifySuccess = "success"
+	NotifyFailure = "failure"
+	NotifyWarning = "warning"
+)
+
+// the timeout for sending a single notification
+var notifyTimeout = 10 * time.Second
+
+// Notifier - a destination for run notifications
+type Notifier interface {
+	Name() string
+	Notify(event string, subject string, summary *RunSummary) error
+}
+
+// RunNotification - the body posted to generic webhooks
+type RunNotification struct {
+	Event   string      `json:"event"`
+	Subject string      `json:"subject"`
+	Message string      `json:"message"`
+	Summary *RunSummary `json:"summary"`
+}
+
+// the configured notifiers and the events they are sent
+var notifiers = make([]Notifier, 0)
+var notifyEvents = make(map[string]bool)
+
+// create the notifiers from the configuration
+func initNotifiers(cfg *ServiceConfig) {
+
+	httpClient := &http.Client{Timeout: notifyTimeout}
+	for _, url := range cfg.NotifyWebhooks {
+		notifiers = append(notifiers, &webhookNotifier{url: url, httpClient: httpClient})
+	}
+	if cfg.NotifySlackWebhook != "" {
+		notifiers = append(notifiers, &slackNotifier{url: cfg.NotifySlackWebhook, httpClient: httpClient})
+	}
+	if cfg.SmtpHost != "" {
+		notifiers = append(notifiers, &smtpNotifier{cfg: cfg})
+	}
+
+	for _, event := range cfg.NotifyEvents {
+		notifyEvents[event] = true
+	}
+}
+
+// send a run notification to everything configured. Failures are logged but are never fatal
+func notifyRun(event string, summary *RunSummary, detail string) {
+
+	if len(notifiers) == 0 || notifyEvents[event] == false {
+		return
+	}
+
+	subject := fmt.Sprintf("full MARC ingest (%s): run %s %s", summary.DataSource, summary.RunId, event)
+	if summary.DryRun == true {
+		subject += " (DRY RUN)"
+	}
+	if detail != "" {
+		subject += ": " + detail
+	}
+
+	for _, n := range notifiers {
+		err := n.Notify(event, subject, summary)
+		if err != nil {
+			log.Printf("WARNING: %s notification failed (%s)", n.Name(), err.Error())
+		}
+	}
+}
+
+// the message body, the same summary we log
+func notificationMessage(summary *RunSummary) string {
+	return strings.Join(summary.Lines(), "\n")
+}
+
+// generic webhooks get the event and the complete run summary as JSON
+type webhookNotifier struct {
+	url        string
+	httpClient *http.Client
+}
+
+func (n *webhookNotifier) Name() string {
+	return "webhook"
+}
+
+func (n *webhookNotifier) Notify(event string, subject string, summary *RunSummary) error {
+	return postJson(n.httpClient, n.url, RunNotification{Event: event, Subject: subject, Message: notificationMessage(summary), Summary: summary})
+}
+
+// Slack compatible incoming webhooks get the summary as text
+type slackNotifier struct {
+	url        string
+	httpClient *http.Client
+}
+
+func (n *slackNotifier) Name() string {
+	return "slack"
+}
+
+func (n *slackNotifier) Notify(event string, subject string, summary *RunSummary) error {
+	text := fmt.Sprintf("*%s*\n```\n%s\n```", subject, notificationMessage(summary))
+	return postJson(n.httpClient, n.url, map[string]string{"text": text})
+}
+
+// email via SMTP
+type smtpNotifier struct {
+	cfg *ServiceConfig
+}
+
+func (n *smtpNotifier) Name() string {
+	return "smtp"
+}
+
+func (n *smtpNotifier) Notify(event string, subject string, summary *RunSummary) error {
+
+	var body bytes.Buffer
+	body.WriteString(fmt.Sprintf("From: %s\r\n", n.cfg.SmtpFrom))
+	body.WriteString(fmt.Sprintf("To: %s\r\n", strings.Join(n.cfg.SmtpTo, ", ")))
+	body.WriteString(fmt.Sprintf("Subject: %s\r\n", subject))
+	body.WriteString(fmt.Sprintf("Date: %s\r\n", time.Now().Format(time.RFC1123Z)))
+	body.WriteString("MIME-Version: 1.0\r\n")
+	body.WriteString("Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	body.WriteString(strings.ReplaceAll(notificationMessage(summary), "\n", "\r\n"))
+	body.WriteString("\r\n")
+
+	var auth smtp.Auth
+	if n.cfg.SmtpUser != "" {
+		auth = smtp.PlainAuth("", n.cfg.SmtpUser, n.cfg.SmtpPass, n.cfg.SmtpHost)
+	}
+
+	// smtp.SendMail has no timeout so make sure we do not hang a run waiting for a mail server
+	addr := net.JoinHostPort(n.cfg.SmtpHost, strconv.Itoa(n.cfg.SmtpPort))
+	done := make(chan error, 1)
+	go func() {
+		done <- smtp.SendMail(addr, auth, n.cfg.SmtpFrom, n.cfg.SmtpTo, body.Bytes())
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(notifyTimeout):
+		return fmt.Errorf("timeout sending to %s", addr)
+	}
+}
+
+// post a JSON body, any 2xx response is success
+func postJson(httpClient *http.Client, url string, body interface{}) error {
+
+	buf, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	response, err := httpClient.Post(url, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("%s returned HTTP %d", url, response.StatusCode)
+	}
+	return nil
+}
+
+//
+// end of file
+//
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+)
+
+// the message attribute (or header) that identifies a compressed payload. Consumers that do not
+// know about it will only see it when compression is enabled
+var attributeKeyPayloadEncoding = "encoding"
+
+// the payload encodings
+const (
+	PayloadEncodingGzip = "gzip"
+)
+
+// the approximate space taken by the message attributes (including any provenance), used when sizing batches
+var messageAttributeOverhead = 1024
+
+// the outbound payload for a record; the base64 encoded MARC, gzipped first if configured. The payload
+// is determined once and kept with the record until it is sent
+func outboundPayload(record Record, compress bool) []byte {
+
+	if payload := record.Payload(); payload != nil {
+		return payload
+	}
+
+	raw := record.Raw()
+	if compress == true {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		// writes to a bytes.Buffer cannot fail
+		_, _ = zw.Write(raw)
+		_ = zw.Close()
+		raw = buf.Bytes()
+	}
+
+	payload := make([]byte, base64.StdEncoding.EncodedLen(len(raw)))
+	base64.StdEncoding.Encode(payload, raw)
+	record.SetPayload(payload)
+	return payload
+}
+
+// the payload encoding to signal (blank if the payload is not compressed)
+func payloadEncoding(compress bool) string {
+	if compress == true {
+		return PayloadEncodingGzip
+	}
+	return ""
+}
+
+// the approximate outbound message size of a record
+func outboundSize(record Record, compress bool) int {
+	return len(outboundPayload(record, compress)) + messageAttributeOverhead
+}
+
+//
+// end of file
+//
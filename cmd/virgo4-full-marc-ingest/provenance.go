@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+var ErrUnknownProvenanceAttribute = fmt.Errorf("unknown provenance attribute")
+
+// the optional provenance attributes attached to outbound messages
+const (
+	ProvenanceRunId    = "run-id"        // the ingest run
+	ProvenanceKey      = "source-key"    // the S3 bucket and key of the input file
+	ProvenanceIndex    = "record-index"  // the index of the record within the input file
+	ProvenanceOffset   = "record-offset" // the byte offset of the record within the input file
+	ProvenanceHash     = "content-hash"  // the SHA256 hash of the MARC record
+	ProvenanceMerged   = "merged-count"  // the number of records merged into this one
+	ProvenanceIngested = "ingested-at"   // when the record was read (RFC3339)
+)
+
+// every provenance attribute, the order they are attached in
+var allProvenanceAttributes = []string{
+	ProvenanceRunId,
+	ProvenanceKey,
+	ProvenanceIndex,
+	ProvenanceOffset,
+	ProvenanceHash,
+	ProvenanceMerged,
+	ProvenanceIngested,
+}
+
+// SQS allows 10 message attributes, we always send id, type, source and operation and possibly the payload
+// encoding and trace context. The provenance is packed into a single attribute so any number of them fit
+var maxSqsMessageAttributes = 10
+var provenanceMessageAttribute = "provenance"
+
+// Provenance - where a record came from
+type Provenance struct {
+	RunId    string    `json:"run_id"`
+	Key      string    `json:"key"`
+	Index    int       `json:"index"`
+	Offset   int64     `json:"offset"`
+	Ingested time.Time `json:"ingested"`
+}
+
+// parse the configured provenance attributes, "all" selects every one of them
+func splitProvenance(value string) ([]string, error) {
+
+	names := splitOptional(value)
+	if len(names) == 1 && names[0] == "all" {
+		return allProvenanceAttributes, nil
+	}
+
+	// keep the standard order regardless of how they were configured
+	selected := make([]string, 0, len(names))
+	for _, attrib := range allProvenanceAttributes {
+		for _, name := range names {
+			if name == attrib {
+				selected = append(selected, attrib)
+				break
+			}
+		}
+	}
+	if len(selected) != len(names) {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownProvenanceAttribute, strings.Join(names, " "))
+	}
+	return selected, nil
+}
+
+// the provenance attributes for a record. Records without provenance (there should not be any) get none
+func provenanceAttributes(record Record, names []string) []awssqs.Attribute {
+
+	p := record.Provenance()
+	if p == nil || len(names) == 0 {
+		return nil
+	}
+
+	attributes := make([]awssqs.Attribute, 0, len(names))
+	for _, name := range names {
+		value := ""
+		switch name {
+		case ProvenanceRunId:
+			value = p.RunId
+		case ProvenanceKey:
+			value = p.Key
+		case ProvenanceIndex:
+			value = strconv.Itoa(p.Index)
+		case ProvenanceOffset:
+			value = strconv.FormatInt(p.Offset, 10)
+		case ProvenanceHash:
+			value = recordHash(record.Raw())
+		case ProvenanceMerged:
+			value = strconv.Itoa(record.Merged())
+		case ProvenanceIngested:
+			value = p.Ingested.UTC().Format(time.RFC3339)
+		}
+		// SQS does not allow empty attribute values
+		if value != "" {
+			attributes = append(attributes, awssqs.Attribute{Name: name, Value: value})
+		}
+	}
+	return attributes
+}
+
+// the provenance attributes packed into a single SQS message attribute as a JSON object, the individual
+// attributes would exceed the SQS limit
+func provenanceMessageAttributes(record Record, names []string) []awssqs.Attribute {
+
+	values := provenanceMap(record, names)
+	if len(values) == 0 {
+		return nil
+	}
+	buf, err := json.Marshal(values)
+	if err != nil {
+		return nil
+	}
+	return []awssqs.Attribute{{Name: provenanceMessageAttribute, Value: string(buf)}}
+}
+
+// the provenance attributes as a map, used by the sinks that write JSON
+func provenanceMap(record Record, names []string) map[string]string {
+
+	attributes := provenanceAttributes(record, names)
+	if len(attributes) == 0 {
+		return nil
+	}
+	values := make(map[string]string, len(attributes))
+	for _, a := range attributes {
+		values[a.Name] = a.Value
+	}
+	return values
+}
+
+//
+// end of file
+//
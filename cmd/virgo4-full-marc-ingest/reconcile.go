@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+	"github.com/uvalib/uva-aws-s3-sdk/uva-s3"
+)
+
+var ErrTooManyDeletes = fmt.Errorf("reconciliation delete count exceeds the configured maximum")
+var ErrNothingIngested = fmt.Errorf("no records were ingested, cannot reconcile")
+
+// the subset of the SOLR cursor query response that we are interested in
+type solrIdQueryResponse struct {
+	Response struct {
+		Docs []struct {
+			Id string `json:"id"`
+		} `json:"docs"`
+	} `json:"response"`
+	NextCursorMark string `json:"nextCursorMark"`
+}
+
+// delete any SOLR documents for the data source that were not part of this ingest
+func reconcileSolrRecords(cfg *ServiceConfig, s3Svc uva_s3.UvaS3, ingested string, runId string) (int64, error) {
+	log.Printf("INFO: reconciling SOLR records (%s)", cfg.DataSource)
+
+	httpClient := newSolrClient(cfg.SolrTimeout)
+	existing, err := NewIdSpool(cfg.DownloadDir, "solr-*.ids")
+	if err != nil {
+		return 0, err
+	}
+	defer existing.Remove()
+
+	err = solrSpoolIds(httpClient, cfg, existing)
+	if err != nil {
+		return 0, err
+	}
+
+	deleteUrl := fmt.Sprintf("%s/%s/update", cfg.SolrMaster, cfg.SolrCore)
+	deleteBatch := func(ids []string) error {
+		var payload strings.Builder
+		payload.WriteString("<delete>")
+		for _, id := range ids {
+			payload.WriteString("<id>")
+			_ = xml.EscapeText(&payload, []byte(id))
+			payload.WriteString("</id>")
+		}
+		payload.WriteString("</delete>")
+		_, err := httpPost(httpClient, deleteUrl, []byte(payload.String()))
+		return err
+	}
+
+	return reconcileIds(cfg, s3Svc, "solr", existing, ingested, runId, deleteBatch)
+}
+
+// delete any cache records for the data source that were not part of this ingest
+func reconcileCacheRecords(cfg *ServiceConfig, s3Svc uva_s3.UvaS3, ingested string, runId string) (int64, error) {
+	log.Printf("INFO: reconciling cache records (%s)", cfg.DataSource)
+
+	existing, err := NewIdSpool(cfg.DownloadDir, "cache-*.ids")
+	if err != nil {
+		return 0, err
+	}
+	defer existing.Remove()
+
+	err = cacheSpoolIds(cfg.DataSource, existing)
+	if err != nil {
+		return 0, err
+	}
+
+	deleteBatch := func(ids []string) error {
+		values := make([]interface{}, len(ids))
+		for ix, id := range ids {
+			values[ix] = id
+		}
+		_, err := cacheTransaction(cfg, func(tx *dbx.Tx) (int64, error) {
+			res, err := tx.Delete("source_cache", dbx.And(dbx.HashExp{"source": cfg.DataSource}, dbx.In("id", values...))).Execute()
+			if err != nil {
+				return 0, err
+			}
+			return res.RowsAffected()
+		})
+		return err
+	}
+
+	return reconcileIds(cfg, s3Svc, "cache", existing, ingested, runId, deleteBatch)
+}
+
+// determine the ids that exist but were not ingested and delete them in batches. The list of deleted
+// ids is saved as a run artifact
+func reconcileIds(cfg *ServiceConfig, s3Svc uva_s3.UvaS3, name string, existing *IdSpool, ingested string, runId string, deleteBatch func([]string) error) (int64, error) {
+
+	err := existing.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	// if we ingested nothing then everything would be deleted, assume something is wrong
+	fi, err := os.Stat(ingested)
+	if err != nil {
+		return 0, err
+	}
+	if fi.Size() == 0 {
+		log.Printf("ERROR: no records ingested, not reconciling %s records", name)
+		return 0, ErrNothingIngested
+	}
+
+	sorted, err := sortSpoolFile(cfg.DownloadDir, existing.Name)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(sorted)
+
+	deletes, err := NewIdSpool(cfg.DownloadDir, name+"-deletes-*.ids")
+	if err != nil {
+		return 0, err
+	}
+
+	err = subtractSortedIds(sorted, ingested, deletes.Add)
+	if err != nil {
+		deletes.Remove()
+		return 0, err
+	}
+
+	err = deletes.Close()
+	if err != nil {
+		deletes.Remove()
+		return 0, err
+	}
+
+	log.Printf("INFO: %d %s records (%s) were not part of this ingest", deletes.Count, name, cfg.DataSource)
+
+	// keep a record of what we are about to delete (or refused to delete)
+	defer func() {
+		err := saveArtifact(cfg, s3Svc, deletes.Name, artifactName(cfg.DataSource, runId, name+"-deletes.txt"))
+		if err != nil {
+			deletes.Remove()
+		}
+	}()
+
+	// during a dry run we only report what we would have done
+	if cfg.DryRun == true {
+		log.Printf("INFO: DRY RUN, not deleting %d %s records", deletes.Count, name)
+		return int64(deletes.Count), nil
+	}
+
+	// sanity check before we delete anything
+	if cfg.ReconcileMaxDeletes != 0 && deletes.Count > cfg.ReconcileMaxDeletes {
+		log.Printf("ERROR: %d %s records to delete exceeds the maximum of %d, not deleting", deletes.Count, name, cfg.ReconcileMaxDeletes)
+		return 0, ErrTooManyDeletes
+	}
+
+	reader, err := NewIdReader(deletes.Name)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+
+	start := time.Now()
+	deleted := int64(0)
+	batch := make([]string, 0, cfg.ReconcileBatchSize)
+	for {
+		id, err := reader.Next()
+		if err != nil && err != io.EOF {
+			return deleted, err
+		}
+
+		if err == nil {
+			batch = append(batch, id)
+		}
+
+		if len(batch) == cfg.ReconcileBatchSize || (err == io.EOF && len(batch) != 0) {
+			e := deleteBatch(batch)
+			if e != nil {
+				log.Printf("ERROR: deleting %s records (%s)", name, e.Error())
+				return deleted, e
+			}
+			deleted += int64(len(batch))
+			batch = batch[:0]
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	duration := time.Since(start)
+	log.Printf("INFO: %s reconciliation deleted %d records in %0.2f seconds", name, deleted, duration.Seconds())
+	return deleted, nil
+}
+
+// page through all the SOLR document ids for the data source and add them to the spool
+func solrSpoolIds(httpClient *http.Client, cfg *ServiceConfig, spool *IdSpool) error {
+
+	cursor := "*"
+	for {
+		params := url.Values{}
+		params.Set("q", fmt.Sprintf("data_source_f:%s", cfg.DataSource))
+		params.Set("fl", "id")
+		params.Set("sort", "id asc")
+		params.Set("rows", fmt.Sprintf("%d", cfg.ReconcileBatchSize))
+		params.Set("cursorMark", cursor)
+		params.Set("wt", "json")
+
+		queryUrl := fmt.Sprintf("%s/%s/select?%s", cfg.SolrMaster, cfg.SolrCore, params.Encode())
+		body, err := httpGet(httpClient, queryUrl)
+		if err != nil {
+			return err
+		}
+
+		response := solrIdQueryResponse{}
+		err = json.Unmarshal(body, &response)
+		if err != nil {
+			log.Printf("ERROR: json unmarshal: %s", err)
+			return err
+		}
+
+		for _, d := range response.Response.Docs {
+			if err = spool.Add(d.Id); err != nil {
+				return err
+			}
+		}
+
+		// the cursor does not change when we have reached the end
+		if response.NextCursorMark == "" || response.NextCursorMark == cursor {
+			return nil
+		}
+		cursor = response.NextCursorMark
+	}
+}
+
+// add all the cache record ids for the data source to the spool
+func cacheSpoolIds(dataSource string, spool *IdSpool) error {
+
+	q := dbHandle.Select("id").From("source_cache").Where(dbx.HashExp{"source": dataSource})
+	rows, err := q.Rows()
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var id string
+	for rows.Next() {
+		if err = rows.Scan(&id); err != nil {
+			return err
+		}
+		if err = spool.Add(id); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+//
+// end of file
+//
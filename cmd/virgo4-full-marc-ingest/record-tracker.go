@@ -0,0 +1,106 @@
+package main
+
+import (
+	"sync"
+)
+
+// RecordTracker - tracks records from the time they are queued for the workers until they are sent
+// so we know the point before which every record has been successfully sent. Spilled records are done
+// as far as the workers are concerned but they are not confirmed until they have been resent
+type RecordTracker struct {
+	sync.Mutex
+	next       uint64          // the next sequence number to assign
+	confirmed  uint64          // all sequence numbers below this have been sent (or spilled)
+	done       map[uint64]bool // sent sequence numbers at or above the confirmed point
+	messages   uint64          // the outbound messages sent
+	spilled    bool            // records have been spilled and not yet resent
+	firstSpill uint64          // the lowest spilled sequence number
+}
+
+// NewRecordTracker - create a new record tracker
+func NewRecordTracker() *RecordTracker {
+	return &RecordTracker{done: make(map[uint64]bool)}
+}
+
+// Assign - assign the next sequence number
+func (t *RecordTracker) Assign() uint64 {
+	t.Lock()
+	defer t.Unlock()
+	seq := t.next
+	t.next++
+	return seq
+}
+
+// Done - note that a record has been sent
+func (t *RecordTracker) Done(seq uint64) {
+	t.Lock()
+	defer t.Unlock()
+	t.markDone(seq)
+}
+
+// Spilled - note that a record could not be sent and was spilled, it is no longer pending but the
+// confirmed point cannot move past it until the spilled records are resent
+func (t *RecordTracker) Spilled(seq uint64) {
+	t.Lock()
+	defer t.Unlock()
+	if t.spilled == false || seq < t.firstSpill {
+		t.spilled, t.firstSpill = true, seq
+	}
+	t.markDone(seq)
+}
+
+// Resent - note that the spilled records have all been resent
+func (t *RecordTracker) Resent() {
+	t.Lock()
+	defer t.Unlock()
+	t.spilled = false
+}
+
+// the caller holds the lock
+func (t *RecordTracker) markDone(seq uint64) {
+
+	if seq < t.confirmed {
+		return
+	}
+
+	t.done[seq] = true
+	for t.done[t.confirmed] == true {
+		delete(t.done, t.confirmed)
+		t.confirmed++
+	}
+}
+
+// Confirmed - every sequence number below this has been sent
+func (t *RecordTracker) Confirmed() uint64 {
+	t.Lock()
+	defer t.Unlock()
+	if t.spilled == true && t.firstSpill < t.confirmed {
+		return t.firstSpill
+	}
+	return t.confirmed
+}
+
+// AddMessages - note outbound messages sent
+func (t *RecordTracker) AddMessages(count int) {
+	t.Lock()
+	defer t.Unlock()
+	t.messages += uint64(count)
+}
+
+// Messages - the outbound messages sent so far
+func (t *RecordTracker) Messages() uint64 {
+	t.Lock()
+	defer t.Unlock()
+	return t.messages
+}
+
+// Pending - the number of records assigned but not yet sent
+func (t *RecordTracker) Pending() uint64 {
+	t.Lock()
+	defer t.Unlock()
+	return t.next - t.confirmed - uint64(len(t.done))
+}
+
+//
+// end of file
+//
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRecordTracker(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		assigned  int
+		done      []uint64
+		spilled   []uint64
+		resent    bool
+		confirmed uint64
+		pending   uint64
+	}{
+		{"nothing sent", 5, nil, nil, false, 0, 5},
+		{"sent in order", 5, []uint64{0, 1, 2}, nil, false, 3, 2},
+		{"sent out of order", 5, []uint64{4, 2, 0}, nil, false, 1, 2},
+		{"gap filled", 5, []uint64{1, 2, 0, 4}, nil, false, 3, 1},
+		{"all sent", 3, []uint64{2, 1, 0}, nil, false, 3, 0},
+		{"sent twice", 3, []uint64{0, 0, 1}, nil, false, 2, 1},
+		{"spilled holds confirmation", 5, []uint64{0, 1, 3, 4}, []uint64{2}, false, 2, 0},
+		{"lowest spill holds", 6, []uint64{0, 2, 4}, []uint64{3, 1, 5}, false, 1, 0},
+		{"spill not yet confirmed", 5, []uint64{0, 4}, []uint64{3}, false, 1, 2},
+		{"resent releases", 5, []uint64{0, 1, 3, 4}, []uint64{2}, true, 5, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := NewRecordTracker()
+			for ix := 0; ix < test.assigned; ix++ {
+				if seq := tracker.Assign(); seq != uint64(ix) {
+					t.Fatalf("assigned %d, expected %d", seq, ix)
+				}
+			}
+			for _, seq := range test.done {
+				tracker.Done(seq)
+			}
+			for _, seq := range test.spilled {
+				tracker.Spilled(seq)
+			}
+			if test.resent == true {
+				tracker.Resent()
+			}
+			if got := tracker.Confirmed(); got != test.confirmed {
+				t.Errorf("confirmed %d, expected %d", got, test.confirmed)
+			}
+			if got := tracker.Pending(); got != test.pending {
+				t.Errorf("pending %d, expected %d", got, test.pending)
+			}
+		})
+	}
+}
+
+func TestConfirmAcrossFiles(t *testing.T) {
+
+	tests := []struct {
+		name      string
+		fileStart []uint64
+		filePos   []int
+		done      int // records sent, in sequence order
+		expected  []int
+	}{
+		{"nothing sent", []uint64{0, 0}, []int{4, 0}, 0, []int{0, 0}},
+		{"part of the first file", []uint64{0, 0}, []int{4, 0}, 3, []int{3, 0}},
+		{"first file complete", []uint64{0, 4}, []int{4, 2}, 4, []int{4, 0}},
+		{"into the second file", []uint64{0, 4}, []int{4, 3}, 6, []int{4, 2}},
+		{"all files complete", []uint64{0, 4, 7}, []int{4, 3, 2}, 9, []int{4, 3, 2}},
+		{"file not started", []uint64{0, 0, 0}, []int{4, 0, 0}, 4, []int{4, 0, 0}},
+		{"empty file between", []uint64{0, 0, 4}, []int{4, 0, 2}, 5, []int{4, 0, 1}},
+		{"resumed run, earlier files skipped", []uint64{0, 10, 15}, []int{0, 5, 5}, 13, []int{0, 3, 0}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tracker := NewRecordTracker()
+			last := uint64(0)
+			for ix := range test.filePos {
+				end := test.fileStart[ix] + uint64(test.filePos[ix])
+				if end > last {
+					last = end
+				}
+			}
+			for seq := uint64(0); seq < last; seq++ {
+				tracker.Assign()
+			}
+			for seq := 0; seq < test.done; seq++ {
+				tracker.Done(uint64(seq))
+			}
+
+			summary := NewRunSummary("test", "", false)
+			for range test.filePos {
+				summary.AddFile("bucket", "key", 0, "")
+			}
+			r := &IngestRun{tracker: tracker, fileStart: test.fileStart, filePos: test.filePos, Summary: summary}
+			r.confirm(summary)
+
+			got := make([]int, 0, len(summary.Files))
+			for _, f := range summary.Files {
+				got = append(got, f.Confirmed)
+			}
+			if reflect.DeepEqual(got, test.expected) == false {
+				t.Errorf("confirmed %v, expected %v", got, test.expected)
+			}
+		})
+	}
+}
+
+//
+// end of file
+//
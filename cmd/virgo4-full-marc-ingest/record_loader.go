@@ -22,6 +22,8 @@ type RecordLoader interface {
 	Validate() error
 	First(bool) (Record, error)
 	Next(bool) (Record, error)
+	Offset() int64
+	SeekTo(int64) error
 	Done()
 }
 
@@ -31,6 +33,16 @@ type Record interface {
 	Source() string
 	SetSource(string)
 	Raw() []byte
+	SetRaw([]byte)
+	Merged() int
+	Repaired() bool
+	Sequence() uint64
+	SetSequence(uint64)
+	Payload() []byte
+	SetPayload([]byte)
+	Offset() int64
+	Provenance() *Provenance
+	SetProvenance(*Provenance)
 }
 
 // this is our loader implementation
@@ -45,6 +57,13 @@ type recordImpl struct {
 	RawBytes []byte // the raw record
 	source   string // determined from the filename
 	marcId   string // extracted from the record
+	merged   int    // the number of additional records merged into this one
+	repaired bool   // the record was malformed and has been repaired
+	sequence uint64 // assigned when the record is queued for sending
+	offset   int64  // the file offset of the record
+	payload  []byte // the encoded outbound payload, once determined
+
+	provenance *Provenance // where the record came from, set when it is ingested
 }
 
 //
@@ -216,6 +235,7 @@ func (l *recordLoaderImpl) Next(readAhead bool) (Record, error) {
 			if ok == true {
 				//log.Printf("INFO: identified additional marc record for %s, appending it", id)
 				impl.RawBytes = append(rec.Raw(), nextRec.Raw()...)
+				impl.merged++
 			} else {
 				log.Printf("ERROR: unable to append MARC additional record")
 				_, _ = l.File.Seek(currentPos, 0)
@@ -235,12 +255,38 @@ func (l *recordLoaderImpl) Done() {
 	}
 }
 
+// Offset - the current file offset, the start of the next record
+func (l *recordLoaderImpl) Offset() int64 {
+
+	if l.File == nil {
+		return 0
+	}
+
+	// assume no error cos we are not moving the file pointer
+	pos, _ := l.File.Seek(0, 1)
+	return pos
+}
+
+// SeekTo - position the file so the next read is of the record at the specified offset
+func (l *recordLoaderImpl) SeekTo(offset int64) error {
+
+	if l.File == nil {
+		return ErrFileNotOpen
+	}
+
+	_, err := l.File.Seek(offset, 0)
+	return err
+}
+
 func (l *recordLoaderImpl) Source() string {
 	return l.DataSource
 }
 
 func (l *recordLoaderImpl) rawMarcRead() (Record, error) {
 
+	// note where the record starts for reporting, assume no error cos we are not moving the file pointer
+	start, _ := l.File.Seek(0, 1)
+
 	// read the 5 byte length header
 	_, err := l.File.Read(l.HeaderBuff)
 	if err != nil {
@@ -255,7 +301,7 @@ func (l *recordLoaderImpl) rawMarcRead() (Record, error) {
 
 	// ensure the number is sane
 	if length <= marcRecordHeaderSize {
-		log.Printf("ERROR: marc record prefix invalid (%s)", string(l.HeaderBuff))
+		logRecordf(LevelError, "", start, "marc record prefix invalid (%s)", string(l.HeaderBuff))
 		return nil, ErrBadRecord
 	}
 
@@ -273,16 +319,16 @@ func (l *recordLoaderImpl) rawMarcRead() (Record, error) {
 
 	// we did not read the number of bytes we expected, log it and declare victory
 	if readBytes != length {
-		log.Printf("WARNING: short record read. Expected %d, got %d. Declaring EOF", length, readBytes)
+		logRecordf(LevelWarning, "", start, "short record read. Expected %d, got %d. Declaring EOF", length, readBytes)
 		return nil, io.EOF
 	}
 
 	// verify the end of record marker exists and return success if it does
 	if readBuf[length-2] == fieldTerminator && readBuf[length-1] == recordTerminator {
-		return &recordImpl{RawBytes: readBuf, source: l.DataSource}, nil
+		return &recordImpl{RawBytes: readBuf, source: l.DataSource, offset: start}, nil
 	}
 
-	log.Printf("WARNING: unexpected marc record suffix. Expected (%x %x) got (%x %x). Header length reports %d", fieldTerminator, recordTerminator, readBuf[length-2], readBuf[length-1], length)
+	logRecordf(LevelWarning, "", start, "unexpected marc record suffix. Expected (%x %x) got (%x %x). Header length reports %d", fieldTerminator, recordTerminator, readBuf[length-2], readBuf[length-1], length)
 
 	//
 	// we have a badly formed record, look to see if the terminator appears earlier in the record (in bytes we have already read)
@@ -291,10 +337,10 @@ func (l *recordLoaderImpl) rawMarcRead() (Record, error) {
 	tag := []byte{fieldTerminator, recordTerminator}
 	foundIx := bytes.Index(readBuf, tag)
 	if foundIx != -1 {
-		log.Printf("WARNING: located record terminator earlier in the buffer at offset %d", foundIx)
+		logRecordf(LevelWarning, "", start, "located record terminator earlier in the buffer at offset %d", foundIx)
 		// FIXME: we need to reset the file pointer
-		log.Printf("ERROR: WE HAVE NOT RESET THE FILE POINTER, SUBSEQUENT READS WILL BE BAD")
-		return &recordImpl{RawBytes: readBuf[0:foundIx], source: l.DataSource}, nil
+		logRecordf(LevelError, "", start, "WE HAVE NOT RESET THE FILE POINTER, SUBSEQUENT READS WILL BE BAD")
+		return &recordImpl{RawBytes: readBuf[0:foundIx], source: l.DataSource, repaired: true, offset: start}, nil
 	}
 
 	//
@@ -308,7 +354,7 @@ func (l *recordLoaderImpl) rawMarcRead() (Record, error) {
 		b := make([]byte, 1)
 		_, err = l.File.Read(b)
 		if err != nil {
-			log.Printf("ERROR: reading forward for record terminator, giving up (%s)", err.Error())
+			logRecordf(LevelError, "", start, "reading forward for record terminator, giving up (%s)", err.Error())
 			break
 		}
 
@@ -316,8 +362,8 @@ func (l *recordLoaderImpl) rawMarcRead() (Record, error) {
 
 		// did we find the record terminator
 		if b[0] == recordTerminator {
-			log.Printf("WARNING: record terminator located after an additional %d bytes", len(additionalBuffer))
-			return &recordImpl{RawBytes: append(readBuf, additionalBuffer...), source: l.DataSource}, nil
+			logRecordf(LevelWarning, "", start, "record terminator located after an additional %d bytes", len(additionalBuffer))
+			return &recordImpl{RawBytes: append(readBuf, additionalBuffer...), source: l.DataSource, repaired: true, offset: start}, nil
 		}
 	}
 
@@ -338,6 +384,13 @@ func (r *recordImpl) Raw() []byte {
 	return r.RawBytes
 }
 
+// SetRaw - replace the record contents, the id and payload are determined again
+func (r *recordImpl) SetRaw(raw []byte) {
+	r.RawBytes = raw
+	r.marcId = ""
+	r.payload = nil
+}
+
 func (r *recordImpl) Source() string {
 	return r.source
 }
@@ -346,6 +399,42 @@ func (r *recordImpl) SetSource(source string) {
 	r.source = source
 }
 
+func (r *recordImpl) Merged() int {
+	return r.merged
+}
+
+func (r *recordImpl) Repaired() bool {
+	return r.repaired
+}
+
+func (r *recordImpl) Sequence() uint64 {
+	return r.sequence
+}
+
+func (r *recordImpl) SetSequence(sequence uint64) {
+	r.sequence = sequence
+}
+
+func (r *recordImpl) Payload() []byte {
+	return r.payload
+}
+
+func (r *recordImpl) SetPayload(payload []byte) {
+	r.payload = payload
+}
+
+func (r *recordImpl) Offset() int64 {
+	return r.offset
+}
+
+func (r *recordImpl) Provenance() *Provenance {
+	return r.provenance
+}
+
+func (r *recordImpl) SetProvenance(provenance *Provenance) {
+	r.provenance = provenance
+}
+
 func (r *recordImpl) extractId() (string, error) {
 
 	id, err := r.getMarcFieldId("001")
@@ -385,7 +474,7 @@ func (r *recordImpl) getMarcFieldId(fieldId string) (string, error) {
 	currentOffset := marcRecordFieldDirStart
 	endOfDir, err := strconv.Atoi(string(r.RawBytes[12:17]))
 	if err != nil {
-		log.Printf("ERROR: marc record end of directory offset invalid (%s)", string(r.RawBytes[12:17]))
+		logRecordf(LevelError, "", r.offset, "marc record end of directory offset invalid (%s)", string(r.RawBytes[12:17]))
 		return "", ErrBadRecord
 	}
 
@@ -394,11 +483,11 @@ func (r *recordImpl) getMarcFieldId(fieldId string) (string, error) {
 		tag := []byte{fieldTerminator}
 		foundIx := bytes.Index(r.RawBytes, tag)
 		if foundIx == -1 {
-			log.Printf("ERROR: cannot locate end of directory marker")
+			logRecordf(LevelError, "", r.offset, "cannot locate end of directory marker")
 			return "", ErrBadRecord
 		}
 		foundIx++
-		log.Printf("INFO: resetting directory terminator. was %d, now %d", endOfDir, foundIx)
+		logRecordf(LevelInfo, "", r.offset, "resetting directory terminator. was %d, now %d", endOfDir, foundIx)
 		endOfDir = foundIx
 	}
 
@@ -409,13 +498,13 @@ func (r *recordImpl) getMarcFieldId(fieldId string) (string, error) {
 		next := string(dirEntry[3:7])
 		fieldLength, err := strconv.Atoi(next)
 		if err != nil {
-			log.Printf("ERROR: marc record field length invalid (%s)", next)
+			logRecordf(LevelError, "", r.offset, "marc record field length invalid (%s)", next)
 			return "", ErrBadRecord
 		}
 		next = string(dirEntry[7:12])
 		fieldOffset, err := strconv.Atoi(next)
 		if err != nil {
-			log.Printf("ERROR: marc record field offset invalid (%s)", next)
+			logRecordf(LevelError, "", r.offset, "marc record field offset invalid (%s)", next)
 			return "", ErrBadRecord
 		}
 
@@ -427,7 +516,7 @@ func (r *recordImpl) getMarcFieldId(fieldId string) (string, error) {
 		currentOffset += marcRecordFieldDirEntrySize
 	}
 
-	log.Printf("ERROR: could not locate field %s in marc record", fieldId)
+	logRecordf(LevelError, "", r.offset, "could not locate field %s in marc record", fieldId)
 	return "", ErrBadRecord
 }
 
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/uvalib/uva-aws-s3-sdk/uva-s3"
+)
+
+var ErrNoReportLocation = fmt.Errorf("run has no input files and no report bucket is configured")
+
+// the version of the report layout, bump when fields change meaning
+var runReportVersion = 1
+
+// RunReport - the machine readable report uploaded at the end of each run
+type RunReport struct {
+	Version          int                `json:"version"`
+	RunId            string             `json:"run_id"`
+	DataSource       string             `json:"data_source"`
+	DryRun           bool               `json:"dry_run"`
+	Outcome          string             `json:"outcome"`
+	Error            string             `json:"error,omitempty"`
+	Warnings         []string           `json:"warnings,omitempty"`
+	Started          time.Time          `json:"started"`
+	Finished         time.Time          `json:"finished"`
+	ElapsedSeconds   float64            `json:"elapsed_seconds"`
+	ResumeCount      int                `json:"resume_count"`
+	Inputs           []RunReportInput   `json:"inputs"`
+	Totals           RunReportTotals    `json:"totals"`
+	Throughput       RunReportRate      `json:"throughput"`
+	Phases           []RunReportPhase   `json:"phases"`
+	OutboundMessages uint64             `json:"outbound_messages"`
+	ErrorQueue       RunReportThreshold `json:"error_queue"`
+	Deletes          RunReportDeletes   `json:"deletes"`
+	Collections      *RunReportSwap     `json:"collections,omitempty"`
+}
+
+// RunReportInput - a single input file
+type RunReportInput struct {
+	Bucket          string         `json:"bucket"`
+	Key             string         `json:"key"`
+	Size            int64          `json:"size"`
+	Checksum        string         `json:"checksum"`
+	Records         int            `json:"records"`
+	Merged          int            `json:"merged"`
+	Bad             int            `json:"bad"`
+	Duplicates      int            `json:"duplicates"`
+	Filtered        map[string]int `json:"filtered,omitempty"`
+	Converted       int            `json:"converted"`
+	InvalidUtf8     int            `json:"invalid_utf8"`
+	DurationSeconds float64        `json:"duration_seconds"`
+	Throughput      RunReportRate  `json:"throughput"`
+}
+
+// RunReportTotals - the totals across all the input files
+type RunReportTotals struct {
+	Files       int            `json:"files"`
+	Bytes       int64          `json:"bytes"`
+	Records     int            `json:"records"`
+	Merged      int            `json:"merged"`
+	Bad         int            `json:"bad"`
+	Duplicates  int            `json:"duplicates"`
+	Filtered    map[string]int `json:"filtered,omitempty"`
+	Converted   int            `json:"converted"`
+	InvalidUtf8 int            `json:"invalid_utf8"`
+	Spilled     int            `json:"spilled"`
+	Replayed    int            `json:"replayed"`
+}
+
+// RunReportRate - ingest throughput
+type RunReportRate struct {
+	RecordsPerSecond float64 `json:"records_per_second"`
+	BytesPerSecond   float64 `json:"bytes_per_second"`
+}
+
+// RunReportPhase - the timing of a run phase
+type RunReportPhase struct {
+	Phase           RunPhase  `json:"phase"`
+	Started         time.Time `json:"started"`
+	DurationSeconds float64   `json:"duration_seconds"`
+}
+
+// RunReportThreshold - the error queue count checked against the configured threshold
+type RunReportThreshold struct {
+	Count     uint `json:"count"`
+	Threshold int  `json:"threshold"`
+	Exceeded  bool `json:"exceeded"`
+}
+
+// RunReportDeletes - the deletion counts, a dry run reports what would have been deleted
+type RunReportDeletes struct {
+	Solr  int64 `json:"solr"`
+	Cache int64 `json:"cache"`
+}
+
+// RunReportSwap - the SOLR collections when swapping collections
+type RunReportSwap struct {
+	New      string `json:"new"`
+	Previous string `json:"previous"`
+}
+
+// create the report from the run summary
+func newRunReport(cfg *ServiceConfig, summary *RunSummary) *RunReport {
+
+	report := &RunReport{
+		Version:          runReportVersion,
+		RunId:            summary.RunId,
+		DataSource:       summary.DataSource,
+		DryRun:           summary.DryRun,
+		Outcome:          summary.Outcome,
+		Error:            summary.Error,
+		Warnings:         summary.Warnings,
+		Started:          summary.Started,
+		Finished:         summary.Finished,
+		ElapsedSeconds:   summary.Finished.Sub(summary.Started).Seconds(),
+		ResumeCount:      summary.ResumeCount,
+		Inputs:           make([]RunReportInput, 0, len(summary.Files)),
+		Phases:           make([]RunReportPhase, 0, len(summary.Phases)),
+		OutboundMessages: summary.OutboundMessages,
+		ErrorQueue: RunReportThreshold{
+			Count:     summary.ErrorQueueCount,
+			Threshold: cfg.ErrorThreshold,
+			Exceeded:  summary.ErrorQueueCount >= uint(cfg.ErrorThreshold),
+		},
+		Deletes: RunReportDeletes{Solr: summary.SolrDeleted, Cache: summary.CacheDeleted},
+	}
+
+	for _, f := range summary.Files {
+		report.Inputs = append(report.Inputs, RunReportInput{
+			Bucket:          f.Bucket,
+			Key:             f.Key,
+			Size:            f.Size,
+			Checksum:        f.Checksum,
+			Records:         f.Records,
+			Merged:          f.Merged,
+			Bad:             f.Bad,
+			Duplicates:      f.Duplicates,
+			Filtered:        f.Filtered,
+			Converted:       f.Converted,
+			InvalidUtf8:     f.InvalidUtf8,
+			DurationSeconds: f.Duration.Seconds(),
+			Throughput:      newRunReportRate(f.Records, f.Size, f.Duration),
+		})
+		report.Totals.Files++
+		report.Totals.Bytes += f.Size
+	}
+	report.Totals.Records = summary.TotalRecords
+	report.Totals.Merged = summary.MergedRecords
+	report.Totals.Bad = summary.BadRecords
+	report.Totals.Duplicates = summary.Duplicates
+	report.Totals.Filtered = summary.Filtered
+	report.Totals.Converted = summary.Converted
+	report.Totals.InvalidUtf8 = summary.InvalidUtf8
+	report.Totals.Spilled = summary.Spilled
+	report.Totals.Replayed = summary.Replayed
+
+	// a resumed run may have more than one ingest phase
+	ingest := time.Duration(0)
+	for _, p := range summary.Phases {
+		report.Phases = append(report.Phases, RunReportPhase{Phase: p.Phase, Started: p.Started, DurationSeconds: p.Duration.Seconds()})
+		if p.Phase == PhaseIngest {
+			ingest += p.Duration
+		}
+	}
+	report.Throughput = newRunReportRate(report.Totals.Records, report.Totals.Bytes, ingest)
+
+	if summary.NewCollection != "" {
+		report.Collections = &RunReportSwap{New: summary.NewCollection, Previous: summary.PreviousCollection}
+	}
+
+	return report
+}
+
+func newRunReportRate(records int, bytes int64, duration time.Duration) RunReportRate {
+	if duration <= 0 {
+		return RunReportRate{}
+	}
+	return RunReportRate{
+		RecordsPerSecond: float64(records) / duration.Seconds(),
+		BytesPerSecond:   float64(bytes) / duration.Seconds(),
+	}
+}
+
+// where the report goes; the report bucket if configured, otherwise next to the (first) input file
+func runReportLocation(cfg *ServiceConfig, summary *RunSummary) (string, string, error) {
+
+	name := fmt.Sprintf("%s-%s-report.json", summary.DataSource, summary.RunId)
+	if cfg.ReportBucket != "" {
+		return cfg.ReportBucket, path.Join(cfg.ReportPrefix, summary.DataSource, name), nil
+	}
+	if len(summary.Files) == 0 {
+		return "", "", ErrNoReportLocation
+	}
+	return summary.Files[0].Bucket, path.Join(path.Dir(summary.Files[0].Key), name), nil
+}
+
+// create and upload the run report
+func saveRunReport(cfg *ServiceConfig, s3Svc uva_s3.UvaS3, summary *RunSummary) error {
+
+	bucket, key, err := runReportLocation(cfg, summary)
+	if err != nil {
+		log.Printf("WARNING: not saving run report (%s)", err.Error())
+		return err
+	}
+
+	buf, err := json.MarshalIndent(newRunReport(cfg, summary), "", "  ")
+	if err != nil {
+		log.Printf("ERROR: creating run report (%s)", err.Error())
+		return err
+	}
+
+	file, err := ioutil.TempFile(cfg.DownloadDir, "run-report-*.json")
+	if err != nil {
+		log.Printf("ERROR: creating run report (%s)", err.Error())
+		return err
+	}
+
+	// a dry run keeps its report locally, it would sit alongside the reports of real runs
+	if cfg.DryRun == false {
+		defer os.Remove(file.Name())
+	}
+
+	_, err = file.Write(buf)
+	if err == nil {
+		err = file.Close()
+	} else {
+		file.Close()
+	}
+	if err != nil {
+		log.Printf("ERROR: writing run report (%s)", err.Error())
+		return err
+	}
+
+	if cfg.DryRun == true {
+		log.Printf("INFO: DRY RUN, run report available locally as %s (not uploaded to %s/%s)", file.Name(), bucket, key)
+		return nil
+	}
+
+	log.Printf("INFO: uploading run report to %s/%s", bucket, key)
+	err = s3Svc.PutFromFile(uva_s3.NewUvaS3Object(bucket, key), file.Name())
+	if err != nil {
+		log.Printf("ERROR: uploading run report (%s)", err.Error())
+		return err
+	}
+
+	return nil
+}
+
+//
+// end of file
+//
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// RunControl - the state of a run shared with the admin API; pause and abort requests and progress
+type RunControl struct {
+	sync.Mutex
+	cond    *sync.Cond
+	paused  bool
+	aborted bool
+	held    bool // the reader is held by backpressure
+
+	stalled      time.Duration // the time the current phase has spent paused or held
+	stalledSince time.Time     // when the current pause or hold started
+
+	phase        RunPhase  // the current phase
+	phaseStarted time.Time // when the current phase started
+	file         string    // the file being ingested
+	fileIndex    int       // its index
+	files        int       // the number of files in the run
+	bytesRead    int64     // the bytes ingested so far
+	bytesTotal   int64     // the total bytes to ingest
+	records      int       // the records ingested so far
+	ingestStart  time.Time // when this process started ingesting (used to estimate completion)
+}
+
+// RunStatus - a snapshot of the run state
+type RunStatus struct {
+	RunId        string    `json:"run_id"`
+	DataSource   string    `json:"data_source"`
+	Started      time.Time `json:"started"`
+	Phase        RunPhase  `json:"phase"`
+	PhaseStarted time.Time `json:"phase_started"`
+	File         string    `json:"file,omitempty"`
+	FileIndex    int       `json:"file_index"`
+	Files        int       `json:"files"`
+	Records      int       `json:"records"`
+	BytesRead    int64     `json:"bytes_read"`
+	BytesTotal   int64     `json:"bytes_total"`
+	Percent      float64   `json:"percent"`
+	ETA          string    `json:"eta,omitempty"`
+	Paused       bool      `json:"paused"`
+	Held         bool      `json:"held"`
+	Stalled      float64   `json:"stalled_seconds"` // the time the current phase has spent paused or held
+	Aborted      bool      `json:"aborted"`
+	DryRun       bool      `json:"dry_run"`
+}
+
+// NewRunControl - create a new run control
+func NewRunControl() *RunControl {
+	c := &RunControl{}
+	c.cond = sync.NewCond(&c.Mutex)
+	return c
+}
+
+// Pause - stop feeding records to the workers
+func (c *RunControl) Pause() {
+	c.Lock()
+	defer c.Unlock()
+	c.stall(func() { c.paused = true })
+}
+
+// Resume - start feeding records to the workers again
+func (c *RunControl) Resume() {
+	c.Lock()
+	defer c.Unlock()
+	c.stall(func() { c.paused = false })
+	c.cond.Broadcast()
+}
+
+// note the reader being held (or released) by backpressure
+func (c *RunControl) setHeld(held bool) {
+	c.Lock()
+	defer c.Unlock()
+	c.stall(func() { c.held = held })
+}
+
+// apply a change to the paused or held state, accounting for the time spent stalled. The caller holds the lock
+func (c *RunControl) stall(change func()) {
+	before := c.paused == true || c.held == true
+	change()
+	after := c.paused == true || c.held == true
+	if before == false && after == true {
+		c.stalledSince = time.Now()
+	} else if before == true && after == false {
+		c.stalled += time.Since(c.stalledSince)
+	}
+}
+
+// Abort - stop the run at the next opportunity
+func (c *RunControl) Abort() {
+	c.Lock()
+	defer c.Unlock()
+	c.aborted = true
+	c.cond.Broadcast()
+}
+
+// Aborted - has the run been aborted
+func (c *RunControl) Aborted() bool {
+	c.Lock()
+	defer c.Unlock()
+	return c.aborted
+}
+
+// WaitIfPaused - block while the run is paused, returns true if the run has been aborted
+func (c *RunControl) WaitIfPaused() bool {
+	c.Lock()
+	defer c.Unlock()
+	for c.paused == true && c.aborted == false {
+		c.cond.Wait()
+	}
+	return c.aborted
+}
+
+func (c *RunControl) setPhase(phase RunPhase) {
+	c.Lock()
+	defer c.Unlock()
+	c.phase = phase
+	c.phaseStarted = time.Now()
+	c.stalled = 0
+	c.stalledSince = c.phaseStarted
+	if phase == PhaseIngest {
+		c.ingestStart = c.phaseStarted
+	}
+}
+
+func (c *RunControl) setFile(ix int, name string) {
+	c.Lock()
+	defer c.Unlock()
+	c.fileIndex = ix
+	c.file = name
+}
+
+func (c *RunControl) setTotals(files int, bytes int64) {
+	c.Lock()
+	defer c.Unlock()
+	c.files = files
+	c.bytesTotal = bytes
+	c.bytesRead = 0
+	c.records = 0
+}
+
+func (c *RunControl) addProgress(records int, bytes int64) {
+	c.Lock()
+	defer c.Unlock()
+	c.records += records
+	c.bytesRead += bytes
+}
+
+// Status - a snapshot of the run state
+func (c *RunControl) Status(summary *RunSummary) RunStatus {
+	c.Lock()
+	defer c.Unlock()
+
+	status := RunStatus{
+		RunId:        summary.RunId,
+		DataSource:   summary.DataSource,
+		Started:      summary.Started,
+		DryRun:       summary.DryRun,
+		Phase:        c.phase,
+		PhaseStarted: c.phaseStarted,
+		File:         c.file,
+		FileIndex:    c.fileIndex,
+		Files:        c.files,
+		Records:      c.records,
+		BytesRead:    c.bytesRead,
+		BytesTotal:   c.bytesTotal,
+		Paused:       c.paused,
+		Held:         c.held,
+		Aborted:      c.aborted,
+	}
+
+	stalled := c.stalled
+	if c.paused == true || c.held == true {
+		stalled += time.Since(c.stalledSince)
+	}
+	status.Stalled = stalled.Seconds()
+
+	if c.bytesTotal != 0 {
+		status.Percent = float64(c.bytesRead) * 100 / float64(c.bytesTotal)
+	}
+
+	// estimate completion of the ingest from the rate so far
+	if c.phase == PhaseIngest && c.bytesRead != 0 && c.paused == false {
+		elapsed := time.Since(c.ingestStart)
+		remaining := time.Duration(float64(elapsed) * float64(c.bytesTotal-c.bytesRead) / float64(c.bytesRead))
+		status.ETA = time.Now().Add(remaining).UTC().Format(time.RFC3339)
+	}
+
+	return status
+}
+
+//
+// end of file
+//
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+)
+
+// the subset of the ingest_runs table returned when listing runs
+type RunLedgerEntry struct {
+	Id           string     `db:"id" json:"id"`
+	DataSource   string     `db:"data_source" json:"data_source"`
+	StartedAt    time.Time  `db:"started_at" json:"started_at"`
+	FinishedAt   *time.Time `db:"finished_at" json:"finished_at,omitempty"`
+	TotalRecords int        `db:"total_records" json:"total_records"`
+	SolrDeleted  int64      `db:"solr_deleted" json:"solr_deleted"`
+	CacheDeleted int64      `db:"cache_deleted" json:"cache_deleted"`
+	Outcome      string     `db:"outcome" json:"outcome"`
+	Error        string     `db:"error" json:"error"`
+}
+
+// write the current state of the run (and its files) to the ledger
+func ledgerSaveRun(summary *RunSummary) error {
+
+	phases, err := json.Marshal(summary.Phases)
+	if err != nil {
+		return err
+	}
+	warnings, err := json.Marshal(append(make([]string, 0, len(summary.Warnings)), summary.Warnings...))
+	if err != nil {
+		return err
+	}
+
+	var ingestAt, finishedAt interface{}
+	if summary.IngestStarted.IsZero() == false {
+		ingestAt = summary.IngestStarted
+	}
+	if summary.Finished.IsZero() == false {
+		finishedAt = summary.Finished
+	}
+
+	err = dbHandle.Transactional(func(tx *dbx.Tx) error {
+
+		params := dbx.Params{
+			"id":                  summary.RunId,
+			"data_source":         summary.DataSource,
+			"inbound_message":     summary.InboundMessage,
+			"started_at":          summary.Started,
+			"ingest_at":           ingestAt,
+			"finished_at":         finishedAt,
+			"total_records":       summary.TotalRecords,
+			"merged_records":      summary.MergedRecords,
+			"bad_records":         summary.BadRecords,
+			"solr_deleted":        summary.SolrDeleted,
+			"cache_deleted":       summary.CacheDeleted,
+			"phase_timings":       string(phases),
+			"outcome":             summary.Outcome,
+			"error":               summary.Error,
+			"phase":               string(summary.CurrentPhase()),
+			"new_collection":      summary.NewCollection,
+			"previous_collection": summary.PreviousCollection,
+			"resume_count":        summary.ResumeCount,
+			"outbound_messages":   summary.OutboundMessages,
+			"warnings":            string(warnings),
+			"spilled":             summary.Spilled,
+			"replayed":            summary.Replayed,
+			"error_queue_count":   summary.ErrorQueueCount,
+		}
+
+		_, err := tx.Upsert("ingest_runs", params, "id").Execute()
+		if err != nil {
+			return err
+		}
+
+		for ix, f := range summary.Files {
+			filtered, err := json.Marshal(f.Filtered)
+			if err != nil {
+				return err
+			}
+			params := dbx.Params{
+				"run_id":       summary.RunId,
+				"file_index":   ix,
+				"bucket":       f.Bucket,
+				"s3_key":       f.Key,
+				"size":         f.Size,
+				"checksum":     f.Checksum,
+				"records":      f.Records,
+				"merged":       f.Merged,
+				"bad":          f.Bad,
+				"duration_ms":  f.Duration.Milliseconds(),
+				"confirmed":    f.Confirmed,
+				"duplicates":   f.Duplicates,
+				"filtered":     string(filtered),
+				"converted":    f.Converted,
+				"invalid_utf8": f.InvalidUtf8,
+			}
+			_, err = tx.Upsert("ingest_run_files", params, "run_id", "file_index").Execute()
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		log.Printf("ERROR: saving run %s to the ledger (%s)", summary.RunId, err.Error())
+	}
+	return err
+}
+
+// when a SOLR collection stopped being referenced by the aliases, the finish of the successful run that
+// replaced it. Returns nil if the ledger does not know
+func ledgerCollectionReplaced(collection string) (*time.Time, error) {
+
+	var replaced sql.NullTime
+	err := dbHandle.NewQuery("SELECT MIN(finished_at) FROM ingest_runs WHERE previous_collection = {:collection} AND outcome = {:outcome}").
+		Bind(dbx.Params{"collection": collection, "outcome": OutcomeSuccess}).
+		Row(&replaced)
+	if err != nil {
+		return nil, err
+	}
+	if replaced.Valid == false {
+		return nil, nil
+	}
+	return &replaced.Time, nil
+}
+
+// the full ingest_runs row, used when resuming a run
+type ledgerRunRow struct {
+	Id                 string     `db:"id"`
+	DataSource         string     `db:"data_source"`
+	InboundMessage     string     `db:"inbound_message"`
+	StartedAt          time.Time  `db:"started_at"`
+	IngestAt           *time.Time `db:"ingest_at"`
+	TotalRecords       int        `db:"total_records"`
+	MergedRecords      int        `db:"merged_records"`
+	BadRecords         int        `db:"bad_records"`
+	SolrDeleted        int64      `db:"solr_deleted"`
+	CacheDeleted       int64      `db:"cache_deleted"`
+	PhaseTimings       string     `db:"phase_timings"`
+	Outcome            string     `db:"outcome"`
+	Error              string     `db:"error"`
+	NewCollection      string     `db:"new_collection"`
+	PreviousCollection string     `db:"previous_collection"`
+	ResumeCount        int        `db:"resume_count"`
+	OutboundMessages   uint64     `db:"outbound_messages"`
+	Warnings           string     `db:"warnings"`
+	Spilled            int        `db:"spilled"`
+	Replayed           int        `db:"replayed"`
+	ErrorQueueCount    uint       `db:"error_queue_count"`
+}
+
+// the ingest_run_files row
+type ledgerFileRow struct {
+	FileIndex   int    `db:"file_index"`
+	Bucket      string `db:"bucket"`
+	Key         string `db:"s3_key"`
+	Size        int64  `db:"size"`
+	Checksum    string `db:"checksum"`
+	Records     int    `db:"records"`
+	Merged      int    `db:"merged"`
+	Bad         int    `db:"bad"`
+	DurationMs  int64  `db:"duration_ms"`
+	Confirmed   int    `db:"confirmed"`
+	Duplicates  int    `db:"duplicates"`
+	Filtered    string `db:"filtered"`
+	Converted   int    `db:"converted"`
+	InvalidUtf8 int    `db:"invalid_utf8"`
+}
+
+// load any runs for our data source that did not complete, most recent first
+func ledgerLoadIncompleteRuns(cfg *ServiceConfig) ([]*RunSummary, error) {
+
+	rows := make([]ledgerRunRow, 0)
+	err := dbHandle.Select("id", "data_source", "inbound_message", "started_at", "ingest_at", "total_records",
+		"merged_records", "bad_records", "solr_deleted", "cache_deleted", "phase_timings",
+		"outcome", "error", "new_collection", "previous_collection", "resume_count", "outbound_messages",
+		"warnings", "spilled", "replayed", "error_queue_count").
+		From("ingest_runs").
+		Where(dbx.HashExp{"outcome": OutcomeRunning, "data_source": cfg.DataSource}).
+		OrderBy("started_at DESC").
+		All(&rows)
+	if err != nil {
+		return nil, err
+	}
+
+	runs := make([]*RunSummary, 0, len(rows))
+	for _, r := range rows {
+		summary := &RunSummary{
+			RunId:              r.Id,
+			DataSource:         r.DataSource,
+			InboundMessage:     r.InboundMessage,
+			Started:            r.StartedAt,
+			TotalRecords:       r.TotalRecords,
+			MergedRecords:      r.MergedRecords,
+			BadRecords:         r.BadRecords,
+			SolrDeleted:        r.SolrDeleted,
+			CacheDeleted:       r.CacheDeleted,
+			Outcome:            r.Outcome,
+			Error:              r.Error,
+			NewCollection:      r.NewCollection,
+			PreviousCollection: r.PreviousCollection,
+			ResumeCount:        r.ResumeCount,
+			OutboundMessages:   r.OutboundMessages,
+			Spilled:            r.Spilled,
+			Replayed:           r.Replayed,
+			ErrorQueueCount:    r.ErrorQueueCount,
+			Files:              make([]FileSummary, 0),
+			Phases:             make([]PhaseTiming, 0),
+		}
+		if r.IngestAt != nil {
+			summary.IngestStarted = *r.IngestAt
+		}
+
+		err = json.Unmarshal([]byte(r.PhaseTimings), &summary.Phases)
+		if err != nil {
+			return nil, err
+		}
+		err = json.Unmarshal([]byte(r.Warnings), &summary.Warnings)
+		if err != nil {
+			return nil, err
+		}
+
+		files := make([]ledgerFileRow, 0)
+		err = dbHandle.Select("file_index", "bucket", "s3_key", "size", "checksum", "records", "merged", "bad",
+			"duration_ms", "confirmed", "duplicates", "filtered", "converted", "invalid_utf8").
+			From("ingest_run_files").
+			Where(dbx.HashExp{"run_id": r.Id}).
+			OrderBy("file_index").
+			All(&files)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, f := range files {
+			ix := summary.AddFile(f.Bucket, f.Key, f.Size, f.Checksum)
+			summary.Files[ix].Records = f.Records
+			summary.Files[ix].Merged = f.Merged
+			summary.Files[ix].Bad = f.Bad
+			summary.Files[ix].Duration = time.Duration(f.DurationMs) * time.Millisecond
+			summary.Files[ix].Confirmed = f.Confirmed
+			summary.Files[ix].Duplicates = f.Duplicates
+			summary.Files[ix].Converted = f.Converted
+			summary.Files[ix].InvalidUtf8 = f.InvalidUtf8
+			err = json.Unmarshal([]byte(f.Filtered), &summary.Files[ix].Filtered)
+			if err != nil {
+				return nil, err
+			}
+		}
+		summary.recalculateTotals()
+
+		runs = append(runs, summary)
+	}
+
+	return runs, nil
+}
+
+// get the most recent runs from the ledger
+func ledgerListRuns(limit int) ([]RunLedgerEntry, error) {
+
+	runs := make([]RunLedgerEntry, 0)
+	err := dbHandle.Select("id", "data_source", "started_at", "finished_at", "total_records",
+		"solr_deleted", "cache_deleted", "outcome", "error").
+		From("ingest_runs").
+		OrderBy("started_at DESC").
+		Limit(int64(limit)).
+		All(&runs)
+
+	return runs, err
+}
+
+//
+// end of file
+//
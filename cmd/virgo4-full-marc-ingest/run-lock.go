@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	dbx "github.com/go-ozzo/ozzo-dbx"
+)
+
+var ErrRunLockLost = fmt.Errorf("run lock connection has been lost")
+
+// an arbitrary key identifying the run locks. Each data source has its own lock, the advisory lock uses the
+// two key form with this as the first key and a hash of the data source as the second
+const runLockKey = 4242002
+
+// the prefix of our rows in the lock table, the data source is appended
+const runLockName = "full-marc-ingest"
+
+// the run lock as it appears in pg_locks; the two keys are classid and objid with an objsubid of 2
+const runLockHeldQuery = "SELECT EXISTS (SELECT 1 FROM pg_locks WHERE locktype = 'advisory' AND classid = $1 AND objid = $2 AND objsubid = 2 AND granted AND pid = $3)"
+
+// RunLock - a distributed lock held while a run has the managed services stopped
+type RunLock struct {
+	sync.Mutex
+	conn   *sql.Conn     // the dedicated connection holding the advisory lock
+	key    int           // the data source part of the advisory lock key
+	name   string        // our row in the lock table
+	holder string        // our holder identity
+	pid    int           // the backend pid of our session
+	done   chan struct{} // closed when the lock is released
+}
+
+// the holder details from the lock table
+type runLockHolder struct {
+	Holder      string    `db:"holder"`
+	RunId       string    `db:"run_id"`
+	Pid         int       `db:"backend_pid"`
+	AcquiredAt  time.Time `db:"acquired_at"`
+	HeartbeatAt time.Time `db:"heartbeat_at"`
+}
+
+// identify ourselves as a lock holder
+func runLockIdentity() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s/%d", host, os.Getpid())
+}
+
+// the data source part of the advisory lock key and the name of the lock table row. Instances ingesting
+// different data sources do not stop each other's services so they do not share a lock
+func runLockFor(dataSource string) (int, string) {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(dataSource))
+	// pg_locks reports the keys as oids, keep it positive so it compares the same either way
+	key := int(h.Sum32() & 0x7fffffff)
+	name := fmt.Sprintf("%s/%s", runLockName, dataSource)
+	if len(name) > 64 {
+		name = fmt.Sprintf("%s/%08x", runLockName, key)
+	}
+	return key, name
+}
+
+// acquire the run lock for our data source, waiting for any other holder to release it
+func acquireRunLock(cfg *ServiceConfig, runId string) (*RunLock, error) {
+
+	ctx := context.Background()
+
+	// advisory locks belong to a session so we need a connection of our own
+	conn, err := dbHandle.DB().Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	lock := &RunLock{conn: conn, holder: runLockIdentity(), done: make(chan struct{})}
+	lock.key, lock.name = runLockFor(cfg.DataSource)
+	for {
+		var acquired bool
+		err = conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1, $2)", runLockKey, lock.key).Scan(&acquired)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+
+		if acquired == true {
+			break
+		}
+
+		// someone else has it, find out who and whether they are still alive
+		current := runLockHolder{}
+		err = dbHandle.Select("holder", "run_id", "backend_pid", "acquired_at", "heartbeat_at").
+			From("ingest_run_lock").
+			Where(dbx.HashExp{"name": lock.name}).
+			One(&current)
+		if err != nil && err != sql.ErrNoRows {
+			conn.Close()
+			return nil, err
+		}
+
+		if err == nil {
+			stale := time.Since(current.HeartbeatAt)
+			if stale >= time.Duration(cfg.RunLockStaleTimeout)*time.Second {
+				log.Printf("WARNING: run lock held by %s (run %s) has not had a heartbeat for %0.0f seconds, assuming it is stale", current.Holder, current.RunId, stale.Seconds())
+				terminateLockHolder(lock.key, current.Pid)
+			} else {
+				log.Printf("INFO: run %s waiting on run lock held by %s (run %s) since %s", runId, current.Holder, current.RunId, current.AcquiredAt.UTC())
+			}
+		} else {
+			log.Printf("INFO: run %s waiting on run lock held by an unknown holder", runId)
+		}
+
+		time.Sleep(time.Duration(cfg.RunLockPollTime) * time.Second)
+	}
+
+	// we have the lock, tell everyone else who we are
+	err = conn.QueryRowContext(ctx, "SELECT pg_backend_pid()").Scan(&lock.pid)
+	if err != nil {
+		lock.Release()
+		return nil, err
+	}
+
+	now := time.Now()
+	_, err = dbHandle.Upsert("ingest_run_lock", dbx.Params{
+		"name":         lock.name,
+		"holder":       lock.holder,
+		"run_id":       runId,
+		"backend_pid":  lock.pid,
+		"acquired_at":  now,
+		"heartbeat_at": now,
+	}, "name").Execute()
+	if err != nil {
+		lock.Release()
+		return nil, err
+	}
+
+	log.Printf("INFO: run %s acquired run lock %s as %s", runId, lock.name, lock.holder)
+	go lock.heartbeat(time.Duration(cfg.RunLockHeartbeat) * time.Second)
+	return lock, nil
+}
+
+// periodically update our heartbeat until the lock is released
+func (l *RunLock) heartbeat(interval time.Duration) {
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-time.After(interval):
+		}
+
+		l.Lock()
+		if l.conn == nil {
+			l.Unlock()
+			return
+		}
+
+		// make sure our session still holds the lock, we cannot carry on without it
+		var held bool
+		err := l.conn.QueryRowContext(context.Background(), runLockHeldQuery, runLockKey, l.key, l.pid).Scan(&held)
+		l.Unlock()
+		if err == nil && held == false {
+			err = fmt.Errorf("advisory lock no longer held by session %d", l.pid)
+		}
+		if err != nil {
+			log.Printf("ERROR: %s (%s)", ErrRunLockLost.Error(), err.Error())
+			fatalIfError(fmt.Errorf("%w: %s", ErrRunLockLost, err.Error()))
+		}
+
+		_, err = dbHandle.Update("ingest_run_lock", dbx.Params{"heartbeat_at": time.Now()},
+			dbx.HashExp{"name": l.name, "holder": l.holder}).Execute()
+		if err != nil {
+			log.Printf("WARNING: run lock heartbeat failed (%s)", err.Error())
+		}
+	}
+}
+
+// Release - release the run lock
+func (l *RunLock) Release() {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.conn == nil {
+		return
+	}
+
+	close(l.done)
+
+	// remove our holder details first so nobody mistakes our session for a live holder
+	_, err := dbHandle.Delete("ingest_run_lock", dbx.HashExp{"name": l.name, "holder": l.holder}).Execute()
+	if err != nil {
+		log.Printf("WARNING: clearing run lock holder (%s)", err.Error())
+	}
+
+	_, err = l.conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1, $2)", runLockKey, l.key)
+	if err != nil {
+		log.Printf("WARNING: releasing run lock (%s)", err.Error())
+	}
+	l.conn.Close()
+	l.conn = nil
+	log.Printf("INFO: released run lock")
+}
+
+// terminate the database session of a stale lock holder, this releases its lock. The pid may have been
+// reused by an unrelated session so we make sure it actually holds the lock first
+func terminateLockHolder(key int, pid int) {
+
+	if pid == 0 {
+		return
+	}
+
+	var held bool
+	err := dbHandle.DB().QueryRow(runLockHeldQuery, runLockKey, key, pid).Scan(&held)
+	if err != nil {
+		log.Printf("ERROR: checking stale run lock holder session %d (%s)", pid, err.Error())
+		return
+	}
+	if held == false {
+		log.Printf("WARNING: stale run lock holder session %d does not hold the lock, not terminating it", pid)
+		return
+	}
+
+	var terminated bool
+	err = dbHandle.NewQuery("SELECT pg_terminate_backend({:pid})").Bind(dbx.Params{"pid": pid}).Row(&terminated)
+	if err != nil {
+		log.Printf("ERROR: terminating stale run lock holder session %d (%s)", pid, err.Error())
+		return
+	}
+	log.Printf("INFO: terminated stale run lock holder session %d (%t)", pid, terminated)
+}
+
+//
+// end of file
+//
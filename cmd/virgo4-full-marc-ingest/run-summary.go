@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// RunPhase - the phases of an ingest run
+type RunPhase string
+
+const (
+	PhaseDownload     RunPhase = "download"
+	PhaseValidate     RunPhase = "validate"
+	PhaseStopServices RunPhase = "stop-services"
+	PhaseIdleWait     RunPhase = "idle-wait"
+	PhaseIngest       RunPhase = "ingest"
+	PhaseDrain        RunPhase = "drain"
+	PhaseDeletes      RunPhase = "deletes"
+	PhaseRestart      RunPhase = "restart"
+)
+
+// run outcomes
+const (
+	OutcomeRunning = "running"
+	OutcomeSuccess = "success"
+	OutcomeInvalid = "invalid"
+	OutcomeFailed  = "failed"
+	OutcomeAborted = "aborted"
+)
+
+// FileSummary - the summary of a single ingested file
+type FileSummary struct {
+	Bucket      string         // the S3 bucket
+	Key         string         // the S3 key
+	RemoteName  string         // the S3 name of the file
+	Size        int64          // the file size
+	Checksum    string         // the SHA256 checksum of the file
+	Records     int            // the number of records ingested
+	Merged      int            // the number of records merged into a previous record
+	Bad         int            // the number of malformed records recovered by the loader
+	Duplicates  int            // the number of records with an id seen earlier in the file (if reporting)
+	Filtered    map[string]int `json:",omitempty"` // the number of records excluded by each filter rule
+	Converted   int            // the number of MARC-8 records converted to UTF-8
+	InvalidUtf8 int            // the number of Unicode records containing invalid UTF-8
+	Duration    time.Duration  // the time taken to ingest the file
+	Confirmed   int            // the number of records confirmed as sent (used when resuming)
+	LocalName   string         `json:"-"` // the local file name once downloaded
+}
+
+// PhaseTiming - the timing of a single run phase
+type PhaseTiming struct {
+	Phase    RunPhase      // the phase
+	Started  time.Time     // when it started
+	Duration time.Duration // how long it took
+}
+
+// RunSummary - the summary of a complete ingest run
+type RunSummary struct {
+	RunId          string         // the run identifier
+	DataSource     string         // the configured data source
+	InboundMessage string         // the inbound notification that started the run
+	Started        time.Time      // when the run started
+	IngestStarted  time.Time      // when ingest started
+	Finished       time.Time      // when the run finished
+	Files          []FileSummary  // the files ingested
+	Phases         []PhaseTiming  // the phase timings
+	TotalRecords   int            // the total number of records ingested
+	MergedRecords  int            // the total number of records merged
+	BadRecords     int            // the total number of malformed records recovered
+	Duplicates     int            // the total number of duplicate records (if reporting)
+	Filtered       map[string]int // the total number of records excluded by each filter rule
+	Converted      int            // the total number of MARC-8 records converted to UTF-8
+	InvalidUtf8    int            // the total number of Unicode records containing invalid UTF-8
+	Spilled        int            // the number of records that could not be sent and were spilled
+	Replayed       int            // the number of spilled records resent at the end of the run
+	SolrDeleted    int64          // the number of SOLR records deleted (where known)
+	CacheDeleted   int64          // the number of cache records deleted
+	Outcome        string         // the run outcome
+	Error          string         // the error that ended the run (if any)
+
+	NewCollection      string   // the SOLR collection created for this run (if swapping collections)
+	PreviousCollection string   // the SOLR collection previously referenced by the write alias
+	ResumeCount        int      // the number of times this run has been resumed
+	ErrorQueueCount    uint     // the number of items in the error queue at the end of the run
+	OutboundMessages   uint64   // the number of outbound messages sent (work and cache queues)
+	DryRun             bool     // this was a dry run, deletes are counts of what would have been deleted
+	Warnings           []string // problems that did not stop the run
+}
+
+// NewRunSummary - create a new run summary
+func NewRunSummary(dataSource string, inboundMessage string, dryRun bool) *RunSummary {
+	return &RunSummary{
+		RunId:          newRunId(),
+		DataSource:     dataSource,
+		InboundMessage: inboundMessage,
+		Started:        time.Now(),
+		Files:          make([]FileSummary, 0),
+		Phases:         make([]PhaseTiming, 0),
+		Outcome:        OutcomeRunning,
+		DryRun:         dryRun,
+	}
+}
+
+// generate a new run identifier; timestamp based so they sort sensibly
+func newRunId() string {
+	buf := make([]byte, 4)
+	_, _ = rand.Read(buf)
+	return fmt.Sprintf("%s-%s", time.Now().UTC().Format("20060102150405"), hex.EncodeToString(buf))
+}
+
+// StartPhase - note the start of a new phase, ending the current one
+func (s *RunSummary) StartPhase(phase RunPhase) {
+	s.EndPhase()
+	s.Phases = append(s.Phases, PhaseTiming{Phase: phase, Started: time.Now()})
+}
+
+// EndPhase - note the end of the current phase (if any)
+func (s *RunSummary) EndPhase() {
+	if len(s.Phases) != 0 {
+		current := &s.Phases[len(s.Phases)-1]
+		if current.Duration == 0 {
+			current.Duration = time.Since(current.Started)
+		}
+	}
+}
+
+// CurrentPhase - the current phase of the run
+func (s *RunSummary) CurrentPhase() RunPhase {
+	if len(s.Phases) == 0 {
+		return ""
+	}
+	return s.Phases[len(s.Phases)-1].Phase
+}
+
+// AddFile - add a file to the run, returns its index
+func (s *RunSummary) AddFile(bucket string, key string, size int64, checksum string) int {
+	s.Files = append(s.Files, FileSummary{
+		Bucket:     bucket,
+		Key:        key,
+		RemoteName: fmt.Sprintf("%s/%s", bucket, key),
+		Size:       size,
+		Checksum:   checksum})
+	return len(s.Files) - 1
+}
+
+// FileDone - note that a file has been ingested
+func (s *RunSummary) FileDone(ix int, records int, merged int, bad int, duplicates int, filtered map[string]int, converted int, invalidUtf8 int, duration time.Duration) {
+	f := &s.Files[ix]
+	f.Records = records
+	f.Merged = merged
+	f.Bad = bad
+	f.Duplicates = duplicates
+	f.Filtered = filtered
+	f.Converted = converted
+	f.InvalidUtf8 = invalidUtf8
+	f.Duration = duration
+	s.recalculateTotals()
+}
+
+// recalculate the totals from the files, a resumed run may already have some
+func (s *RunSummary) recalculateTotals() {
+	s.TotalRecords, s.MergedRecords, s.BadRecords, s.Duplicates = 0, 0, 0, 0
+	s.Converted, s.InvalidUtf8 = 0, 0
+	s.Filtered = nil
+	for _, f := range s.Files {
+		s.TotalRecords += f.Records
+		s.MergedRecords += f.Merged
+		s.BadRecords += f.Bad
+		s.Duplicates += f.Duplicates
+		s.Converted += f.Converted
+		s.InvalidUtf8 += f.InvalidUtf8
+		for rule, count := range f.Filtered {
+			if s.Filtered == nil {
+				s.Filtered = make(map[string]int)
+			}
+			s.Filtered[rule] += count
+		}
+	}
+}
+
+// Complete - note the end of the run
+func (s *RunSummary) Complete(outcome string, err error) {
+	s.EndPhase()
+	s.Finished = time.Now()
+	s.Outcome = outcome
+	if err != nil {
+		s.Error = err.Error()
+	}
+}
+
+// Copy - a deep copy of the summary
+func (s *RunSummary) Copy() *RunSummary {
+	c := *s
+	c.Files = append(make([]FileSummary, 0, len(s.Files)), s.Files...)
+	for ix := range c.Files {
+		c.Files[ix].Filtered = copyCounts(s.Files[ix].Filtered)
+	}
+	c.Phases = append(make([]PhaseTiming, 0, len(s.Phases)), s.Phases...)
+	c.Filtered = copyCounts(s.Filtered)
+	c.Warnings = append([]string(nil), s.Warnings...)
+	return &c
+}
+
+func copyCounts(counts map[string]int) map[string]int {
+	if counts == nil {
+		return nil
+	}
+	c := make(map[string]int, len(counts))
+	for k, v := range counts {
+		c[k] = v
+	}
+	return c
+}
+
+// Lines - the run summary as human readable lines
+func (s *RunSummary) Lines() []string {
+
+	lines := make([]string, 0, len(s.Files)+len(s.Phases)+8)
+	if s.DryRun == true {
+		lines = append(lines, fmt.Sprintf("run %s summary (%s): %s (DRY RUN)", s.RunId, s.DataSource, s.Outcome))
+	} else {
+		lines = append(lines, fmt.Sprintf("run %s summary (%s): %s", s.RunId, s.DataSource, s.Outcome))
+	}
+	if s.Error != "" {
+		lines = append(lines, fmt.Sprintf("  error: %s", s.Error))
+	}
+	for _, w := range s.Warnings {
+		lines = append(lines, fmt.Sprintf("  warning: %s", w))
+	}
+	for _, f := range s.Files {
+		lines = append(lines, fmt.Sprintf("  file %s (%d bytes): %d records (%d merged, %d bad, %d duplicate) in %0.2f seconds", f.RemoteName, f.Size, f.Records, f.Merged, f.Bad, f.Duplicates, f.Duration.Seconds()))
+	}
+	for _, p := range s.Phases {
+		lines = append(lines, fmt.Sprintf("  phase %-14s %0.2f seconds", p.Phase, p.Duration.Seconds()))
+	}
+	deleted := "deleted:  "
+	if s.DryRun == true {
+		deleted = "to delete:"
+	}
+	lines = append(lines, fmt.Sprintf("  total records ingested: %d", s.TotalRecords))
+	rules := make([]string, 0, len(s.Filtered))
+	for rule := range s.Filtered {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+	for _, rule := range rules {
+		lines = append(lines, fmt.Sprintf("  records filtered by %s: %d", rule, s.Filtered[rule]))
+	}
+	if s.Converted != 0 {
+		lines = append(lines, fmt.Sprintf("  MARC-8 records converted: %d", s.Converted))
+	}
+	if s.InvalidUtf8 != 0 {
+		lines = append(lines, fmt.Sprintf("  records with invalid UTF-8: %d", s.InvalidUtf8))
+	}
+	lines = append(lines, fmt.Sprintf("  SOLR records %s %d", deleted, s.SolrDeleted))
+	lines = append(lines, fmt.Sprintf("  cache records %s %d", deleted, s.CacheDeleted))
+	lines = append(lines, fmt.Sprintf("  outbound messages sent: %d", s.OutboundMessages))
+	if s.Spilled != 0 {
+		lines = append(lines, fmt.Sprintf("  records spilled:        %d (%d resent)", s.Spilled, s.Replayed))
+	}
+	lines = append(lines, fmt.Sprintf("  error queue count:      %d", s.ErrorQueueCount))
+	if s.Finished.IsZero() == false {
+		lines = append(lines, fmt.Sprintf("  elapsed time:           %0.2f seconds", s.Finished.Sub(s.Started).Seconds()))
+	}
+	return lines
+}
+
+// Warn - note a problem that did not stop the run
+func (s *RunSummary) Warn(warning string) {
+	s.Warnings = append(s.Warnings, warning)
+}
+
+// Log - log the run summary
+func (s *RunSummary) Log() {
+	for _, line := range s.Lines() {
+		log.Printf("INFO: %s", line)
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,1213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/uvalib/uva-aws-s3-sdk/uva-s3"
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var ErrChecksumMismatch = fmt.Errorf("downloaded file checksum does not match the original")
+var ErrRunAbandoned = fmt.Errorf("run was interrupted before it could be resumed")
+var ErrTooManyResumes = fmt.Errorf("run has been resumed too many times")
+var ErrRunAborted = fmt.Errorf("run aborted by request")
+
+// how often we save the ingest progress so an interrupted run can be resumed
+var checkpointInterval = 30 * time.Second
+
+// the phases a run goes through once the inbound files have been downloaded and validated, in order.
+// A run interrupted during one of these phases can be resumed
+var resumablePhases = []RunPhase{
+	PhaseStopServices,
+	PhaseIdleWait,
+	PhaseIngest,
+	PhaseDrain,
+	PhaseDeletes,
+	PhaseRestart,
+}
+
+// IngestRun - a single ingest run. The run state (the summary, the file positions and the spans) is only
+// changed by the goroutine processing the run and it does so holding the state lock. Anything else (the
+// HTTP handlers and the fatal error hook, which can run on a worker) reads a copy taken under the lock
+type IngestRun struct {
+	Summary *RunSummary // the run summary, also the persisted run state
+	state   sync.Mutex  // guards the run state
+
+	cfg     *ServiceConfig
+	aws     awssqs.AWS_SQS
+	s3Svc   uva_s3.UvaS3
+	records chan<- Record
+	tracker *RecordTracker
+	control *RunControl
+
+	fileStart      []uint64      // the tracker sequence of the first record read from each file
+	filePos        []int         // the number of records read from each file
+	ingestedIds    *IdSpool      // the ids ingested during this run (if reconciling deletes)
+	hashes         *IdSpool      // the ids and hashes ingested during this run (if saving a hash store)
+	hashCount      int           // the number of records added to the hash store
+	lastCheckpoint time.Time     // when we last saved our progress
+	ingesting      bool          // this process has ingested records for the run
+	backpressure   *Backpressure // holds the reader while the outbound queues are backed up (if configured)
+	messageBase    uint64        // the tracker message count when this process started ingesting
+	priorMessages  uint64        // the outbound messages sent before we were resumed
+	promoted       bool          // the new SOLR collection has been promoted and is in use
+
+	traceCtx  context.Context // the run span context
+	runSpan   trace.Span      // the run span
+	phaseCtx  context.Context // the current phase span context
+	phaseSpan trace.Span      // the current phase span
+}
+
+// the run currently in progress (if any)
+var activeRun *IngestRun
+var activeRunLock sync.Mutex
+
+func setActiveRun(run *IngestRun) {
+	activeRunLock.Lock()
+	defer activeRunLock.Unlock()
+	activeRun = run
+}
+
+func getActiveRun() *IngestRun {
+	activeRunLock.Lock()
+	defer activeRunLock.Unlock()
+	return activeRun
+}
+
+// NewIngestRun - create a new ingest run
+func NewIngestRun(cfg *ServiceConfig, aws awssqs.AWS_SQS, s3Svc uva_s3.UvaS3, records chan<- Record, tracker *RecordTracker, summary *RunSummary) *IngestRun {
+	return &IngestRun{
+		Summary: summary,
+		cfg:     cfg,
+		aws:     aws,
+		s3Svc:   s3Svc,
+		records: records,
+		tracker: tracker,
+		control: NewRunControl(),
+	}
+}
+
+// Prepare - download and validate the inbound files. Returns false if the files are invalid
+func (r *IngestRun) Prepare(inbound []InboundFile) bool {
+
+	setActiveRun(r)
+	setLogContext(LogContext{RunId: r.Summary.RunId, DataSource: r.Summary.DataSource})
+	r.startTrace()
+	log.Printf("INFO: starting run %s", r.Summary.RunId)
+	r.save()
+
+	// download each file
+	r.startPhase(PhaseDownload)
+	for _, f := range inbound {
+
+		// VIRGONEW-2419
+		if f.ObjectSize == 0 {
+			log.Printf("INFO: notification is reporting %s/%s is ZERO length, ignoring", f.SourceBucket, f.SourceKey)
+			continue
+		}
+
+		ix := 0
+		r.update(func() { ix = r.Summary.AddFile(f.SourceBucket, f.SourceKey, f.ObjectSize, "") })
+		_, span := r.startFileSpan("download", ix)
+		err := r.download(ix)
+		endSpan(span, err)
+		fatalIfError(err)
+	}
+
+	// validate each file
+	r.startPhase(PhaseValidate)
+	for ix, file := range r.Summary.Files {
+
+		setLogContextFile(file.RemoteName)
+		_, span := r.startFileSpan("validate", ix)
+		log.Printf("INFO: validating %s (%s)", file.RemoteName, file.LocalName)
+
+		// create a new loader
+		loader, err := NewRecordLoader(r.cfg.DataSource, file.RemoteName, file.LocalName)
+		fatalIfError(err)
+
+		// validate the file
+		err = loader.Validate()
+		if err == nil && r.cfg.DuplicatePolicy == DuplicatesReject {
+			err = r.rejectDuplicates(ix, loader)
+		}
+		loader.Done()
+		endSpan(span, err)
+		setLogContextFile("")
+		if err == nil {
+			log.Printf("INFO: %s (%s) appears to be OK, ready for ingest", file.RemoteName, file.LocalName)
+			continue
+		}
+
+		log.Printf("ERROR: %s (%s) appears to be invalid, ignoring it (%s)", file.RemoteName, file.LocalName, err.Error())
+
+		// one of the files was invalid, we need to ignore the entire batch and delete the local files
+		r.removeLocalFiles()
+		r.update(func() { r.Summary.Complete(OutcomeInvalid, err) })
+		r.finish()
+		return false
+	}
+
+	notifyRun(NotifyStart, r.Summary, "")
+	return true
+}
+
+// Process - process the run starting at the specified phase
+func (r *IngestRun) Process(from RunPhase) {
+
+	setActiveRun(r)
+	setLogContext(LogContext{RunId: r.Summary.RunId, DataSource: r.Summary.DataSource})
+	r.startTrace()
+
+	// make sure nobody else is running while we have the services stopped
+	if r.cfg.RunLock == true {
+		lock, err := acquireRunLock(r.cfg, r.Summary.RunId)
+		fatalIfError(err)
+		defer lock.Release()
+	}
+
+	// if we are resuming, the services have already been stopped
+	servicesStopped := from != PhaseStopServices
+
+	started := false
+	for _, phase := range resumablePhases {
+		if phase == from {
+			started = true
+		}
+		if started == false {
+			continue
+		}
+
+		// an aborted run skips straight to restarting the services
+		if r.control.Aborted() == true {
+			log.Printf("WARNING: run %s aborted during %s", r.Summary.RunId, r.Summary.CurrentPhase())
+			r.stop(servicesStopped, OutcomeAborted, ErrRunAborted)
+			return
+		}
+
+		r.startPhase(phase)
+		r.save()
+
+		switch phase {
+		case PhaseStopServices:
+			// disable the ingest services
+			if r.cfg.DryRun == true {
+				log.Printf("INFO: DRY RUN, not stopping %s", strings.Join(r.cfg.ManagedECSServices, " "))
+				break
+			}
+			servicesStopped = true
+			err := stopManagedServices(r.cfg.ECSClusterName, r.cfg.ManagedECSServices)
+			fatalIfError(err)
+
+		case PhaseIdleWait:
+			// wait until the work queues are idle, during a dry run the services are not stopped so they may never be
+			if r.cfg.DryRun == true {
+				log.Printf("INFO: DRY RUN, not waiting for idle queues")
+				break
+			}
+			err := ensureQueuesIdle(r.aws, r.cfg.WaitIdleQueues, int(r.cfg.PollTimeOut), r.cfg.WaitForIdleStart)
+			fatalIfError(err)
+
+		case PhaseIngest:
+			r.ingest()
+
+		case PhaseDrain:
+			r.drain()
+
+		case PhaseDeletes:
+			err := r.deletes()
+			if err != nil {
+				r.stop(servicesStopped, OutcomeFailed, err)
+				return
+			}
+
+		case PhaseRestart:
+			// re-enable the ingest services
+			if r.cfg.DryRun == true {
+				log.Printf("INFO: DRY RUN, not starting %s", strings.Join(r.cfg.ManagedECSServices, " "))
+				break
+			}
+			err := startManagedServices(r.cfg.ECSClusterName, r.cfg.ManagedECSServices)
+			fatalIfError(err)
+		}
+	}
+
+	r.update(func() { r.Summary.Complete(OutcomeSuccess, nil) })
+	r.finish()
+}
+
+// stop a run early without (any more) deletes, restarting the services if we stopped them. The run
+// cannot be resumed
+func (r *IngestRun) stop(servicesStopped bool, outcome string, err error) {
+
+	// let the workers send anything already queued
+	for r.tracker.Pending() != 0 {
+		log.Printf("INFO: waiting for all records to be queued (%d remain)", r.tracker.Pending())
+		time.Sleep(flushTimeout)
+	}
+	r.checkpoint()
+
+	// the indexers must not be left writing to a collection that will never be promoted
+	if r.abandonCollection(r.Summary) == true {
+		r.update(func() { r.Summary.NewCollection = "" })
+	}
+
+	if servicesStopped == true && r.cfg.DryRun == false {
+		r.startPhase(PhaseRestart)
+		restartErr := startManagedServices(r.cfg.ECSClusterName, r.cfg.ManagedECSServices)
+		if restartErr != nil {
+			log.Printf("ERROR: restarting services after %s run (%s)", outcome, restartErr.Error())
+		}
+	}
+
+	r.update(func() { r.Summary.Complete(outcome, err) })
+	r.finish()
+}
+
+// Fail - note a fatal error. If we can resume the run later we leave it running. This is called by the
+// fatal error hook, possibly on a worker while the run goroutine carries on, so it works with a copy of
+// the run state
+func (r *IngestRun) Fail(err error) {
+
+	r.state.Lock()
+	summary := r.Summary.Copy()
+	r.confirm(summary)
+	ids := r.spoolNames()
+	r.state.Unlock()
+
+	// the run has already finished
+	if summary.Outcome != OutcomeRunning {
+		return
+	}
+
+	if r.cfg.ResumeRuns == true && isResumable(summary.CurrentPhase()) == true {
+		log.Printf("INFO: run %s interrupted during %s, it will be resumed on restart", summary.RunId, summary.CurrentPhase())
+		summary.Error = err.Error()
+		r.saveSummary(summary)
+		notifyRun(NotifyFailure, summary, fmt.Sprintf("interrupted during %s, it will be resumed", summary.CurrentPhase()))
+		r.endTrace(summary, err)
+		return
+	}
+
+	// we are about to exit so the id lists are removed without closing them
+	for _, name := range ids {
+		_ = os.Remove(name)
+	}
+	if r.abandonCollection(summary) == true {
+		summary.NewCollection = ""
+	}
+	summary.Complete(OutcomeFailed, err)
+	r.finishSummary(summary)
+}
+
+// abandon the SOLR collection created for a run that will not succeed, restoring the write alias so the
+// indexers go back to the collection in use. Returns true if the collection was abandoned
+func (r *IngestRun) abandonCollection(summary *RunSummary) bool {
+
+	r.state.Lock()
+	promoted := r.promoted
+	r.state.Unlock()
+
+	if summary.NewCollection == "" || promoted == true {
+		return false
+	}
+
+	log.Printf("INFO: abandoning SOLR collection %s, restoring %s", summary.NewCollection, summary.PreviousCollection)
+	abandonIngestCollection(r.cfg, summary.NewCollection, summary.PreviousCollection)
+	return true
+}
+
+func (r *IngestRun) ingest() {
+
+	// if we are swapping collections, create the new collection and point the indexers at it
+	if r.cfg.SolrCollectionSwap == true && r.cfg.DryRun == false && r.Summary.NewCollection == "" {
+		collection, previous, err := createIngestCollection(r.cfg)
+		fatalIfError(err)
+		r.update(func() { r.Summary.NewCollection, r.Summary.PreviousCollection = collection, previous })
+		r.save()
+	}
+
+	// once processing is complete, we will delete old records so we need to capture the time we start. If we
+	// are resuming, we keep the original time
+	if r.Summary.IngestStarted.IsZero() {
+		r.update(func() { r.Summary.IngestStarted = time.Now() })
+		//r.Summary.IngestStarted = time.Date(2018, 0, 1, 0, 0, 0, 0, time.UTC)
+		r.save()
+	}
+
+	r.update(func() {
+		r.fileStart = make([]uint64, len(r.Summary.Files))
+		r.filePos = make([]int, len(r.Summary.Files))
+		r.ingesting = true
+		r.messageBase = r.tracker.Messages()
+		r.priorMessages = r.Summary.OutboundMessages
+	})
+	r.lastCheckpoint = time.Now()
+
+	// if we are reconciling deletes or saving a hash store, we need to keep a list of the record ids we ingest
+	r.newIngestedIds()
+
+	// hold the reader if the outbound queues back up
+	if r.cfg.DryRun == false {
+		r.backpressure = NewBackpressure(r.cfg, r.aws)
+	}
+	if r.backpressure != nil {
+		r.backpressure.Start()
+		defer func() {
+			r.backpressure.Stop()
+			r.backpressure = nil
+		}()
+	}
+
+	total := int64(0)
+	for _, f := range r.Summary.Files {
+		total += f.Size
+	}
+	r.control.setTotals(len(r.Summary.Files), total)
+
+	// now we can process each of the inbound files
+	for ix := range r.Summary.Files {
+
+		f := r.Summary.Files[ix]
+		if r.control.Aborted() == true {
+			break
+		}
+
+		// a file completely ingested before we were interrupted can be ignored unless we need its ids
+		if f.Duration != 0 && f.Confirmed >= f.Records && r.ingestedIds == nil && r.hashes == nil {
+			log.Printf("INFO: %s already ingested, skipping it", f.RemoteName)
+			r.control.addProgress(f.Records, f.Size)
+			continue
+		}
+
+		r.ingestFile(ix, f.Confirmed, true)
+	}
+}
+
+// read the records from a file, optionally sending them to the workers. Records before the skip point have
+// already been sent and are only read
+func (r *IngestRun) ingestFile(ix int, skip int, send bool) {
+
+	file := &r.Summary.Files[ix]
+	err := r.ensureLocal(ix)
+	fatalIfError(err)
+
+	start := time.Now()
+	if skip != 0 {
+		log.Printf("INFO: processing %s (%s), resuming after record %d", file.RemoteName, file.LocalName, skip)
+	} else {
+		log.Printf("INFO: processing %s (%s)", file.RemoteName, file.LocalName)
+	}
+
+	loader, err := NewRecordLoader(r.cfg.DataSource, file.RemoteName, file.LocalName)
+	// fatal fail here because we have already validated the file and believe it to be correct so this
+	// is some other sort of failure
+	fatalIfError(err)
+
+	r.update(func() { r.filePos[ix] = 0 })
+	setLogContextFile(file.RemoteName)
+	defer setLogContextFile("")
+	if send == true {
+		r.control.setFile(ix, file.RemoteName)
+	}
+
+	// outbound batches are traced under the file they came from
+	fileCtx, span := r.startFileSpan("ingest-file", ix)
+	span.SetAttributes(attribute.Bool("file.send", send), attribute.Int("file.skip", skip))
+	if send == true {
+		setBatchContext(fileCtx)
+	}
+
+	// locate the ids repeated within the file so the duplicate policy can be applied
+	var dups *DuplicateIds
+	if r.cfg.DuplicatePolicy != DuplicatesSendAll && r.cfg.DuplicatePolicy != DuplicatesReject {
+		dups, err = scanDuplicateIds(r.cfg.DownloadDir, loader)
+		fatalIfError(err)
+		if send == true && len(dups.Ids) != 0 {
+			log.Printf("WARNING: %s contains %d repeated ids, keeping %s", file.RemoteName, len(dups.Ids), r.cfg.DuplicatePolicy)
+			dups.Log(file.RemoteName)
+			err = saveDuplicateReport(r.cfg, r.s3Svc, r.Summary.RunId, ix, dups)
+			fatalIfError(err)
+		}
+	}
+
+	// the copies of repeated ids appended to the first when merging are read separately
+	var merger RecordLoader
+	if dups != nil && r.cfg.DuplicatePolicy == DuplicatesMerge && len(dups.Ids) != 0 {
+		merger, err = NewRecordLoader(r.cfg.DataSource, file.RemoteName, file.LocalName)
+		fatalIfError(err)
+		defer merger.Done()
+	}
+
+	// the run report includes the duplicate ids in each file
+	var fileIds *IdSpool
+	if send == true && r.cfg.RunReport == true && dups == nil {
+		fileIds, err = NewIdSpool(r.cfg.DownloadDir, "file-ids-*")
+		fatalIfError(err)
+		defer fileIds.Remove()
+	}
+
+	// the records excluded by each filter rule
+	filtered := make(map[string]int)
+
+	// get the first record
+	count, merged, bad, index := 0, 0, 0, -1
+	converted, invalidUtf8 := 0, 0
+	rec, err := loader.First(true)
+	if err != nil {
+		// are we done
+		if err == io.EOF {
+			log.Printf("WARNING: EOF on first read, unexpected empty file")
+		} else {
+			// fatal fail here because we have already validated the file and believe it to be correct so this
+			// is some other sort of failure
+			fatalIfError(err)
+		}
+	}
+
+	// we can get here with an error if the first read yields EOF
+	if err == nil {
+		for {
+
+			// stop feeding the workers while the outbound queues are backed up or we are paused
+			if send == true && r.backpressure != nil {
+				r.backpressure.Wait(r.control)
+			}
+			if send == true && r.control.WaitIfPaused() == true {
+				log.Printf("INFO: run aborted, stopping processing of %s", file.RemoteName)
+				break
+			}
+
+			// here we overwrite the record source if configured to do so, otherwise we use the
+			// one from the loader, determined by the filename.
+
+			if r.cfg.DataSource != "" {
+				rec.SetSource(r.cfg.DataSource)
+			}
+
+			// the hash store holds records as they were loaded so the diff command, which reads the dump
+			// itself, can compare against it. Merging, conversion and transforms all change the record
+			r.addHash(rec)
+
+			// records dropped by the duplicate policy or excluded by a filter rule are never counted
+			index++
+			if r.dropRecord(rec, index, dups, merger, filtered, send == true && count >= skip) == true {
+				rec, err = loader.Next(true)
+				if err == io.EOF {
+					break
+				}
+				fatalIfError(err)
+				continue
+			}
+
+			// convert MARC-8 records so the transforms and everything downstream see UTF-8
+			if r.cfg.Marc8Converter != nil && r.convertRecord(rec) == true {
+				converted++
+			}
+			if invalidUtf8Record(rec) == true {
+				invalidUtf8++
+			}
+
+			// fix up the record before it is sent, ingested ids are the transformed ones
+			if r.cfg.Transformer != nil {
+				r.transformRecord(rec)
+			}
+
+			if r.ingestedIds != nil {
+				id, _ := rec.Id()
+				err = r.ingestedIds.Add(id)
+				fatalIfError(err)
+			}
+
+			if fileIds != nil {
+				id, _ := rec.Id()
+				err = fileIds.Add(id)
+				fatalIfError(err)
+			}
+
+			seq := r.tracker.Assign()
+			rec.SetSequence(seq)
+			rec.SetProvenance(&Provenance{
+				RunId:    r.Summary.RunId,
+				Key:      file.RemoteName,
+				Index:    index,
+				Offset:   rec.Offset(),
+				Ingested: time.Now(),
+			})
+
+			count++
+			merged += rec.Merged()
+			if rec.Repaired() == true {
+				bad++
+			}
+
+			r.update(func() {
+				if r.filePos[ix] == 0 {
+					r.fileStart[ix] = seq
+				}
+				r.filePos[ix]++
+			})
+			if send == true {
+				r.control.addProgress(1, int64(len(rec.Raw())))
+			}
+			if send == true && count > skip {
+				metricRecordsRead.WithLabelValues(rec.Source()).Inc()
+				metricBytesRead.WithLabelValues(rec.Source()).Add(float64(len(rec.Raw())))
+				r.records <- rec
+			} else {
+				// already sent
+				r.tracker.Done(rec.Sequence())
+			}
+
+			if time.Since(r.lastCheckpoint) >= checkpointInterval {
+				r.checkpoint()
+			}
+
+			rec, err = loader.Next(true)
+			if err != nil {
+				if err == io.EOF {
+					// this is expected, break out of the processing loop
+					break
+				}
+				// fatal fail here because we have already validated the file and believe it to be correct so this
+				// is some other sort of failure
+				fatalIfError(err)
+			}
+		}
+	}
+
+	loader.Done()
+	span.SetAttributes(attribute.Int("file.records", count), attribute.Int("file.merged", merged), attribute.Int("file.bad", bad))
+	endSpan(span, nil)
+	duration := time.Since(start)
+	if send == true {
+		duplicates := 0
+		if dups != nil {
+			duplicates = dups.Extra
+		}
+		if fileIds != nil {
+			duplicates, err = countDuplicateIds(r.cfg.DownloadDir, fileIds)
+			fatalIfError(err)
+		}
+		r.update(func() {
+			r.Summary.FileDone(ix, count, merged, bad, duplicates, filtered, converted, invalidUtf8, duration)
+		})
+		log.Printf("INFO: done processing %s (%s). %d records (%0.2f tps)", file.RemoteName, file.LocalName, count, float64(count)/duration.Seconds())
+	}
+
+	// file has been ingested, remove it
+	log.Printf("INFO: removing processed file %s", file.LocalName)
+	err = os.Remove(file.LocalName)
+	fatalIfError(err)
+	r.update(func() { file.LocalName = "" })
+}
+
+// apply the duplicate policy and the filter rules to a record, returns true if it should be dropped. Records
+// kept when merging duplicates have the later copies appended
+func (r *IngestRun) dropRecord(rec Record, index int, dups *DuplicateIds, merger RecordLoader, filtered map[string]int, counted bool) bool {
+
+	if dups != nil {
+		id, _ := rec.Id()
+		keep, others := dups.Keep(r.cfg.DuplicatePolicy, id, index)
+		if keep == false {
+			return true
+		}
+		for _, offset := range others {
+			err := mergeRecordAt(merger, rec, offset)
+			fatalIfError(err)
+		}
+	}
+
+	if r.cfg.Filter != nil {
+		if rule := r.cfg.Filter.Match(rec); rule != "" {
+			filtered[rule]++
+			if counted == true {
+				metricRecordsFiltered.WithLabelValues(rule).Inc()
+			}
+			return true
+		}
+	}
+
+	return false
+}
+
+// convert a MARC-8 record to UTF-8, returns true if it was converted. Records that cannot be converted
+// are sent as they are
+func (r *IngestRun) convertRecord(rec Record) bool {
+	id, _ := rec.Id()
+	converted, err := r.cfg.Marc8Converter.Convert(rec)
+	if err != nil {
+		logRecordf(LevelWarning, id, rec.Offset(), "unable to convert the record from MARC-8, sending it unchanged (%s)", err.Error())
+		metricConversionFailures.WithLabelValues(rec.Source()).Inc()
+		return false
+	}
+	if converted == true {
+		metricRecordsConverted.WithLabelValues(rec.Source()).Inc()
+	}
+	return converted
+}
+
+// report a record that claims to be Unicode but is not valid UTF-8
+func invalidUtf8Record(rec Record) bool {
+	if invalidUtf8(rec.Raw()) == false {
+		return false
+	}
+	id, _ := rec.Id()
+	logRecordf(LevelWarning, id, rec.Offset(), "record claims to be Unicode but contains invalid UTF-8")
+	metricRecordsInvalidUtf8.WithLabelValues(rec.Source()).Inc()
+	return true
+}
+
+// apply the transform pipeline to a record, records that cannot be transformed are sent as they are
+func (r *IngestRun) transformRecord(rec Record) {
+	id, _ := rec.Id()
+	applied, err := r.cfg.Transformer.Apply(rec)
+	if err != nil {
+		logRecordf(LevelWarning, id, rec.Offset(), "unable to transform the record, sending it unchanged (%s)", err.Error())
+		metricTransformFailures.WithLabelValues(rec.Source()).Inc()
+		return
+	}
+	if applied == true {
+		metricRecordsTransformed.WithLabelValues(rec.Source()).Inc()
+	}
+}
+
+// a file containing repeated ids is invalid when the duplicate policy is reject
+func (r *IngestRun) rejectDuplicates(ix int, loader RecordLoader) error {
+
+	file := r.Summary.Files[ix]
+	dups, err := scanDuplicateIds(r.cfg.DownloadDir, loader)
+	if err != nil {
+		return err
+	}
+	if len(dups.Ids) == 0 {
+		return nil
+	}
+
+	dups.Log(file.RemoteName)
+	err = saveDuplicateReport(r.cfg, r.s3Svc, r.Summary.RunId, ix, dups)
+	if err != nil {
+		log.Printf("WARNING: unable to save the duplicate id report (%s)", err.Error())
+	}
+	return fmt.Errorf("%w: %d ids repeated", ErrDuplicateIds, len(dups.Ids))
+}
+
+func (r *IngestRun) drain() {
+
+	// wait until we have processed all outbound items
+	for {
+		pending := r.tracker.Pending()
+		// is our queue empty
+		if pending == 0 {
+			break
+		}
+		log.Printf("INFO: waiting for all records to be queued (%d remain)", pending)
+		time.Sleep(flushTimeout)
+	}
+
+	// resend anything that could not be sent the first time
+	r.replaySpilled()
+
+	// everything has been sent
+	r.checkpoint()
+
+	if r.cfg.DryRun == true {
+		log.Printf("INFO: DRY RUN, not waiting for idle queues")
+		return
+	}
+
+	// wait until the work queues are idle
+	err := ensureQueuesIdle(r.aws, r.cfg.WaitIdleQueues, int(r.cfg.PollTimeOut), r.cfg.WaitForIdleEnd)
+	fatalIfError(err)
+}
+
+// resend any records spilled during the run, the run fails if they still cannot be sent
+func (r *IngestRun) replaySpilled() {
+
+	if outboundSpill == nil || outboundSpill.Count() == 0 {
+		return
+	}
+
+	name, count, err := outboundSpill.Take()
+	fatalIfError(err)
+	log.Printf("WARNING: %d records could not be sent during the run, resending", count)
+	r.update(func() {
+		r.Summary.Spilled += count
+		r.Summary.Warn(fmt.Sprintf("%d records could not be sent and were spilled", count))
+	})
+
+	replayed, failedName, err := replaySpillFile(r.phaseCtx, r.cfg, outboundSink, name)
+	r.update(func() { r.Summary.Replayed += replayed })
+	if err != nil {
+		// keep what we could not send so it can be replayed later
+		keep := name
+		if failedName != "" {
+			keep = failedName
+			_ = os.Remove(name)
+		}
+		_ = saveArtifact(r.cfg, r.s3Svc, keep, artifactName(r.cfg.DataSource, r.Summary.RunId, "spill.jsonl"))
+		fatalIfError(err)
+	}
+	_ = os.Remove(name)
+
+	// the confirmed point can now move past the spilled records
+	r.tracker.Resent()
+
+	log.Printf("INFO: resent %d spilled records", replayed)
+}
+
+// returns an error if the run must fail without any further processing
+func (r *IngestRun) deletes() error {
+
+	// if we were resumed after ingest, we need to rebuild the list of ingested ids
+	if (r.cfg.ReconcileDeletes == true && r.ingestedIds == nil) || (r.cfg.HashStore == true && r.hashes == nil) {
+		r.rebuildIngestedIds()
+	}
+
+	if r.hashes != nil {
+		r.saveHashStore()
+	}
+
+	// sort the ingested ids so we can compare them with what exists
+	sortedIds := ""
+	if r.cfg.ReconcileDeletes == true {
+
+		err := r.ingestedIds.Close()
+		fatalIfError(err)
+		sortedIds, err = sortSpoolFile(r.cfg.DownloadDir, r.ingestedIds.Name)
+		fatalIfError(err)
+		r.ingestedIds.Remove()
+		r.update(func() { r.ingestedIds = nil })
+		defer os.Remove(sortedIds)
+	}
+
+	var err error
+
+	// swap to the new collection or delete old SOLR stuff
+	if r.cfg.SolrCollectionSwap == true && r.cfg.DryRun == true {
+		log.Printf("INFO: DRY RUN, not swapping SOLR collections")
+	} else if r.cfg.SolrCollectionSwap == true {
+		err = promoteIngestCollection(r.cfg, r.Summary.NewCollection, r.Summary.PreviousCollection, r.Summary.TotalRecords)
+		if err != nil {
+			// the new collection has been abandoned and the indexers pointed back at the old one
+			log.Printf("ERROR: SOLR collection swap failed, the run has failed (%s)", err.Error())
+			r.update(func() { r.Summary.NewCollection = "" })
+			return fmt.Errorf("SOLR collection swap failed: %w", err)
+		}
+		r.update(func() { r.promoted = true })
+	} else if r.cfg.DeleteSolr == true {
+		start := time.Now()
+		deleted := int64(0)
+		if r.cfg.ReconcileDeletes == true {
+			deleted, err = reconcileSolrRecords(r.cfg, r.s3Svc, sortedIds, r.Summary.RunId)
+		} else if r.cfg.DryRun == true {
+			deleted, err = countOldSolrRecords(r.cfg.SolrMaster, r.cfg.SolrCore, r.cfg.SolrTimeout, r.cfg.DataSource, r.Summary.IngestStarted)
+			log.Printf("INFO: DRY RUN, not deleting %d SOLR records", deleted)
+		} else {
+			err = deleteOldSolrRecords(r.cfg.SolrMaster, r.cfg.SolrCore, r.cfg.SolrTimeout, r.cfg.DataSource, r.Summary.IngestStarted)
+		}
+		r.update(func() { r.Summary.SolrDeleted = deleted })
+		r.observeDeletes("solr", start, deleted)
+		r.deleteGuard("SOLR", err)
+		//fatalIfError(err)
+	}
+
+	// delete old cache stuff
+	if r.cfg.DeleteCache == true {
+		start := time.Now()
+		deleted := int64(0)
+		if r.cfg.ReconcileDeletes == true {
+			deleted, err = reconcileCacheRecords(r.cfg, r.s3Svc, sortedIds, r.Summary.RunId)
+		} else {
+			deleted, err = deleteOldCacheRecords(r.cfg, r.cfg.DataSource, r.Summary.IngestStarted)
+		}
+		r.update(func() { r.Summary.CacheDeleted = deleted })
+		r.observeDeletes("cache", start, deleted)
+		r.deleteGuard("cache", err)
+		//fatalIfError(err)
+	}
+
+	// determine of we have unprocessed items and abort if we have too many
+	unprocessed, err := getQueueMessageCount(r.aws, r.cfg.ErrorQueue)
+	fatalIfError(err)
+	r.update(func() { r.Summary.ErrorQueueCount = unprocessed })
+	if unprocessed >= uint(r.cfg.ErrorThreshold) && r.cfg.DryRun == true {
+		log.Printf("WARNING: DRY RUN, error queue contains %d items", unprocessed)
+	} else if unprocessed >= uint(r.cfg.ErrorThreshold) {
+		log.Printf("ERROR: too many unprocessed items (%d)", unprocessed)
+		fatalIfError(ErrTooManyUnprocessedItems)
+	}
+	return nil
+}
+
+// delete failures do not stop the run but they are noted in the summary and notified
+func (r *IngestRun) deleteGuard(target string, err error) {
+	if err == nil {
+		return
+	}
+	warning := fmt.Sprintf("%s delete failed (%s)", target, err.Error())
+	if err == ErrTooManyDeletes || err == ErrCacheDeleteThreshold {
+		warning = fmt.Sprintf("%s delete guard tripped (%s)", target, err.Error())
+	}
+	log.Printf("WARNING: %s", warning)
+	r.update(func() { r.Summary.Warn(warning) })
+	notifyRun(NotifyWarning, r.Summary, warning)
+}
+
+// update the delete metrics, a dry run does not delete anything
+func (r *IngestRun) observeDeletes(target string, start time.Time, deleted int64) {
+	if r.cfg.DryRun == true {
+		return
+	}
+	metricDeleteDuration.WithLabelValues(target).Observe(time.Since(start).Seconds())
+	metricRecordsDeleted.WithLabelValues(target).Add(float64(deleted))
+}
+
+// start new lists of the ingested ids and hashes as required
+func (r *IngestRun) newIngestedIds() {
+	r.removeIngestedIds()
+	var ids, hashes *IdSpool
+	var err error
+	if r.cfg.ReconcileDeletes == true {
+		ids, err = NewIdSpool(r.cfg.DownloadDir, "ingested-*.ids")
+		fatalIfError(err)
+	}
+	if r.cfg.HashStore == true {
+		hashes, err = NewIdSpool(r.cfg.DownloadDir, "ingested-*.hashes")
+		fatalIfError(err)
+	}
+	r.update(func() { r.ingestedIds, r.hashes, r.hashCount = ids, hashes, 0 })
+}
+
+// add a record to the hash store. Like the index the diff command builds, it includes every record loaded,
+// whether or not it is sent, and the last copy of a repeated id wins
+func (r *IngestRun) addHash(rec Record) {
+	if r.hashes == nil {
+		return
+	}
+	id, _ := rec.Id()
+	err := r.hashes.Add(indexSpoolLine(id, r.hashCount, recordHash(rec.Raw()), -1))
+	fatalIfError(err)
+	r.hashCount++
+}
+
+func (r *IngestRun) removeIngestedIds() {
+	if r.ingestedIds != nil {
+		r.ingestedIds.Remove()
+	}
+	if r.hashes != nil {
+		r.hashes.Remove()
+	}
+	r.update(func() { r.ingestedIds, r.hashes = nil, nil })
+}
+
+// the names of the id lists, the caller holds the state lock
+func (r *IngestRun) spoolNames() []string {
+	names := make([]string, 0, 2)
+	if r.ingestedIds != nil {
+		names = append(names, r.ingestedIds.Name)
+	}
+	if r.hashes != nil {
+		names = append(names, r.hashes.Name)
+	}
+	return names
+}
+
+// save the ingested ids and hashes so the next dump can be compared with this one. Not being
+// able to do so does not affect the run
+func (r *IngestRun) saveHashStore() {
+
+	index, repeated, err := sortIndexSpool(r.cfg.DownloadDir, r.hashes)
+	r.hashes.Remove()
+	r.update(func() { r.hashes = nil })
+	if err != nil {
+		log.Printf("WARNING: unable to create the hash store (%s)", err.Error())
+		return
+	}
+
+	log.Printf("INFO: hash store created (%d repeated ids)", repeated)
+	err = saveArtifact(r.cfg, r.s3Svc, index, artifactName(r.cfg.DataSource, r.Summary.RunId, "hashes.txt"))
+	if err != nil {
+		log.Printf("WARNING: unable to save the hash store (%s)", err.Error())
+		_ = os.Remove(index)
+	}
+}
+
+// read all the files again to determine which ids were ingested
+func (r *IngestRun) rebuildIngestedIds() {
+	log.Printf("INFO: rebuilding the list of ingested ids")
+	r.newIngestedIds()
+	r.update(func() {
+		r.fileStart = make([]uint64, len(r.Summary.Files))
+		r.filePos = make([]int, len(r.Summary.Files))
+	})
+	for ix := range r.Summary.Files {
+		r.ingestFile(ix, 0, false)
+	}
+}
+
+// update the confirmed record counts and save them
+func (r *IngestRun) checkpoint() {
+	r.update(func() { r.confirm(r.Summary) })
+	r.lastCheckpoint = time.Now()
+	r.save()
+}
+
+// update the confirmed record counts of a summary, the caller holds the state lock
+func (r *IngestRun) confirm(summary *RunSummary) {
+
+	confirmed := r.tracker.Confirmed()
+	if r.ingesting == true {
+		summary.OutboundMessages = r.priorMessages + r.tracker.Messages() - r.messageBase
+	}
+	for ix := range r.filePos {
+		// files we have not started yet
+		if r.filePos[ix] == 0 {
+			continue
+		}
+
+		c := 0
+		if confirmed > r.fileStart[ix] {
+			c = int(confirmed - r.fileStart[ix])
+		}
+		if c > r.filePos[ix] {
+			c = r.filePos[ix]
+		}
+		summary.Files[ix].Confirmed = c
+	}
+}
+
+// Status - the run status, safe to call from any goroutine
+func (r *IngestRun) Status() RunStatus {
+	r.state.Lock()
+	summary := r.Summary.Copy()
+	r.state.Unlock()
+	return r.control.Status(summary)
+}
+
+// update the run state, see IngestRun
+func (r *IngestRun) update(change func()) {
+	r.state.Lock()
+	defer r.state.Unlock()
+	change()
+}
+
+// download a file and verify it against the expected checksum (if we have one)
+func (r *IngestRun) download(ix int) error {
+
+	file := &r.Summary.Files[ix]
+
+	// create temp file
+	tmp, err := ioutil.TempFile(r.cfg.DownloadDir, "")
+	if err != nil {
+		return err
+	}
+	tmp.Close()
+
+	// download the file
+	o := uva_s3.NewUvaS3Object(file.Bucket, file.Key)
+	err = r.s3Svc.GetToFile(o, tmp.Name())
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	checksum, err := fileChecksum(tmp.Name())
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	if file.Checksum != "" && file.Checksum != checksum {
+		log.Printf("ERROR: %s has changed since the run started (checksum %s, expected %s)", file.RemoteName, checksum, file.Checksum)
+		_ = os.Remove(tmp.Name())
+		return ErrChecksumMismatch
+	}
+
+	r.update(func() { file.LocalName, file.Checksum = tmp.Name(), checksum })
+	return nil
+}
+
+// ensure we have a local copy of the file, downloading it again if necessary
+func (r *IngestRun) ensureLocal(ix int) error {
+	if r.Summary.Files[ix].LocalName != "" {
+		return nil
+	}
+	log.Printf("INFO: downloading %s again", r.Summary.Files[ix].RemoteName)
+	return r.download(ix)
+}
+
+func (r *IngestRun) removeLocalFiles() {
+	for ix := range r.Summary.Files {
+		f := &r.Summary.Files[ix]
+		if f.LocalName != "" {
+			log.Printf("INFO: removing invalid file %s", f.LocalName)
+			err := os.Remove(f.LocalName)
+			fatalIfError(err)
+			r.update(func() { f.LocalName = "" })
+		}
+	}
+}
+
+// note the start of a new phase
+func (r *IngestRun) startPhase(phase RunPhase) {
+	r.update(func() {
+		if r.phaseSpan != nil {
+			r.phaseSpan.End()
+		}
+		r.phaseCtx, r.phaseSpan = tracer.Start(r.traceCtx, string(phase), trace.WithAttributes(attribute.String("phase", string(phase))))
+		r.Summary.StartPhase(phase)
+	})
+	setBatchContext(r.phaseCtx)
+	r.control.setPhase(phase)
+	setRunPhaseMetric(phase)
+}
+
+// the run is complete, one way or another
+func (r *IngestRun) finish() {
+	r.removeIngestedIds()
+	r.finishSummary(r.Summary)
+}
+
+// log, save, report and notify the final state of the run
+func (r *IngestRun) finishSummary(summary *RunSummary) {
+	setRunPhaseMetric("")
+	summary.Log()
+	r.saveSummary(summary)
+	if r.cfg.RunReport == true {
+		// a missing report is not a reason to fail the run
+		_ = saveRunReport(r.cfg, r.s3Svc, summary)
+	}
+	if summary.Outcome == OutcomeSuccess {
+		notifyRun(NotifySuccess, summary, "")
+	} else {
+		notifyRun(NotifyFailure, summary, summary.Outcome)
+	}
+	var err error
+	if summary.Outcome != OutcomeSuccess {
+		err = fmt.Errorf("run %s: %s", summary.Outcome, summary.Error)
+	}
+	r.endTrace(summary, err)
+	setActiveRun(nil)
+	setLogContext(LogContext{})
+}
+
+// start the run span, a resumed run gets a new trace
+func (r *IngestRun) startTrace() {
+	r.state.Lock()
+	defer r.state.Unlock()
+	if r.runSpan != nil {
+		return
+	}
+	r.traceCtx, r.runSpan = tracer.Start(context.Background(), "run", trace.WithAttributes(
+		attribute.String("run.id", r.Summary.RunId),
+		attribute.String("run.data_source", r.Summary.DataSource),
+		attribute.Bool("run.dry_run", r.Summary.DryRun),
+		attribute.Int("run.resume_count", r.Summary.ResumeCount),
+	))
+	r.phaseCtx = r.traceCtx
+}
+
+// end the phase and run spans
+func (r *IngestRun) endTrace(summary *RunSummary, err error) {
+	setBatchContext(context.Background())
+	r.state.Lock()
+	defer r.state.Unlock()
+	if r.phaseSpan != nil {
+		endSpan(r.phaseSpan, err)
+		r.phaseSpan = nil
+	}
+	if r.runSpan != nil {
+		r.runSpan.SetAttributes(
+			attribute.String("run.outcome", summary.Outcome),
+			attribute.Int("run.records", summary.TotalRecords),
+			attribute.Int64("run.outbound_messages", int64(summary.OutboundMessages)),
+		)
+		endSpan(r.runSpan, err)
+		r.runSpan = nil
+	}
+}
+
+// start a span for an operation on a single file
+func (r *IngestRun) startFileSpan(name string, ix int) (context.Context, trace.Span) {
+	f := r.Summary.Files[ix]
+	return tracer.Start(r.phaseCtx, name, trace.WithAttributes(
+		attribute.String("file.name", f.RemoteName),
+		attribute.Int64("file.size", f.Size),
+	))
+}
+
+// save the run state to the ledger if we are configured to do so
+func (r *IngestRun) save() {
+	r.saveSummary(r.Summary)
+}
+
+func (r *IngestRun) saveSummary(summary *RunSummary) {
+	if r.cfg.RunLedger == true {
+		// ledger failures are not fatal, the run itself is more important
+		_ = ledgerSaveRun(summary)
+	}
+}
+
+func isResumable(phase RunPhase) bool {
+	for _, p := range resumablePhases {
+		if p == phase {
+			return true
+		}
+	}
+	return false
+}
+
+// resume any runs that were interrupted
+func resumeIncompleteRuns(cfg *ServiceConfig, aws awssqs.AWS_SQS, s3Svc uva_s3.UvaS3, records chan<- Record, tracker *RecordTracker) {
+
+	runs, err := ledgerLoadIncompleteRuns(cfg)
+	fatalIfError(err)
+
+	for ix, summary := range runs {
+
+		run := NewIngestRun(cfg, aws, s3Svc, records, tracker, summary)
+		phase := summary.CurrentPhase()
+
+		// only the most recent run can be resumed and then only once the inbound files were validated, the inbound
+		// notification is still available for anything before that
+		if ix != 0 || isResumable(phase) == false {
+			log.Printf("WARNING: abandoning interrupted run %s (phase %s)", summary.RunId, phase)
+			summary.Complete(OutcomeFailed, ErrRunAbandoned)
+			run.finish()
+			continue
+		}
+
+		if summary.ResumeCount >= cfg.ResumeAttempts {
+			log.Printf("ERROR: run %s has been resumed %d times, giving up on it", summary.RunId, summary.ResumeCount)
+			summary.Complete(OutcomeFailed, ErrTooManyResumes)
+			run.finish()
+			continue
+		}
+
+		// anything in flight when we were interrupted may not have been sent
+		if phase == PhaseDrain {
+			phase = PhaseIngest
+		}
+
+		summary.ResumeCount++
+		summary.Error = ""
+		log.Printf("INFO: resuming run %s at phase %s (attempt %d)", summary.RunId, phase, summary.ResumeCount)
+		notifyRun(NotifyStart, summary, fmt.Sprintf("resumed at %s", phase))
+		run.Process(phase)
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+var ErrUnknownSinkFormat = fmt.Errorf("unknown sink file format (json or marc)")
+
+// the file sink formats
+const (
+	SinkFormatJson = "json" // newline delimited OutboundRecord JSON
+	SinkFormatMarc = "marc" // the raw MARC records
+)
+
+// writes records to a local file, useful for testing and feeding local consumers
+type fileSink struct {
+	sync.Mutex
+	format     string
+	compress   bool
+	provenance []string
+	file       *os.File
+	writer     *bufio.Writer
+}
+
+func newFileSink(name string, format string, compress bool, provenance []string) (Sink, error) {
+
+	if format != SinkFormatJson && format != SinkFormatMarc {
+		return nil, ErrUnknownSinkFormat
+	}
+
+	file, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileSink{format: format, compress: compress, provenance: provenance, file: file, writer: bufio.NewWriter(file)}, nil
+}
+
+func (s *fileSink) Name() string {
+	return SinkFile
+}
+
+func (s *fileSink) Send(ctx context.Context, records []Record) (int, error) {
+
+	// the workers share the sink
+	s.Lock()
+	defer s.Unlock()
+
+	start := time.Now()
+	defer func() {
+		metricBatchPutDuration.WithLabelValues(SinkFile).Observe(time.Since(start).Seconds())
+	}()
+
+	traceparent := traceParent(ctx)
+	for _, rec := range records {
+		if s.format == SinkFormatMarc {
+			_, err := s.writer.Write(rec.Raw())
+			if err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		buf, err := json.Marshal(newOutboundRecord(rec, traceparent, s.compress, s.provenance))
+		if err != nil {
+			return 0, err
+		}
+		_, err = s.writer.Write(append(buf, '\n'))
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// each batch is complete on disk before the records are considered sent
+	err := s.writer.Flush()
+	if err != nil {
+		return 0, err
+	}
+	return len(records), nil
+}
+
+func (s *fileSink) Close() error {
+	s.Lock()
+	defer s.Unlock()
+
+	err := s.writer.Flush()
+	if err != nil {
+		s.file.Close()
+		return err
+	}
+	return s.file.Close()
+}
+
+//
+// end of file
+//
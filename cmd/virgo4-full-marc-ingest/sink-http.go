@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// the timeout for a single batch POST
+var httpSinkTimeout = 30 * time.Second
+
+// posts each batch as a JSON array of OutboundRecord
+type httpSink struct {
+	url        string
+	token      string
+	compress   bool
+	provenance []string
+	httpClient *http.Client
+}
+
+func newHttpSink(url string, token string, compress bool, provenance []string) (Sink, error) {
+	return &httpSink{url: url, token: token, compress: compress, provenance: provenance, httpClient: &http.Client{Timeout: httpSinkTimeout}}, nil
+}
+
+func (s *httpSink) Name() string {
+	return SinkHttp
+}
+
+func (s *httpSink) Send(ctx context.Context, records []Record) (int, error) {
+
+	start := time.Now()
+	defer func() {
+		metricBatchPutDuration.WithLabelValues(SinkHttp).Observe(time.Since(start).Seconds())
+	}()
+
+	traceparent := traceParent(ctx)
+	batch := make([]OutboundRecord, 0, len(records))
+	for _, rec := range records {
+		batch = append(batch, newOutboundRecord(rec, traceparent, s.compress, s.provenance))
+	}
+	buf, err := json.Marshal(batch)
+	if err != nil {
+		return 0, err
+	}
+
+	for attempt := uint(1); ; attempt++ {
+		retry, err := s.post(ctx, buf)
+		if err == nil {
+			return len(records), nil
+		}
+
+		if retry == false || attempt > sendRetries {
+			return 0, err
+		}
+
+		log.Printf("WARNING: HTTP sink post failed (%s), retrying...", err.Error())
+		metricBatchPutRetries.WithLabelValues(SinkHttp).Inc()
+		trace.SpanFromContext(ctx).AddEvent("retry", trace.WithAttributes(attribute.String("error", err.Error())))
+		time.Sleep(retrySleepTime * time.Duration(attempt))
+	}
+}
+
+// post the batch, returns true if a failure can be retried
+func (s *httpSink) post(ctx context.Context, buf []byte) (bool, error) {
+
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(buf))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	response, err := s.httpClient.Do(req)
+	if err != nil {
+		return canRetry(err), err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode >= 200 && response.StatusCode <= 299 {
+		return false, nil
+	}
+
+	// server errors and throttling may succeed later
+	retry := response.StatusCode >= 500 || response.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("%s returned HTTP %d", s.url, response.StatusCode)
+}
+
+func (s *httpSink) Close() error {
+	return nil
+}
+
+//
+// end of file
+//
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+// how long the producer waits to fill a batch, our batches are already formed so keep this short
+var kafkaBatchTimeout = 50 * time.Millisecond
+
+// produces each record to a Kafka compatible topic keyed by the record id. The message value and
+// the headers are the same as the SQS message payload and attributes
+type kafkaSink struct {
+	writer     *kafka.Writer
+	compress   bool
+	provenance []string
+}
+
+func newKafkaSink(brokers []string, topic string, compress bool, provenance []string) (Sink, error) {
+	writer := &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.Hash{},
+		RequiredAcks: kafka.RequireAll,
+		MaxAttempts:  int(sendRetries) + 1,
+		BatchSize:    int(awssqs.MAX_SQS_BLOCK_COUNT),
+		BatchTimeout: kafkaBatchTimeout,
+	}
+	return &kafkaSink{writer: writer, compress: compress, provenance: provenance}, nil
+}
+
+func (s *kafkaSink) Name() string {
+	return SinkKafka
+}
+
+func (s *kafkaSink) Send(ctx context.Context, records []Record) (int, error) {
+
+	start := time.Now()
+	defer func() {
+		metricBatchPutDuration.WithLabelValues(SinkKafka).Observe(time.Since(start).Seconds())
+	}()
+
+	traceparent := traceParent(ctx)
+	messages := make([]kafka.Message, 0, len(records))
+	for _, rec := range records {
+		id, _ := rec.Id()
+		headers := []kafka.Header{
+			{Key: awssqs.AttributeKeyRecordId, Value: []byte(id)},
+			{Key: awssqs.AttributeKeyRecordType, Value: []byte(awssqs.AttributeValueRecordTypeB64Marc)},
+			{Key: awssqs.AttributeKeyRecordSource, Value: []byte(rec.Source())},
+			{Key: awssqs.AttributeKeyRecordOperation, Value: []byte(awssqs.AttributeValueRecordOperationUpdate)},
+		}
+		if s.compress == true {
+			headers = append(headers, kafka.Header{Key: attributeKeyPayloadEncoding, Value: []byte(PayloadEncodingGzip)})
+		}
+		if traceparent != "" {
+			headers = append(headers, kafka.Header{Key: traceMessageAttribute, Value: []byte(traceparent)})
+		}
+		for _, a := range provenanceAttributes(rec, s.provenance) {
+			headers = append(headers, kafka.Header{Key: a.Name, Value: []byte(a.Value)})
+		}
+		messages = append(messages, kafka.Message{Key: []byte(id), Value: outboundPayload(rec, s.compress), Headers: headers})
+	}
+
+	err := s.writer.WriteMessages(ctx, messages...)
+	if err != nil {
+		return 0, err
+	}
+	return len(messages), nil
+}
+
+func (s *kafkaSink) Close() error {
+	return s.writer.Close()
+}
+
+//
+// end of file
+//
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// the destination of records that only need the cache queue, their work queue message was sent
+var sqsTargetCache = "cache"
+
+// the original sink, records go to the outbound queue and (optionally) the cache queue
+type sqsSink struct {
+	aws        awssqs.AWS_SQS
+	outQueue   awssqs.QueueHandle
+	cacheQueue awssqs.QueueHandle
+	compress   bool
+	provenance []string
+}
+
+func newSqsSink(cfg *ServiceConfig, aws awssqs.AWS_SQS) (Sink, error) {
+
+	outQueue, err := aws.QueueHandle(cfg.OutQueueName)
+	if err != nil {
+		return nil, err
+	}
+
+	var cacheQueue awssqs.QueueHandle
+	if cfg.CacheQueueName != "" {
+		cacheQueue, err = aws.QueueHandle(cfg.CacheQueueName)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &sqsSink{aws: aws, outQueue: outQueue, cacheQueue: cacheQueue, compress: cfg.CompressPayload, provenance: cfg.Provenance}, nil
+}
+
+func (s *sqsSink) Name() string {
+	return SinkSqs
+}
+
+func (s *sqsSink) Send(ctx context.Context, records []Record) (int, error) {
+
+	count := len(records)
+
+	//
+	// we use copies of the messages for each queue because we want to ensure that new S3 objects are created
+	// if not, we have multiple messages that share an external S3 object
+	//
+
+	// downstream services can join the trace
+	traceAttribs := traceAttributes(ctx)
+
+	// replayed records may only need the cache queue
+	work := make([]Record, 0, count)
+	cacheOnly := make([]Record, 0)
+	batch1 := make([]awssqs.Message, 0, count)
+	batch2 := make([]awssqs.Message, 0, count)
+	for _, m := range records {
+		msg := constructMessage(m, s.compress, s.provenance)
+		msg.Attribs = append(msg.Attribs, traceAttribs...)
+		if recordTarget(m) == sqsTargetCache {
+			cacheOnly = append(cacheOnly, m)
+		} else {
+			work = append(work, m)
+			batch1 = append(batch1, msg)
+		}
+		batch2 = append(batch2, msg)
+	}
+
+	sent := 0
+	if len(batch1) != 0 {
+		err := putMessages(ctx, s.aws, s.outQueue, "work", batch1)
+		if err != nil {
+			if len(cacheOnly) == 0 {
+				return 0, err
+			}
+			return 0, &PartialSendError{Err: err, Failures: []SendFailure{{Records: work}, {Records: cacheOnly, Target: sqsTargetCache}}}
+		}
+		sent += len(batch1)
+	}
+
+	// if we are configured to send items to the cache. If this fails the work queue already has them
+	if s.cacheQueue != "" {
+		err := putMessages(ctx, s.aws, s.cacheQueue, "cache", batch2)
+		if err != nil {
+			return sent, &PartialSendError{Err: err, Failures: []SendFailure{{Records: records, Target: sqsTargetCache}}}
+		}
+		sent += len(batch2)
+	}
+
+	// if we get here, everything worked as expected
+	return sent, nil
+}
+
+func (s *sqsSink) Close() error {
+	return nil
+}
+
+// put a batch of messages, retrying any that fail
+func putMessages(ctx context.Context, aws awssqs.AWS_SQS, queue awssqs.QueueHandle, queueName string, batch []awssqs.Message) error {
+
+	start := time.Now()
+	defer func() {
+		metricBatchPutDuration.WithLabelValues(queueName).Observe(time.Since(start).Seconds())
+	}()
+
+	// oversize messages are written to the message bucket by BatchMessagePut
+	total := uint(0)
+	for ix := range batch {
+		size := batch[ix].Size()
+		if size > awssqs.MAX_SQS_MESSAGE_SIZE {
+			metricMessagesOversize.WithLabelValues(queueName).Inc()
+		}
+		total += size
+	}
+	metricBatchBytes.WithLabelValues(queueName).Observe(float64(total))
+
+	opStatus, err := aws.BatchMessagePut(queue, batch)
+	if err != nil {
+		// if an error we can handle, retry
+		if err == awssqs.ErrOneOrMoreOperationsUnsuccessful {
+			log.Printf("WARNING: one or more items failed to send to the %s queue, retrying...", queueName)
+			failed := 0
+			for _, op := range opStatus {
+				if op == false {
+					metricBatchPutRetries.WithLabelValues(queueName).Inc()
+					failed++
+				}
+			}
+			trace.SpanFromContext(ctx).AddEvent("retry", trace.WithAttributes(attribute.String("queue", queueName), attribute.Int("failed", failed)))
+
+			// retry the failed items and bail out if we cannot retry
+			err = aws.MessagePutRetry(queue, batch, opStatus, sendRetries)
+		}
+	}
+
+	// bail out if an error and let someone else handle it
+	return err
+}
+
+func constructMessage(record Record, compress bool, provenance []string) awssqs.Message {
+
+	id, _ := record.Id()
+	attributes := make([]awssqs.Attribute, 0, maxSqsMessageAttributes)
+	attributes = append(attributes, awssqs.Attribute{Name: awssqs.AttributeKeyRecordId, Value: id})
+	attributes = append(attributes, awssqs.Attribute{Name: awssqs.AttributeKeyRecordType, Value: awssqs.AttributeValueRecordTypeB64Marc})
+	attributes = append(attributes, awssqs.Attribute{Name: awssqs.AttributeKeyRecordSource, Value: record.Source()})
+	attributes = append(attributes, awssqs.Attribute{Name: awssqs.AttributeKeyRecordOperation, Value: awssqs.AttributeValueRecordOperationUpdate})
+	if compress == true {
+		attributes = append(attributes, awssqs.Attribute{Name: attributeKeyPayloadEncoding, Value: PayloadEncodingGzip})
+	}
+	attributes = append(attributes, provenanceMessageAttributes(record, provenance)...)
+	return awssqs.Message{Attribs: attributes, Payload: outboundPayload(record, compress)}
+}
+
+//
+// end of file
+//
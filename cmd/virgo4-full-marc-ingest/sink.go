@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+var ErrUnknownSink = fmt.Errorf("unknown outbound sink")
+
+// the supported sinks
+const (
+	SinkSqs   = "sqs"
+	SinkFile  = "file"
+	SinkHttp  = "http"
+	SinkKafka = "kafka"
+)
+
+// Sink - a destination for outbound records
+type Sink interface {
+	Name() string
+	Send(ctx context.Context, records []Record) (int, error) // send a batch, returns the number of messages sent
+	Close() error
+}
+
+// SendFailure - records a send did not deliver and the destination they still need, blank is every
+// destination of their sink
+type SendFailure struct {
+	Records []Record
+	Target  string
+}
+
+// PartialSendError - a batch that was only partly sent
+type PartialSendError struct {
+	Err      error
+	Failures []SendFailure
+}
+
+func (e *PartialSendError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PartialSendError) Unwrap() error {
+	return e.Err
+}
+
+// the records a failed send did not deliver, all of them unless it was partly sent
+func sendFailures(records []Record, err error) []SendFailure {
+	var partial *PartialSendError
+	if errors.As(err, &partial) == true {
+		return partial.Failures
+	}
+	return []SendFailure{{Records: records}}
+}
+
+// the destination a record still needs, blank is every destination. Only records replayed from a
+// spill file can have one
+func recordTarget(record Record) string {
+	if r, ok := record.(*spilledRecord); ok == true {
+		return r.entry.Target
+	}
+	return ""
+}
+
+// OutboundRecord - a record as written by the sinks that do not use SQS messages
+type OutboundRecord struct {
+	Id          string `json:"id"`
+	Source      string `json:"source"`
+	Type        string `json:"type"`
+	Operation   string `json:"operation"`
+	Payload     string `json:"payload"`            // base64 encoded MARC, gzipped first if the encoding is gzip
+	Encoding    string `json:"encoding,omitempty"` // the payload encoding
+	Traceparent string `json:"traceparent,omitempty"`
+
+	Provenance map[string]string `json:"provenance,omitempty"` // the configured provenance attributes
+}
+
+func newOutboundRecord(record Record, traceparent string, compress bool, provenance []string) OutboundRecord {
+	id, _ := record.Id()
+	return OutboundRecord{
+		Id:          id,
+		Source:      record.Source(),
+		Type:        awssqs.AttributeValueRecordTypeB64Marc,
+		Operation:   awssqs.AttributeValueRecordOperationUpdate,
+		Payload:     string(outboundPayload(record, compress)),
+		Encoding:    payloadEncoding(compress),
+		Traceparent: traceparent,
+		Provenance:  provenanceMap(record, provenance),
+	}
+}
+
+// create the outbound sink(s) from the configuration. If any data sources use a sink other
+// than the default, records are routed by their source
+func newOutboundSink(cfg *ServiceConfig, aws awssqs.AWS_SQS) (Sink, error) {
+
+	sinks := make(map[string]Sink)
+	create := func(name string) (Sink, error) {
+		if s, ok := sinks[name]; ok == true {
+			return s, nil
+		}
+		var s Sink
+		var err error
+		switch name {
+		case SinkSqs:
+			s, err = newSqsSink(cfg, aws)
+		case SinkFile:
+			s, err = newFileSink(cfg.SinkFile, cfg.SinkFileFormat, cfg.CompressPayload, cfg.Provenance)
+		case SinkHttp:
+			s, err = newHttpSink(cfg.SinkHttpUrl, cfg.SinkHttpToken, cfg.CompressPayload, cfg.Provenance)
+		case SinkKafka:
+			s, err = newKafkaSink(cfg.KafkaBrokers, cfg.KafkaTopic, cfg.CompressPayload, cfg.Provenance)
+		default:
+			err = ErrUnknownSink
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s sink: %w", name, err)
+		}
+		log.Printf("INFO: created %s outbound sink", name)
+		sinks[name] = s
+		return s, nil
+	}
+
+	defaultSink, err := create(cfg.Sink)
+	if err != nil {
+		return nil, err
+	}
+	if len(cfg.SourceSinks) == 0 {
+		return defaultSink, nil
+	}
+
+	router := &sinkRouter{defaultSink: defaultSink, bySource: make(map[string]Sink)}
+	for source, name := range cfg.SourceSinks {
+		router.bySource[source], err = create(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return router, nil
+}
+
+// sends each record to the sink configured for its data source
+type sinkRouter struct {
+	defaultSink Sink
+	bySource    map[string]Sink
+}
+
+func (r *sinkRouter) Name() string {
+	return "router"
+}
+
+func (r *sinkRouter) sinkFor(record Record) Sink {
+	if s, ok := r.bySource[record.Source()]; ok == true {
+		return s
+	}
+	return r.defaultSink
+}
+
+func (r *sinkRouter) Send(ctx context.Context, records []Record) (int, error) {
+
+	// split the batch by sink, keeping the record order within each
+	order := make([]Sink, 0, 1)
+	batches := make(map[Sink][]Record)
+	for _, rec := range records {
+		s := r.sinkFor(rec)
+		if _, ok := batches[s]; ok == false {
+			order = append(order, s)
+		}
+		batches[s] = append(batches[s], rec)
+	}
+
+	// a failing sink does not stop the others, only its records need to be sent again
+	sent := 0
+	var failed error
+	failures := make([]SendFailure, 0)
+	for _, s := range order {
+		n, err := s.Send(ctx, batches[s])
+		sent += n
+		if err != nil {
+			if failed == nil {
+				failed = err
+			}
+			failures = append(failures, sendFailures(batches[s], err)...)
+		}
+	}
+	if failed == nil {
+		return sent, nil
+	}
+	if sent == 0 && len(order) == 1 {
+		return 0, failed
+	}
+	return sent, &PartialSendError{Err: failed, Failures: failures}
+}
+
+func (r *sinkRouter) Close() error {
+	var result error
+	closed := make(map[Sink]bool)
+	for _, s := range append([]Sink{r.defaultSink}, r.sinkList()...) {
+		if closed[s] == true {
+			continue
+		}
+		closed[s] = true
+		if err := s.Close(); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+func (r *sinkRouter) sinkList() []Sink {
+	list := make([]Sink, 0, len(r.bySource))
+	for _, s := range r.bySource {
+		list = append(list, s)
+	}
+	return list
+}
+
+//
+// end of file
+//
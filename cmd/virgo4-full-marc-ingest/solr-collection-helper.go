@@ -0,0 +1,310 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+var ErrCollectionVerifyFailed = fmt.Errorf("new collection failed document count verification")
+
+// the format of the timestamp suffix used when naming new collections
+var collectionTimestampFormat = "20060102150405"
+
+// the subset of the collections API responses that we are interested in
+type solrCollectionListResponse struct {
+	Collections []string `json:"collections"`
+}
+
+type solrAliasListResponse struct {
+	Aliases map[string]string `json:"aliases"`
+}
+
+type solrSelectResponse struct {
+	Response struct {
+		NumFound uint64 `json:"numFound"`
+	} `json:"response"`
+}
+
+// create a new collection to ingest into and point the write alias at it. Returns the name of the
+// new collection and the name of the collection the write alias previously referenced (if any)
+func createIngestCollection(cfg *ServiceConfig) (string, string, error) {
+
+	httpClient := newSolrClient(cfg.SolrTimeout)
+
+	// find the collection currently referenced by the write alias so we can restore it if necessary
+	aliases, err := solrListAliases(httpClient, cfg.SolrMaster)
+	if err != nil {
+		return "", "", err
+	}
+	previous := aliases[cfg.SolrWriteAlias]
+
+	collection := fmt.Sprintf("%s_%s", cfg.SolrCollectionPrefix, time.Now().UTC().Format(collectionTimestampFormat))
+	log.Printf("INFO: creating SOLR collection %s (configset %s)", collection, cfg.SolrConfigSet)
+
+	params := url.Values{}
+	params.Set("action", "CREATE")
+	params.Set("name", collection)
+	params.Set("collection.configName", cfg.SolrConfigSet)
+	params.Set("numShards", fmt.Sprintf("%d", cfg.SolrShards))
+	params.Set("replicationFactor", fmt.Sprintf("%d", cfg.SolrReplicas))
+	_, err = solrCollectionsRequest(httpClient, cfg.SolrMaster, params)
+	if err != nil {
+		log.Printf("ERROR: creating SOLR collection %s (%s)", collection, err.Error())
+		return "", "", err
+	}
+
+	// and point the indexers at it
+	err = solrCreateAlias(httpClient, cfg.SolrMaster, cfg.SolrWriteAlias, collection)
+	if err != nil {
+		return "", "", err
+	}
+
+	return collection, previous, nil
+}
+
+// verify the newly populated collection and, if it looks reasonable, point the read alias at it and retire
+// any old collections. If the collection cannot be promoted, the write alias is restored and the new
+// collection removed
+func promoteIngestCollection(cfg *ServiceConfig, collection string, previous string, ingested int) error {
+
+	httpClient := newSolrClient(cfg.SolrTimeout)
+
+	// ensure everything the indexers have sent is visible
+	commitUrl := fmt.Sprintf("%s/%s/update?commit=true", cfg.SolrMaster, collection)
+	_, err := httpPost(httpClient, commitUrl, []byte("<commit/>"))
+	if err != nil {
+		log.Printf("ERROR: committing SOLR collection %s, abandoning it (%s)", collection, err.Error())
+		abandonIngestCollection(cfg, collection, previous)
+		return err
+	}
+
+	count, err := solrDocumentCount(httpClient, cfg.SolrMaster, collection)
+	if err != nil {
+		log.Printf("ERROR: counting SOLR collection %s, abandoning it (%s)", collection, err.Error())
+		abandonIngestCollection(cfg, collection, previous)
+		return err
+	}
+
+	required := uint64(ingested) * uint64(cfg.SolrMinDocPercent) / 100
+	log.Printf("INFO: SOLR collection %s contains %d documents (%d ingested, %d required)", collection, count, ingested, required)
+
+	if count < required || count == 0 {
+		log.Printf("ERROR: SOLR collection %s does not contain enough documents, abandoning it", collection)
+		abandonIngestCollection(cfg, collection, previous)
+		return ErrCollectionVerifyFailed
+	}
+
+	// everything looks OK, clients can now use the new collection
+	err = solrCreateAlias(httpClient, cfg.SolrMaster, cfg.SolrReadAlias, collection)
+	if err != nil {
+		log.Printf("ERROR: pointing SOLR alias %s at %s, abandoning it (%s)", cfg.SolrReadAlias, collection, err.Error())
+		abandonIngestCollection(cfg, collection, previous)
+		return err
+	}
+
+	// retire anything old enough that is no longer referenced, the new collection is already in use so
+	// failing to do so is not a reason to fail the run
+	err = retireOldCollections(cfg, previous)
+	if err != nil {
+		log.Printf("WARNING: retiring old SOLR collections (%s)", err.Error())
+	}
+	return nil
+}
+
+// restore the write alias to its previous collection and remove the abandoned collection
+func abandonIngestCollection(cfg *ServiceConfig, collection string, previous string) {
+
+	httpClient := newSolrClient(cfg.SolrTimeout)
+
+	if previous != "" {
+		err := solrCreateAlias(httpClient, cfg.SolrMaster, cfg.SolrWriteAlias, previous)
+		if err != nil {
+			log.Printf("ERROR: restoring SOLR alias %s to %s (%s)", cfg.SolrWriteAlias, previous, err.Error())
+			// we cannot safely delete the new collection because it is still referenced
+			return
+		}
+	}
+
+	err := solrDeleteCollection(httpClient, cfg.SolrMaster, collection)
+	if err != nil {
+		log.Printf("ERROR: deleting abandoned SOLR collection %s (%s)", collection, err.Error())
+	}
+}
+
+// delete any of our collections that have not been referenced by an alias for the retention period. The
+// collection just replaced is always kept so we can roll back to it
+func retireOldCollections(cfg *ServiceConfig, previous string) error {
+
+	httpClient := newSolrClient(cfg.SolrTimeout)
+
+	aliases, err := solrListAliases(httpClient, cfg.SolrMaster)
+	if err != nil {
+		return err
+	}
+
+	referenced := make(map[string]bool)
+	for _, v := range aliases {
+		// an alias can reference a list of collections
+		for _, c := range strings.Split(v, ",") {
+			referenced[c] = true
+		}
+	}
+
+	body, err := solrCollectionsRequest(httpClient, cfg.SolrMaster, url.Values{"action": []string{"LIST"}})
+	if err != nil {
+		return err
+	}
+
+	collections := solrCollectionListResponse{}
+	err = json.Unmarshal(body, &collections)
+	if err != nil {
+		log.Printf("ERROR: json unmarshal: %s", err)
+		return err
+	}
+
+	// our collections by creation time, the names are timestamped
+	prefix := cfg.SolrCollectionPrefix + "_"
+	ours := make([]string, 0, len(collections.Collections))
+	created := make(map[string]time.Time)
+	for _, c := range collections.Collections {
+		if strings.HasPrefix(c, prefix) == false {
+			continue
+		}
+		t, err := time.Parse(collectionTimestampFormat, strings.TrimPrefix(c, prefix))
+		if err != nil {
+			log.Printf("WARNING: cannot determine age of SOLR collection %s, ignoring it", c)
+			continue
+		}
+		ours = append(ours, c)
+		created[c] = t
+	}
+	sort.Slice(ours, func(i, j int) bool { return created[ours[i]].Before(created[ours[j]]) })
+
+	retainUntil := time.Now().Add(-time.Duration(cfg.SolrRetainHours) * time.Hour)
+	for ix, c := range ours {
+
+		// only consider collections that are no longer in use
+		if referenced[c] == true {
+			continue
+		}
+
+		if c == previous {
+			log.Printf("INFO: retaining previous SOLR collection %s for rollback", c)
+			continue
+		}
+
+		// the ledger knows when the collection was replaced, otherwise it was no earlier than the
+		// creation of the collection that replaced it
+		unaliased := created[c]
+		if ix+1 < len(ours) {
+			unaliased = created[ours[ix+1]]
+		}
+		if cfg.RunLedger == true {
+			replaced, err := ledgerCollectionReplaced(c)
+			if err != nil {
+				return err
+			}
+			if replaced != nil {
+				unaliased = *replaced
+			}
+		}
+
+		if unaliased.After(retainUntil) {
+			log.Printf("INFO: retaining previous SOLR collection %s", c)
+			continue
+		}
+
+		log.Printf("INFO: retiring previous SOLR collection %s", c)
+		err = solrDeleteCollection(httpClient, cfg.SolrMaster, c)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func newSolrClient(timeout int) *http.Client {
+	return &http.Client{
+		Timeout: time.Duration(timeout) * time.Second,
+	}
+}
+
+func solrCollectionsRequest(httpClient *http.Client, endpoint string, params url.Values) ([]byte, error) {
+	params.Set("wt", "json")
+	requestUrl := fmt.Sprintf("%s/admin/collections?%s", endpoint, params.Encode())
+	log.Printf("INFO: URL %s", requestUrl)
+	return httpGet(httpClient, requestUrl)
+}
+
+func solrListAliases(httpClient *http.Client, endpoint string) (map[string]string, error) {
+
+	body, err := solrCollectionsRequest(httpClient, endpoint, url.Values{"action": []string{"LISTALIASES"}})
+	if err != nil {
+		return nil, err
+	}
+
+	aliases := solrAliasListResponse{}
+	err = json.Unmarshal(body, &aliases)
+	if err != nil {
+		log.Printf("ERROR: json unmarshal: %s", err)
+		return nil, err
+	}
+
+	if aliases.Aliases == nil {
+		aliases.Aliases = make(map[string]string)
+	}
+	return aliases.Aliases, nil
+}
+
+func solrCreateAlias(httpClient *http.Client, endpoint string, alias string, collection string) error {
+
+	log.Printf("INFO: pointing SOLR alias %s at %s", alias, collection)
+
+	params := url.Values{}
+	params.Set("action", "CREATEALIAS")
+	params.Set("name", alias)
+	params.Set("collections", collection)
+	_, err := solrCollectionsRequest(httpClient, endpoint, params)
+	if err != nil {
+		log.Printf("ERROR: updating SOLR alias %s (%s)", alias, err.Error())
+	}
+	return err
+}
+
+func solrDeleteCollection(httpClient *http.Client, endpoint string, collection string) error {
+
+	params := url.Values{}
+	params.Set("action", "DELETE")
+	params.Set("name", collection)
+	_, err := solrCollectionsRequest(httpClient, endpoint, params)
+	return err
+}
+
+func solrDocumentCount(httpClient *http.Client, endpoint string, collection string) (uint64, error) {
+
+	countUrl := fmt.Sprintf("%s/%s/select?q=*:*&rows=0&wt=json", endpoint, collection)
+	body, err := httpGet(httpClient, countUrl)
+	if err != nil {
+		return 0, err
+	}
+
+	response := solrSelectResponse{}
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		log.Printf("ERROR: json unmarshal: %s", err)
+		return 0, err
+	}
+
+	return response.Response.NumFound, nil
+}
+
+//
+// end of file
+//
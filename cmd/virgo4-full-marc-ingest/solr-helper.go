@@ -1,14 +1,19 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"strings"
 	"time"
 )
 
-var deletePayloadTemplate = "<delete><query>timestamp:[* TO \"{:before}\"] AND data_source_f:{:datasource}</query></delete>"
+var deleteQueryTemplate = "timestamp:[* TO \"{:before}\"] AND data_source_f:{:datasource}"
+var deletePayloadTemplate = "<delete><query>" + deleteQueryTemplate + "</query></delete>"
 
 func ensureSOLREndpointExists(endpoint string, core string, timeout int) error {
 	log.Printf("INFO: checking SOLR endpoint %s", endpoint)
@@ -24,6 +29,26 @@ func ensureSOLREndpointExists(endpoint string, core string, timeout int) error {
 	return err
 }
 
+// ping the SOLR endpoint once without logging anything, used by the frequent readiness checks
+func pingSOLREndpoint(endpoint string, core string, timeout time.Duration) error {
+
+	httpClient := &http.Client{
+		Timeout: timeout,
+	}
+
+	response, err := httpClient.Get(fmt.Sprintf("%s/%s/admin/ping", endpoint, core))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("request returns HTTP %d", response.StatusCode)
+	}
+	return nil
+}
+
 func deleteOldSolrRecords(endpoint string, core string, timeout int, dataSource string, olderThan time.Time) error {
 	log.Printf("INFO: deleting SOLR records (%s) older than %s", dataSource, olderThan.UTC())
 
@@ -56,6 +81,36 @@ func deleteOldSolrRecords(endpoint string, core string, timeout int, dataSource
 	return nil
 }
 
+// count the SOLR records that deleteOldSolrRecords would delete, used during a dry run
+func countOldSolrRecords(endpoint string, core string, timeout int, dataSource string, olderThan time.Time) (int64, error) {
+	log.Printf("INFO: counting SOLR records (%s) older than %s", dataSource, olderThan.UTC())
+
+	// configure the client
+	httpClient := &http.Client{
+		Timeout: time.Duration(timeout) * time.Second,
+	}
+
+	query := deleteQueryTemplate
+	query = strings.ReplaceAll(query, "{:before}", olderThan.UTC().Format(time.RFC3339))
+	query = strings.ReplaceAll(query, "{:datasource}", dataSource)
+	countUrl := fmt.Sprintf("%s/%s/select?q=%s&rows=0&wt=json", endpoint, core, url.QueryEscape(query))
+	log.Printf("INFO: URL %s", countUrl)
+	body, err := httpGet(httpClient, countUrl)
+	if err != nil {
+		log.Printf("ERROR: counting SOLR records (%s)", err.Error())
+		return 0, err
+	}
+
+	response := solrSelectResponse{}
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		log.Printf("ERROR: json unmarshal: %s", err)
+		return 0, err
+	}
+
+	return int64(response.Response.NumFound), nil
+}
+
 //
 // end of file
 //
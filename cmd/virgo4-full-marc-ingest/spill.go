@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+)
+
+var ErrSpillReplayFailed = fmt.Errorf("one or more spilled records could not be resent")
+
+// the outbound sink and the spill file for records it could not accept, set up by main
+var outboundSink Sink
+var outboundSpill *SpillFile
+
+// SpillEntry - a record that could not be sent
+type SpillEntry struct {
+	Id     string `json:"id"`
+	Source string `json:"source"`
+	Raw    []byte `json:"raw"`              // the MARC record
+	Error  string `json:"error"`            // why it could not be sent
+	Target string `json:"target,omitempty"` // the destination it still needs if it was partly sent (blank is all)
+
+	Provenance *Provenance `json:"provenance,omitempty"` // where the record came from
+}
+
+// SpillFile - the local file failed records are written to so the run can continue
+type SpillFile struct {
+	sync.Mutex
+	dir    string
+	name   string
+	file   *os.File
+	writer *bufio.Writer
+	count  int
+}
+
+// NewSpillFile - create a spill file in the specified directory
+func NewSpillFile(dir string) (*SpillFile, error) {
+	s := &SpillFile{dir: dir}
+	err := s.open()
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *SpillFile) open() error {
+	file, err := ioutil.TempFile(s.dir, "spill-*.jsonl")
+	if err != nil {
+		return err
+	}
+	s.name, s.file, s.writer, s.count = file.Name(), file, bufio.NewWriter(file), 0
+	return nil
+}
+
+// Spill - spill the records a send did not deliver, only those that failed if it was partly sent.
+// Returns the records spilled
+func (s *SpillFile) Spill(records []Record, cause error) ([]Record, error) {
+
+	spilled := make([]Record, 0, len(records))
+	for _, f := range sendFailures(records, cause) {
+		err := s.Add(f.Records, f.Target, cause)
+		if err != nil {
+			return spilled, err
+		}
+		spilled = append(spilled, f.Records...)
+	}
+	return spilled, nil
+}
+
+// Add - spill a batch of records that still need sending to the target (blank is everywhere)
+func (s *SpillFile) Add(records []Record, target string, cause error) error {
+
+	s.Lock()
+	defer s.Unlock()
+
+	for _, rec := range records {
+		id, _ := rec.Id()
+		// a replayed record that only needed some destinations still only needs them
+		recTarget := target
+		if recTarget == "" {
+			recTarget = recordTarget(rec)
+		}
+		buf, err := json.Marshal(SpillEntry{Id: id, Source: rec.Source(), Raw: rec.Raw(), Error: cause.Error(), Target: recTarget, Provenance: rec.Provenance()})
+		if err != nil {
+			return err
+		}
+		_, err = s.writer.Write(append(buf, '\n'))
+		if err != nil {
+			return err
+		}
+		s.count++
+	}
+	metricRecordsSpilled.Add(float64(len(records)))
+
+	// the records are considered done once they are spilled so make sure they are on disk
+	return s.writer.Flush()
+}
+
+// Count - the number of records spilled to the current file
+func (s *SpillFile) Count() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.count
+}
+
+// Take - close the current file and start a new one. Returns the name of the closed file and the
+// number of records in it; the caller is responsible for it
+func (s *SpillFile) Take() (string, int, error) {
+
+	s.Lock()
+	defer s.Unlock()
+
+	err := s.writer.Flush()
+	if err == nil {
+		err = s.file.Close()
+	} else {
+		s.file.Close()
+	}
+	if err != nil {
+		return "", 0, err
+	}
+
+	name, count := s.name, s.count
+	return name, count, s.open()
+}
+
+// spilledRecord - a record read back from a spill file
+type spilledRecord struct {
+	entry    SpillEntry
+	sequence uint64
+	payload  []byte
+}
+
+func (r *spilledRecord) Id() (string, error)         { return r.entry.Id, nil }
+func (r *spilledRecord) Source() string              { return r.entry.Source }
+func (r *spilledRecord) SetSource(source string)     { r.entry.Source = source }
+func (r *spilledRecord) Raw() []byte                 { return r.entry.Raw }
+func (r *spilledRecord) SetRaw(raw []byte)           { r.entry.Raw, r.payload = raw, nil }
+func (r *spilledRecord) Merged() int                 { return 0 }
+func (r *spilledRecord) Repaired() bool              { return false }
+func (r *spilledRecord) Sequence() uint64            { return r.sequence }
+func (r *spilledRecord) SetSequence(sequence uint64) { r.sequence = sequence }
+func (r *spilledRecord) Payload() []byte             { return r.payload }
+func (r *spilledRecord) SetPayload(payload []byte)   { r.payload = payload }
+func (r *spilledRecord) Provenance() *Provenance     { return r.entry.Provenance }
+func (r *spilledRecord) SetProvenance(p *Provenance) { r.entry.Provenance = p }
+
+func (r *spilledRecord) Offset() int64 {
+	if r.entry.Provenance == nil {
+		return 0
+	}
+	return r.entry.Provenance.Offset
+}
+
+// resend the records in a spill file. Records that still cannot be sent are written to a new spill
+// file whose name is returned along with the number of records resent
+func replaySpillFile(ctx context.Context, cfg *ServiceConfig, sink Sink, name string) (int, string, error) {
+
+	file, err := os.Open(name)
+	if err != nil {
+		return 0, "", err
+	}
+	defer file.Close()
+
+	var failed *SpillFile
+	replayed := 0
+	batch := make([]Record, 0, awssqs.MAX_SQS_BLOCK_COUNT)
+	batchBytes := 0
+
+	send := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		_, sendErr := sink.Send(ctx, batch)
+		if sendErr != nil {
+			log.Printf("WARNING: resending %d spilled records failed (%s)", len(batch), sendErr.Error())
+			var err error
+			if failed == nil {
+				failed, err = NewSpillFile(cfg.DownloadDir)
+				if err != nil {
+					return err
+				}
+			}
+			spilled, err := failed.Spill(batch, sendErr)
+			if err != nil {
+				return err
+			}
+			replayed += len(batch) - len(spilled)
+		} else {
+			replayed += len(batch)
+		}
+		batch = batch[:0]
+		batchBytes = 0
+		return nil
+	}
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) != 0 {
+			entry := SpillEntry{}
+			if jerr := json.Unmarshal(line, &entry); jerr != nil {
+				return replayed, "", jerr
+			}
+			rec := &spilledRecord{entry: entry}
+			size := outboundSize(rec, cfg.CompressPayload)
+			if len(batch) != 0 && batchBytes+size > cfg.MaxBatchBytes {
+				if serr := send(); serr != nil {
+					return replayed, "", serr
+				}
+			}
+			batch = append(batch, rec)
+			batchBytes += size
+			if uint(len(batch)) == awssqs.MAX_SQS_BLOCK_COUNT {
+				if serr := send(); serr != nil {
+					return replayed, "", serr
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return replayed, "", err
+		}
+	}
+	if err := send(); err != nil {
+		return replayed, "", err
+	}
+
+	if failed == nil {
+		return replayed, "", nil
+	}
+	failedName, _, err := failed.Take()
+	failed.Remove()
+	if err != nil {
+		return replayed, "", err
+	}
+	return replayed, failedName, ErrSpillReplayFailed
+}
+
+// Remove - close and remove the current spill file
+func (s *SpillFile) Remove() {
+	s.Lock()
+	defer s.Unlock()
+	s.file.Close()
+	_ = os.Remove(s.name)
+}
+
+//
+// end of file
+//
@@ -23,7 +23,12 @@ func ensureQueuesExist(aws awssqs.AWS_SQS, queues []string) error {
 
 func ensureQueuesIdle(aws awssqs.AWS_SQS, queues []string, polltime int, timeout int) error {
 
+	result := "error"
+
 	start := time.Now()
+	defer func() {
+		metricIdleWaitDuration.WithLabelValues(result).Observe(time.Since(start).Seconds())
+	}()
 	idleCount := 0 // we to handle in-flight too so we wait for 3 idle iterations
 	for {
 		// get counts for all the queues we are interested in
@@ -37,6 +42,7 @@ func ensureQueuesIdle(aws awssqs.AWS_SQS, queues []string, polltime int, timeout
 			idleCount++
 			if idleCount == 3 {
 				log.Printf("INFO: all queues are now idle")
+				result = "idle"
 				return nil
 			}
 		} else {
@@ -47,6 +53,7 @@ func ensureQueuesIdle(aws awssqs.AWS_SQS, queues []string, polltime int, timeout
 		elapsed := int64(time.Since(start) / time.Second)
 		if elapsed >= int64(timeout) {
 			log.Printf("ERROR: queues not idle after %d seconds, giving up", timeout)
+			result = "timeout"
 			return ErrQueuesNotIdle
 		}
 
@@ -75,6 +82,7 @@ func getQueueMessageCount(aws awssqs.AWS_SQS, queue string) (uint, error) {
 	if err != nil {
 		return 0, err
 	}
+	metricQueueDepth.WithLabelValues(queue).Set(float64(count))
 	if count > 0 {
 		log.Printf("INFO: queue %s still contains %d items", queue, count)
 	}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+	"golang.org/x/time/rate"
+)
+
+// how often a held reader checks whether it can continue
+var backpressureCheckTime = 1 * time.Second
+
+// OutboundThrottle - limits the rate records are sent, shared by all the workers
+type OutboundThrottle struct {
+	records *rate.Limiter // nil if records are not limited
+	batches *rate.Limiter // nil if batches are not limited
+}
+
+// NewOutboundThrottle - create the throttle from the configuration
+func NewOutboundThrottle(cfg *ServiceConfig) *OutboundThrottle {
+
+	t := &OutboundThrottle{}
+	if cfg.MaxRecordsPerSecond > 0 {
+		// the burst must allow a complete batch
+		burst := cfg.MaxRecordsPerSecond
+		if burst < int(awssqs.MAX_SQS_BLOCK_COUNT) {
+			burst = int(awssqs.MAX_SQS_BLOCK_COUNT)
+		}
+		t.records = rate.NewLimiter(rate.Limit(cfg.MaxRecordsPerSecond), burst)
+	}
+	if cfg.MaxBatchesPerSecond > 0 {
+		t.batches = rate.NewLimiter(rate.Limit(cfg.MaxBatchesPerSecond), 1)
+	}
+	return t
+}
+
+// Wait - block until a batch of the specified size can be sent
+func (t *OutboundThrottle) Wait(records int) {
+
+	start := time.Now()
+	if t.batches != nil {
+		// cannot fail with a background context and a burst of 1
+		_ = t.batches.Wait(context.Background())
+	}
+	if t.records != nil {
+		_ = t.records.WaitN(context.Background(), records)
+	}
+	if waited := time.Since(start); waited > time.Millisecond {
+		metricThrottleWait.Add(waited.Seconds())
+	}
+}
+
+// Backpressure - holds the reader while the outbound queues are backed up
+type Backpressure struct {
+	sync.Mutex
+	aws       awssqs.AWS_SQS
+	queues    []string
+	highWater uint
+	lowWater  uint
+	pollTime  time.Duration
+	engaged   bool
+	done      chan struct{}
+}
+
+// NewBackpressure - create the backpressure monitor, returns nil if it is not configured
+func NewBackpressure(cfg *ServiceConfig, aws awssqs.AWS_SQS) *Backpressure {
+	if cfg.BackpressureHighWater == 0 || len(cfg.BackpressureQueues) == 0 {
+		return nil
+	}
+	return &Backpressure{
+		aws:       aws,
+		queues:    cfg.BackpressureQueues,
+		highWater: uint(cfg.BackpressureHighWater),
+		lowWater:  uint(cfg.BackpressureLowWater),
+		pollTime:  time.Duration(cfg.BackpressurePollTime) * time.Second,
+		done:      make(chan struct{}),
+	}
+}
+
+// Start - start monitoring the queues
+func (b *Backpressure) Start() {
+	log.Printf("INFO: monitoring %v for backpressure (high water %d, low water %d)", b.queues, b.highWater, b.lowWater)
+	go b.monitor()
+}
+
+// Stop - stop monitoring the queues and release the reader
+func (b *Backpressure) Stop() {
+	close(b.done)
+	b.setEngaged(false)
+}
+
+// Engaged - is the reader being held
+func (b *Backpressure) Engaged() bool {
+	b.Lock()
+	defer b.Unlock()
+	return b.engaged
+}
+
+// Wait - block while the queues are backed up, returns early if the run is aborted
+func (b *Backpressure) Wait(control *RunControl) {
+	if b.Engaged() == false {
+		return
+	}
+	control.setHeld(true)
+	defer control.setHeld(false)
+	for b.Engaged() == true && control.Aborted() == false {
+		time.Sleep(backpressureCheckTime)
+	}
+}
+
+func (b *Backpressure) monitor() {
+	for {
+		b.check()
+		select {
+		case <-b.done:
+			return
+		case <-time.After(b.pollTime):
+		}
+	}
+}
+
+// engage above the high water mark and release at or below the low water mark
+func (b *Backpressure) check() {
+
+	depth := uint(0)
+	for _, q := range b.queues {
+		count, err := b.aws.GetMessagesAvailable(q)
+		if err != nil {
+			// leave things as they are, we will try again
+			log.Printf("WARNING: unable to get the depth of %s for backpressure (%s)", q, err.Error())
+			return
+		}
+		metricQueueDepth.WithLabelValues(q).Set(float64(count))
+		if count > depth {
+			depth = count
+		}
+	}
+
+	if b.Engaged() == false && depth > b.highWater {
+		log.Printf("WARNING: outbound queue depth %d is above %d, holding the reader", depth, b.highWater)
+		b.setEngaged(true)
+	} else if b.Engaged() == true && depth <= b.lowWater {
+		log.Printf("INFO: outbound queue depth %d is at or below %d, releasing the reader", depth, b.lowWater)
+		b.setEngaged(false)
+	}
+}
+
+func (b *Backpressure) setEngaged(engaged bool) {
+	b.Lock()
+	defer b.Unlock()
+	b.engaged = engaged
+	if engaged == true {
+		metricBackpressure.Set(1)
+	} else {
+		metricBackpressure.Set(0)
+	}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// the message attribute used to propagate the trace to downstream services
+var traceMessageAttribute = "traceparent"
+
+// the time allowed to flush spans on shutdown
+var traceShutdownTimeout = 5 * time.Second
+
+// the tracer used for all our spans. Until tracing is configured this is a no-op
+var tracer = otel.Tracer("github.com/uvalib/virgo4-full-marc-ingest")
+
+// the context outbound batches are traced under, the file being ingested
+var batchContext = context.Background()
+var batchContextLock sync.Mutex
+
+// configure tracing if a collector has been specified
+func initTracing(cfg *ServiceConfig) {
+
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	if cfg.TraceEndpoint == "" {
+		log.Printf("INFO: tracing disabled, no collector configured")
+		return
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(cfg.TraceEndpoint))
+	fatalIfError(err)
+
+	res := resource.NewWithAttributes(semconv.SchemaURL,
+		semconv.ServiceName(cfg.TraceServiceName),
+		semconv.ServiceVersion(Version()),
+		attribute.String("data_source", cfg.DataSource),
+	)
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.TraceSampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	log.Printf("INFO: exporting traces to %s", cfg.TraceEndpoint)
+
+	// make sure the spans of a failed run are exported before we terminate
+	onFatalError(func(err error) {
+		ctx, cancel := context.WithTimeout(context.Background(), traceShutdownTimeout)
+		defer cancel()
+		_ = provider.Shutdown(ctx)
+	})
+}
+
+// end a span, noting the error (if any)
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// set the context outbound batches are traced under
+func setBatchContext(ctx context.Context) {
+	batchContextLock.Lock()
+	defer batchContextLock.Unlock()
+	batchContext = ctx
+}
+
+func getBatchContext() context.Context {
+	batchContextLock.Lock()
+	defer batchContextLock.Unlock()
+	return batchContext
+}
+
+// the W3C traceparent for the context (blank if it is not traced)
+func traceParent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	return carrier.Get(traceMessageAttribute)
+}
+
+// the message attributes that propagate the trace (if any)
+func traceAttributes(ctx context.Context) []awssqs.Attribute {
+	value := traceParent(ctx)
+	if value == "" {
+		return nil
+	}
+	return []awssqs.Attribute{{Name: traceMessageAttribute, Value: value}}
+}
+
+//
+// end of file
+//
@@ -0,0 +1,336 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var ErrBadTransform = fmt.Errorf("bad transform")
+
+// the transform operations
+const (
+	TransformAddField       = "add-field"       // add a field, in tag order
+	TransformRemoveField    = "remove-field"    // remove the matching fields
+	TransformAddSubfield    = "add-subfield"    // add a subfield to the matching fields
+	TransformRemoveSubfield = "remove-subfield" // remove the matching subfields
+	TransformReplace        = "replace"         // regex replace within control field or subfield values
+	TransformSetLeader      = "set-leader"      // set leader positions
+)
+
+// TransformStep - a single step in the transform pipeline. Field patterns can use x as a wildcard,
+// e.g. "9xx". For example:
+//
+//	{"op": "add-field", "field": "949", "subfields": [["a", "sirsi"]], "sources": ["sirsi"]}
+//	{"op": "remove-field", "field": "99x"}
+//	{"op": "remove-field", "field": "856", "subfield": "u", "match": "vendor\\.example\\.com"}
+//	{"op": "replace", "field": "001", "match": "^(ocm|ocn)", "replace": ""}
+//	{"op": "set-leader", "position": "09", "value": "a"}
+type TransformStep struct {
+	Op         string      `json:"op"`
+	Sources    []string    `json:"sources,omitempty"`    // the data sources the step applies to (blank is all)
+	Field      string      `json:"field,omitempty"`      // the field tag or pattern
+	Indicators string      `json:"indicators,omitempty"` // the indicators of an added data field (default blanks)
+	Subfield   string      `json:"subfield,omitempty"`   // the subfield code
+	Subfields  [][2]string `json:"subfields,omitempty"`  // the code and value of each subfield of an added data field
+	Value      string      `json:"value,omitempty"`      // the value of an added control field or subfield, or the leader value
+	Position   string      `json:"position,omitempty"`   // the leader position or range, e.g. "09" or "05-06"
+	Match      string      `json:"match,omitempty"`      // a regex the value must match (optional except for replace)
+	Replace    string      `json:"replace,omitempty"`    // the replacement, may refer to match groups ($1)
+
+	start   int            // the parsed leader position
+	end     int            // the end of the parsed leader position (exclusive)
+	pattern *regexp.Regexp // the compiled match
+}
+
+// RecordTransformer - the configured transform pipeline
+type RecordTransformer struct {
+	steps []*TransformStep
+}
+
+// NewRecordTransformer - parse the transform steps (a JSON array), returns nil if there are none
+func NewRecordTransformer(config string) (*RecordTransformer, error) {
+
+	if strings.TrimSpace(config) == "" {
+		return nil, nil
+	}
+
+	steps := make([]*TransformStep, 0)
+	err := json.Unmarshal([]byte(config), &steps)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrBadTransform, err.Error())
+	}
+
+	for ix, step := range steps {
+		err = step.prepare()
+		if err != nil {
+			return nil, fmt.Errorf("%w: step %d (%s): %s", ErrBadTransform, ix+1, step.Op, err.Error())
+		}
+	}
+
+	if len(steps) == 0 {
+		return nil, nil
+	}
+	return &RecordTransformer{steps: steps}, nil
+}
+
+// Ops - the step operations, in order
+func (t *RecordTransformer) Ops() []string {
+	ops := make([]string, 0, len(t.steps))
+	for _, step := range t.steps {
+		ops = append(ops, step.Op)
+	}
+	return ops
+}
+
+// ChangesField - can any step change the fields with the specified tag
+func (t *RecordTransformer) ChangesField(tag string) bool {
+	for _, step := range t.steps {
+		if step.Op != TransformSetLeader && tagMatches(step.Field, tag) == true {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *TransformStep) prepare() error {
+
+	if t.Match != "" {
+		pattern, err := regexp.Compile(t.Match)
+		if err != nil {
+			return err
+		}
+		t.pattern = pattern
+	}
+	if t.Subfield != "" && len(t.Subfield) != 1 {
+		return fmt.Errorf("subfield must be a single code")
+	}
+
+	switch t.Op {
+	case TransformAddField:
+		if len(t.Field) != 3 || strings.ContainsAny(t.Field, "xX") == true {
+			return fmt.Errorf("field must be a 3 character tag")
+		}
+		if strings.HasPrefix(t.Field, "00") == true {
+			if t.Value == "" {
+				return fmt.Errorf("value is required for a control field")
+			}
+			return nil
+		}
+		if t.Indicators == "" {
+			t.Indicators = "  "
+		}
+		if len(t.Indicators) != 2 {
+			return fmt.Errorf("indicators must be 2 characters")
+		}
+		if len(t.Subfields) == 0 {
+			return fmt.Errorf("subfields are required for a data field")
+		}
+		for _, sub := range t.Subfields {
+			if len(sub[0]) != 1 {
+				return fmt.Errorf("subfield codes must be a single character")
+			}
+		}
+
+	case TransformRemoveField:
+		if len(t.Field) != 3 {
+			return fmt.Errorf("field must be a 3 character tag or pattern")
+		}
+
+	case TransformAddSubfield, TransformRemoveSubfield:
+		if len(t.Field) != 3 || t.Subfield == "" {
+			return fmt.Errorf("field and subfield are required")
+		}
+		if t.Op == TransformAddSubfield && t.Value == "" {
+			return fmt.Errorf("value is required")
+		}
+
+	case TransformReplace:
+		if len(t.Field) != 3 || t.pattern == nil {
+			return fmt.Errorf("field and match are required")
+		}
+		if strings.HasPrefix(t.Field, "00") == false && t.Subfield == "" {
+			return fmt.Errorf("subfield is required for a data field")
+		}
+
+	case TransformSetLeader:
+		from, to, found := strings.Cut(t.Position, "-")
+		start, err := strconv.Atoi(from)
+		if err != nil || start < 0 {
+			return fmt.Errorf("position invalid (%s)", t.Position)
+		}
+		end := start
+		if found == true {
+			end, err = strconv.Atoi(to)
+			if err != nil || end < start {
+				return fmt.Errorf("position invalid (%s)", t.Position)
+			}
+		}
+		// the length and base address are calculated when the record is serialized
+		if end >= marcLeaderSize || (start <= 16 && end >= 12) || start <= 4 {
+			return fmt.Errorf("position %s cannot be set", t.Position)
+		}
+		if len(t.Value) != end-start+1 {
+			return fmt.Errorf("value must be %d characters", end-start+1)
+		}
+		t.start, t.end = start, end+1
+
+	default:
+		return fmt.Errorf("unknown operation")
+	}
+	return nil
+}
+
+// Apply - transform a record, returns true if any steps were applied. Records that cannot be parsed
+// or serialized again are left unchanged
+func (t *RecordTransformer) Apply(record Record) (bool, error) {
+
+	steps := make([]*TransformStep, 0, len(t.steps))
+	for _, step := range t.steps {
+		if appliesToSource(step.Sources, record.Source()) == true {
+			steps = append(steps, step)
+		}
+	}
+	if len(steps) == 0 {
+		return false, nil
+	}
+
+	parsed, err := parseMarcRecords(record.Raw())
+	if err != nil {
+		return false, err
+	}
+
+	// records sharing an id are merged, each is transformed
+	raw := make([]byte, 0, len(record.Raw()))
+	for _, m := range parsed {
+		for _, step := range steps {
+			step.apply(m)
+		}
+		buf, err := m.Bytes()
+		if err != nil {
+			return false, err
+		}
+		raw = append(raw, buf...)
+	}
+
+	record.SetRaw(raw)
+	return true, nil
+}
+
+func (t *TransformStep) apply(record *MarcRecord) {
+
+	switch t.Op {
+	case TransformAddField:
+		field := MarcField{Tag: t.Field}
+		if field.IsControl() == true {
+			field.Value = t.Value
+		} else {
+			field.Indicator1, field.Indicator2 = t.Indicators[0], t.Indicators[1]
+			for _, sub := range t.Subfields {
+				field.Subfields = append(field.Subfields, MarcSubfield{Code: sub[0][0], Value: sub[1]})
+			}
+		}
+		// after any fields with the same or a lower tag
+		ix := len(record.Fields)
+		for i := range record.Fields {
+			if record.Fields[i].Tag > t.Field {
+				ix = i
+				break
+			}
+		}
+		record.Fields = append(record.Fields[:ix], append([]MarcField{field}, record.Fields[ix:]...)...)
+
+	case TransformRemoveField:
+		fields := record.Fields[:0]
+		for _, f := range record.Fields {
+			if tagMatches(t.Field, f.Tag) == false || t.fieldMatches(&f) == false {
+				fields = append(fields, f)
+			}
+		}
+		record.Fields = fields
+
+	case TransformAddSubfield:
+		for ix := range record.Fields {
+			f := &record.Fields[ix]
+			if f.IsControl() == false && tagMatches(t.Field, f.Tag) == true {
+				f.Subfields = append(f.Subfields, MarcSubfield{Code: t.Subfield[0], Value: t.Value})
+			}
+		}
+
+	case TransformRemoveSubfield:
+		for ix := range record.Fields {
+			f := &record.Fields[ix]
+			if f.IsControl() == true || tagMatches(t.Field, f.Tag) == false {
+				continue
+			}
+			subfields := f.Subfields[:0]
+			for _, sub := range f.Subfields {
+				if sub.Code != t.Subfield[0] || t.valueMatches(sub.Value) == false {
+					subfields = append(subfields, sub)
+				}
+			}
+			f.Subfields = subfields
+		}
+
+	case TransformReplace:
+		for ix := range record.Fields {
+			f := &record.Fields[ix]
+			if tagMatches(t.Field, f.Tag) == false {
+				continue
+			}
+			if f.IsControl() == true {
+				f.Value = t.pattern.ReplaceAllString(f.Value, t.Replace)
+				continue
+			}
+			for s := range f.Subfields {
+				if f.Subfields[s].Code == t.Subfield[0] {
+					f.Subfields[s].Value = t.pattern.ReplaceAllString(f.Subfields[s].Value, t.Replace)
+				}
+			}
+		}
+
+	case TransformSetLeader:
+		leader := []byte(record.Leader)
+		copy(leader[t.start:t.end], t.Value)
+		record.Leader = string(leader)
+	}
+}
+
+// does the field satisfy the (optional) subfield and match of the step
+func (t *TransformStep) fieldMatches(f *MarcField) bool {
+	if t.pattern == nil && t.Subfield == "" {
+		return true
+	}
+	if f.IsControl() == true {
+		return t.valueMatches(f.Value)
+	}
+	for _, sub := range f.Subfields {
+		if (t.Subfield == "" || sub.Code == t.Subfield[0]) && t.valueMatches(sub.Value) == true {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *TransformStep) valueMatches(value string) bool {
+	return t.pattern == nil || t.pattern.MatchString(value)
+}
+
+// does a tag match a pattern, x matches any character
+func tagMatches(pattern string, tag string) bool {
+	if len(pattern) != len(tag) {
+		return false
+	}
+	for ix := 0; ix < len(pattern); ix++ {
+		if pattern[ix] != 'x' && pattern[ix] != 'X' && pattern[ix] != tag[ix] {
+			return false
+		}
+	}
+	return true
+}
+
+//
+// end of file
+//
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestNewRecordTransformer(t *testing.T) {
+
+	tests := []struct {
+		name   string
+		config string
+		steps  int
+		err    bool
+	}{
+		{"blank", "", 0, false},
+		{"empty array", "[]", 0, false},
+		{"add data field", `[{"op": "add-field", "field": "949", "subfields": [["a", "sirsi"]]}]`, 1, false},
+		{"add control field", `[{"op": "add-field", "field": "003", "value": "ViU"}]`, 1, false},
+		{"several", `[{"op": "remove-field", "field": "99x"}, {"op": "set-leader", "position": "09", "value": "a"}]`, 2, false},
+		{"not JSON", `[{"op": }]`, 0, true},
+		{"unknown op", `[{"op": "rename-field", "field": "245"}]`, 0, true},
+		{"add field pattern", `[{"op": "add-field", "field": "9xx", "subfields": [["a", "x"]]}]`, 0, true},
+		{"add control field without value", `[{"op": "add-field", "field": "003"}]`, 0, true},
+		{"add data field without subfields", `[{"op": "add-field", "field": "949"}]`, 0, true},
+		{"bad indicators", `[{"op": "add-field", "field": "949", "indicators": "1", "subfields": [["a", "x"]]}]`, 0, true},
+		{"bad subfield code", `[{"op": "add-field", "field": "949", "subfields": [["ab", "x"]]}]`, 0, true},
+		{"add subfield without value", `[{"op": "add-subfield", "field": "949", "subfield": "a"}]`, 0, true},
+		{"replace without match", `[{"op": "replace", "field": "001", "replace": ""}]`, 0, true},
+		{"replace data field without subfield", `[{"op": "replace", "field": "245", "match": "x"}]`, 0, true},
+		{"set record length", `[{"op": "set-leader", "position": "00-04", "value": "00000"}]`, 0, true},
+		{"set base address", `[{"op": "set-leader", "position": "12", "value": "0"}]`, 0, true},
+		{"set beyond the leader", `[{"op": "set-leader", "position": "24", "value": "x"}]`, 0, true},
+		{"set value length", `[{"op": "set-leader", "position": "05-06", "value": "x"}]`, 0, true},
+		{"bad regex", `[{"op": "remove-field", "field": "856", "match": "("}]`, 0, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transformer, err := NewRecordTransformer(test.config)
+			if test.err == true {
+				if errors.Is(err, ErrBadTransform) == false {
+					t.Errorf("got %v, expected %v", err, ErrBadTransform)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			steps := 0
+			if transformer != nil {
+				steps = len(transformer.Ops())
+			}
+			if steps != test.steps {
+				t.Errorf("got %d steps, expected %d", steps, test.steps)
+			}
+		})
+	}
+}
+
+func TestTransformSteps(t *testing.T) {
+
+	input := testMarcRecord('a', "001 ocm12345", "245 00‡aTitle", "856 40‡uhttp://vendor.example.com/1", "856 40‡uhttp://other.example.com/2", "991   ‡alocal", "999   ‡aX1‡xshadow")
+
+	tests := []struct {
+		name     string
+		config   string
+		source   string
+		expected []byte
+		applied  bool
+	}{
+		{
+			"add data field in tag order",
+			`[{"op": "add-field", "field": "500", "subfields": [["a", "Note"]]}]`, "test",
+			testMarcRecord('a', "001 ocm12345", "245 00‡aTitle", "500   ‡aNote", "856 40‡uhttp://vendor.example.com/1", "856 40‡uhttp://other.example.com/2", "991   ‡alocal", "999   ‡aX1‡xshadow"),
+			true,
+		},
+		{
+			"add control field",
+			`[{"op": "add-field", "field": "003", "value": "ViU"}]`, "test",
+			testMarcRecord('a', "001 ocm12345", "003 ViU", "245 00‡aTitle", "856 40‡uhttp://vendor.example.com/1", "856 40‡uhttp://other.example.com/2", "991   ‡alocal", "999   ‡aX1‡xshadow"),
+			true,
+		},
+		{
+			"remove fields by pattern",
+			`[{"op": "remove-field", "field": "99x"}]`, "test",
+			testMarcRecord('a', "001 ocm12345", "245 00‡aTitle", "856 40‡uhttp://vendor.example.com/1", "856 40‡uhttp://other.example.com/2"),
+			true,
+		},
+		{
+			"remove matching fields",
+			`[{"op": "remove-field", "field": "856", "subfield": "u", "match": "vendor\\.example\\.com"}]`, "test",
+			testMarcRecord('a', "001 ocm12345", "245 00‡aTitle", "856 40‡uhttp://other.example.com/2", "991   ‡alocal", "999   ‡aX1‡xshadow"),
+			true,
+		},
+		{
+			"add subfield",
+			`[{"op": "add-subfield", "field": "245", "subfield": "h", "value": "[electronic resource]"}]`, "test",
+			testMarcRecord('a', "001 ocm12345", "245 00‡aTitle‡h[electronic resource]", "856 40‡uhttp://vendor.example.com/1", "856 40‡uhttp://other.example.com/2", "991   ‡alocal", "999   ‡aX1‡xshadow"),
+			true,
+		},
+		{
+			"remove subfield",
+			`[{"op": "remove-subfield", "field": "999", "subfield": "x"}]`, "test",
+			testMarcRecord('a', "001 ocm12345", "245 00‡aTitle", "856 40‡uhttp://vendor.example.com/1", "856 40‡uhttp://other.example.com/2", "991   ‡alocal", "999   ‡aX1"),
+			true,
+		},
+		{
+			"replace in a control field",
+			`[{"op": "replace", "field": "001", "match": "^(ocm|ocn)", "replace": ""}]`, "test",
+			testMarcRecord('a', "001 12345", "245 00‡aTitle", "856 40‡uhttp://vendor.example.com/1", "856 40‡uhttp://other.example.com/2", "991   ‡alocal", "999   ‡aX1‡xshadow"),
+			true,
+		},
+		{
+			"replace with a group",
+			`[{"op": "replace", "field": "856", "subfield": "u", "match": "^http://(.*)$", "replace": "https://$1"}]`, "test",
+			testMarcRecord('a', "001 ocm12345", "245 00‡aTitle", "856 40‡uhttps://vendor.example.com/1", "856 40‡uhttps://other.example.com/2", "991   ‡alocal", "999   ‡aX1‡xshadow"),
+			true,
+		},
+		{
+			"set leader",
+			`[{"op": "set-leader", "position": "05-06", "value": "cm"}]`, "test",
+			func() []byte {
+				raw := append([]byte{}, input...)
+				copy(raw[5:7], "cm")
+				return raw
+			}(),
+			true,
+		},
+		{
+			"steps in order",
+			`[{"op": "remove-field", "field": "856"}, {"op": "add-field", "field": "856", "indicators": "41", "subfields": [["u", "http://new"]]}]`, "test",
+			testMarcRecord('a', "001 ocm12345", "245 00‡aTitle", "856 41‡uhttp://new", "991   ‡alocal", "999   ‡aX1‡xshadow"),
+			true,
+		},
+		{
+			"step for the source",
+			`[{"op": "remove-field", "field": "99x", "sources": ["sirsi"]}]`, "sirsi",
+			testMarcRecord('a', "001 ocm12345", "245 00‡aTitle", "856 40‡uhttp://vendor.example.com/1", "856 40‡uhttp://other.example.com/2"),
+			true,
+		},
+		{
+			"step for another source",
+			`[{"op": "remove-field", "field": "99x", "sources": ["sirsi"]}]`, "hathi",
+			input,
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transformer, err := NewRecordTransformer(test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := testRecord(append([]byte{}, input...))
+			rec.SetSource(test.source)
+			applied, err := transformer.Apply(rec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if applied != test.applied {
+				t.Errorf("got applied %t, expected %t", applied, test.applied)
+			}
+			if bytes.Equal(rec.Raw(), test.expected) == false {
+				t.Errorf("got %q, expected %q", rec.Raw(), test.expected)
+			}
+		})
+	}
+}
+
+func TestTransformMergedRecords(t *testing.T) {
+
+	first := testMarcRecord('a', "001 ocm1", "245 00‡aFirst")
+	second := testMarcRecord('a', "001 ocm1", "245 00‡aSecond")
+	transformer, err := NewRecordTransformer(`[{"op": "replace", "field": "001", "match": "^ocm", "replace": ""}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := testRecord(append(append([]byte{}, first...), second...))
+	if _, err = transformer.Apply(rec); err != nil {
+		t.Fatal(err)
+	}
+	expected := append(testMarcRecord('a', "001 1", "245 00‡aFirst"), testMarcRecord('a', "001 1", "245 00‡aSecond")...)
+	if bytes.Equal(rec.Raw(), expected) == false {
+		t.Errorf("got %q, expected %q", rec.Raw(), expected)
+	}
+	if id, _ := rec.Id(); id != "1" {
+		t.Errorf("got id %s, expected 1", id)
+	}
+}
+
+func TestTransformerChangesField(t *testing.T) {
+
+	tests := []struct {
+		name     string
+		config   string
+		expected bool
+	}{
+		{"replace the id", `[{"op": "replace", "field": "001", "match": "^ocm", "replace": ""}]`, true},
+		{"remove by pattern", `[{"op": "remove-field", "field": "00x"}]`, true},
+		{"other fields", `[{"op": "remove-field", "field": "99x"}, {"op": "add-field", "field": "003", "value": "ViU"}]`, false},
+		{"leader only", `[{"op": "set-leader", "position": "09", "value": "a"}]`, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			transformer, err := NewRecordTransformer(test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := transformer.ChangesField("001"); got != test.expected {
+				t.Errorf("got %t, expected %t", got, test.expected)
+			}
+		})
+	}
+}
+
+func TestTagMatches(t *testing.T) {
+
+	tests := []struct {
+		pattern  string
+		tag      string
+		expected bool
+	}{
+		{"245", "245", true},
+		{"245", "246", false},
+		{"9xx", "999", true},
+		{"9XX", "949", true},
+		{"9xx", "899", false},
+		{"x0x", "505", true},
+		{"xxx", "001", true},
+		{"24", "245", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.pattern+"/"+test.tag, func(t *testing.T) {
+			if got := tagMatches(test.pattern, test.tag); got != test.expected {
+				t.Errorf("got %t, expected %t", got, test.expected)
+			}
+		})
+	}
+}
+
+//
+// end of file
+//
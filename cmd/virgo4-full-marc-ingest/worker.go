@@ -1,8 +1,9 @@
 package main
 
 import (
-	"encoding/base64"
 	"github.com/uvalib/virgo4-sqs-sdk/awssqs"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"log"
 	"time"
 )
@@ -10,13 +11,14 @@ import (
 // time to wait before flushing pending records
 var flushTimeout = 5 * time.Second
 
-// number of times to retry a message put before giving up and terminating
+// number of times to retry a message put before giving up and spilling (or terminating)
 var sendRetries = uint(3)
 
-func worker(id int, config ServiceConfig, aws awssqs.AWS_SQS, outQueue awssqs.QueueHandle, cacheQueue awssqs.QueueHandle, records <-chan Record) {
+func worker(id int, config ServiceConfig, sink Sink, throttle *OutboundThrottle, tracker *RecordTracker, records <-chan Record) {
 
 	count := uint(0)
 	block := make([]Record, 0, awssqs.MAX_SQS_BLOCK_COUNT)
+	blockBytes := 0
 	var record Record
 	for {
 
@@ -33,17 +35,33 @@ func worker(id int, config ServiceConfig, aws awssqs.AWS_SQS, outQueue awssqs.Qu
 		// did we timeout, if not we have a message to process
 		if timeout == false {
 
+			// would this record take the block over the byte limit
+			size := 0
+			if config.DryRun == false {
+				size = outboundSize(record, config.CompressPayload)
+			}
+			if len(block) != 0 && blockBytes+size > config.MaxBatchBytes {
+
+				// send the block
+				sendBlock(config, sink, throttle, tracker, block)
+
+				// reset the block
+				block = block[:0]
+				blockBytes = 0
+			}
+
 			block = append(block, record)
+			blockBytes += size
 
 			// have we reached a block size limit
-			if count != 0 && count%awssqs.MAX_SQS_BLOCK_COUNT == awssqs.MAX_SQS_BLOCK_COUNT-1 {
+			if uint(len(block)) == awssqs.MAX_SQS_BLOCK_COUNT || blockBytes >= config.MaxBatchBytes {
 
 				// send the block
-				err := sendOutboundMessages(config, aws, outQueue, cacheQueue, block)
-				fatalIfError(err)
+				sendBlock(config, sink, throttle, tracker, block)
 
 				// reset the block
 				block = block[:0]
+				blockBytes = 0
 			}
 			count++
 
@@ -56,11 +74,11 @@ func worker(id int, config ServiceConfig, aws awssqs.AWS_SQS, outQueue awssqs.Qu
 			if len(block) != 0 {
 
 				// send the block
-				err := sendOutboundMessages(config, aws, outQueue, cacheQueue, block)
-				fatalIfError(err)
+				sendBlock(config, sink, throttle, tracker, block)
 
 				// reset the block
 				block = block[:0]
+				blockBytes = 0
 
 				log.Printf("INFO: worker %d processed %d records (flushing)", id, count)
 			}
@@ -73,74 +91,80 @@ func worker(id int, config ServiceConfig, aws awssqs.AWS_SQS, outQueue awssqs.Qu
 	// should never get here
 }
 
-func sendOutboundMessages(config ServiceConfig, aws awssqs.AWS_SQS, outQueue awssqs.QueueHandle, cacheQueue awssqs.QueueHandle, records []Record) error {
+// send a block of records, spilling them if they cannot be sent
+func sendBlock(config ServiceConfig, sink Sink, throttle *OutboundThrottle, tracker *RecordTracker, block []Record) {
 
-	count := len(records)
-	if count == 0 {
-		return nil
+	sent, err := sendOutboundMessages(config, sink, throttle, block)
+	if err != nil && outboundSpill != nil {
+		spilled, spillErr := outboundSpill.Spill(block, err)
+		fatalIfError(spillErr)
+		log.Printf("WARNING: spilled %d of %d records that could not be sent (%s)", len(spilled), len(block), err.Error())
+		markSpilled(tracker, block, spilled, sent)
+		return
 	}
+	fatalIfError(err)
+	markSent(tracker, block, sent)
+}
 
-	//
-	// we use copies of the messages for each queue because we want to ensure that new S3 objects are created
-	// if not, we have multiple messages that share an external S3 object
-	//
-
-	batch1 := make([]awssqs.Message, 0, count)
-	batch2 := make([]awssqs.Message, 0, count)
-	for _, m := range records {
-		msg := constructMessage(m)
-		batch1 = append(batch1, msg)
-		batch2 = append(batch2, msg)
+// note that the records have been sent in the specified number of messages
+func markSent(tracker *RecordTracker, records []Record, messages int) {
+	tracker.AddMessages(messages)
+	for _, r := range records {
+		tracker.Done(r.Sequence())
+		metricRecordsSent.WithLabelValues(r.Source()).Inc()
 	}
+}
 
-	opStatus1, err1 := aws.BatchMessagePut(outQueue, batch1)
-	if err1 != nil {
-		// if an error we can handle, retry
-		if err1 == awssqs.ErrOneOrMoreOperationsUnsuccessful {
-			log.Printf("WARNING: one or more items failed to send to the work queue, retrying...")
-
-			// retry the failed items and bail out if we cannot retry
-			err1 = aws.MessagePutRetry(outQueue, batch1, opStatus1, sendRetries)
+// note that some of the records have been spilled, they are resent at the end of the run. The others were sent
+// in the specified number of messages
+func markSpilled(tracker *RecordTracker, records []Record, spilled []Record, messages int) {
+	tracker.AddMessages(messages)
+	isSpilled := make(map[uint64]bool, len(spilled))
+	for _, r := range spilled {
+		isSpilled[r.Sequence()] = true
+	}
+	for _, r := range records {
+		if isSpilled[r.Sequence()] == true {
+			tracker.Spilled(r.Sequence())
+			continue
 		}
+		tracker.Done(r.Sequence())
+		metricRecordsSent.WithLabelValues(r.Source()).Inc()
+	}
+}
 
-		// bail out if an error and let someone else handle it
-		if err1 != nil {
-			return err1
+// note that the records could not be sent
+func markFailed(records []Record, err error) {
+	for _, f := range sendFailures(records, err) {
+		for _, r := range f.Records {
+			metricRecordsFailed.WithLabelValues(r.Source()).Inc()
 		}
 	}
+}
 
-	// if we are configured to send items to the cache
-	if cacheQueue != "" {
-
-		opStatus2, err2 := aws.BatchMessagePut(cacheQueue, batch2)
-		if err2 != nil {
-			// if an error we can handle, retry
-			if err2 == awssqs.ErrOneOrMoreOperationsUnsuccessful {
-				log.Printf("WARNING: one or more items failed to send to the cache queue, retrying...")
-				// retry the failed items and bail out if we cannot retry
-				err2 = aws.MessagePutRetry(cacheQueue, batch2, opStatus2, sendRetries)
-			}
+// send the records to the outbound sink, returns the number of messages sent
+func sendOutboundMessages(config ServiceConfig, sink Sink, throttle *OutboundThrottle, records []Record) (int, error) {
 
-			// bail out if an error and let someone else handle it
-			if err2 != nil {
-				return err2
-			}
-		}
+	count := len(records)
+	if count == 0 {
+		return 0, nil
 	}
 
-	// if we get here, everything worked as expected
-	return nil
-}
+	// nothing is sent during a dry run
+	if config.DryRun == true {
+		return 0, nil
+	}
 
-func constructMessage(record Record) awssqs.Message {
+	throttle.Wait(count)
 
-	id, _ := record.Id()
-	attributes := make([]awssqs.Attribute, 0, 4)
-	attributes = append(attributes, awssqs.Attribute{Name: awssqs.AttributeKeyRecordId, Value: id})
-	attributes = append(attributes, awssqs.Attribute{Name: awssqs.AttributeKeyRecordType, Value: awssqs.AttributeValueRecordTypeB64Marc})
-	attributes = append(attributes, awssqs.Attribute{Name: awssqs.AttributeKeyRecordSource, Value: record.Source()})
-	attributes = append(attributes, awssqs.Attribute{Name: awssqs.AttributeKeyRecordOperation, Value: awssqs.AttributeValueRecordOperationUpdate})
-	return awssqs.Message{Attribs: attributes, Payload: []byte(base64.StdEncoding.EncodeToString(record.Raw()))}
+	ctx, span := tracer.Start(getBatchContext(), "send-batch", trace.WithAttributes(attribute.Int("batch.records", count), attribute.String("batch.sink", sink.Name())))
+	sent, err := sink.Send(ctx, records)
+	if err != nil {
+		markFailed(records, err)
+	}
+	span.SetAttributes(attribute.Int("batch.messages", sent))
+	endSpan(span, err)
+	return sent, err
 }
 
 //